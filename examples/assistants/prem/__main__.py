@@ -7,15 +7,14 @@ from mistletoe.block_token import CodeFence
 from premai import Prem
 from premai.models import ChatCompletionResponse, Message, MessageRoleEnum
 
-# Ayup can read this from a .ayup-env file inside the assistant directory
-# It's a regular dotenv file, but under a different name to avoid conflicts
+# Set this on the server with 'ay secrets set --assistant local:prem PREM_API_KEY'
 prem_api_key = os.getenv("PREM_API_KEY")
 if prem_api_key is None:
-    raise ValueError("Environment variable PREM_API_KEY is not set. You can use a .ayup-env file to set it")
+    raise ValueError("Environment variable PREM_API_KEY is not set. You can set it with 'ay secrets set --assistant local:prem PREM_API_KEY'")
 
 project_id = os.getenv("PREM_PROJECT_ID")
 if project_id is None:
-    raise ValueError("Environment variable PREM_PROJECT_ID is not set. You can set variables in .ayup-env")
+    raise ValueError("Environment variable PREM_PROJECT_ID is not set. You can set it with 'ay secrets set --assistant local:prem PREM_PROJECT_ID'")
 
 # The raw response received from the LLM
 out_explanation_path = '/out/app/explanation.md'
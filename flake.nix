@@ -144,7 +144,7 @@
                     wantedBy = [ "multi-user.target" ];
                     requires = [ "network-online.target" ];
                     serviceConfig = {
-                      ExecStart = "${server}/bin/ay daemon start --aws --host /ip4/0.0.0.0/tcp/50051";
+                      ExecStart = "${server}/bin/ay daemon start --config-source=aws-sm://ayup-preauth-conf --host /ip4/0.0.0.0/tcp/50051";
                       User = "ayup";
                       RuntimeDirectory = "ayup";
                       StateDirectory = "ayup";
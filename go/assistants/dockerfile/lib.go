@@ -65,11 +65,13 @@ func (s *Assistant) Assist(aCtx assist.Context, state assist.State) (assist.Stat
 
 	caps := solverPb.Caps.CapSet(solverPb.Caps.All())
 
-	st, img, _, _, err := dockerfile2llb.Dockerfile2LLB(aCtx.Ctx, dfBytes, dockerfile2llb.ConvertOpt{
+	// Resolving the base images' metadata may have to pull them
+	convCtx, stopWatch := aCtx.WatchCancel("dockerfile")
+	st, img, _, _, err := dockerfile2llb.Dockerfile2LLB(convCtx.Ctx, dfBytes, dockerfile2llb.ConvertOpt{
 		MetaResolver: imagemetaresolver.Default(),
 		LLBCaps:      &caps,
 	})
-	if err != nil {
+	if err := stopWatch(err); err != nil {
 		return state, terror.Errorf(aCtx.Ctx, "Dockerfile2LLB: %w", err)
 	}
 
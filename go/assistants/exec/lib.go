@@ -60,14 +60,23 @@ func (s *Assistant) Assist(aCtx assist.Context, state assist.State) (assist.Stat
 	b := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
 		def := state.GetBuildDef()
 
-		r, err := c.Solve(ctx, gateway.SolveRequest{
+		// Once the app is executing, ExecProc handles cancel requests
+		solveCtx, stopWatch := aCtx.WatchCancel("build")
+		r, err := c.Solve(solveCtx.Ctx, gateway.SolveRequest{
 			Definition: def.ToPB(),
 		})
-		if err != nil {
+		if err := stopWatch(err); err != nil {
 			return nil, terror.Errorf(aCtx.Ctx, "client solve: %w", err)
 		}
 
+		// The container's address is found with its hostname
+		hostname, err := assist.NewHostname()
+		if err != nil {
+			return nil, terror.Errorf(ctx, "NewHostname: %w", err)
+		}
+
 		ctr, err := c.NewContainer(ctx, gateway.NewContainerRequest{
+			Hostname: hostname,
 			Mounts: []gateway.Mount{
 				{
 					Dest:      "/",
@@ -81,7 +90,7 @@ func (s *Assistant) Assist(aCtx assist.Context, state assist.State) (assist.Stat
 		}
 		defer func() { terror.Ackf(ctx, "ctr Release: %w", ctr.Release(ctx)) }()
 
-		if err := aCtx.ExecProc(ctr, "app", state.GetWorkingDir(), state.GetCmd()); err != nil {
+		if err := aCtx.ExecProc(ctr, hostname, "app", state.GetWorkingDir(), state.GetCmd()); err != nil {
 			return nil, err
 		}
 
@@ -93,6 +102,10 @@ func (s *Assistant) Assist(aCtx assist.Context, state assist.State) (assist.Stat
 		return state, terror.Errorf(aCtx.Ctx, "fsutil newfs: %w", err)
 	}
 
+	if aCtx.Procs != nil {
+		aCtx.Procs.SetPorts(state.GetPorts())
+	}
+
 	for _, p := range state.GetPorts() {
 		err := aCtx.Send(&pb.ActReply{
 			Variant: &pb.ActReply_Expose{
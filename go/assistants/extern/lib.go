@@ -82,8 +82,13 @@ func (s *Assistant) Assist(aCtx assist.Context, state assist.State) (assist.Stat
 	aCtx, span := aCtx.Span("Assist", attribute.String("self path", s.selfPath), attribute.String("app path", aCtx.AppPath))
 	defer span.End()
 
-	providerMap, secretsRunOpts, err := assist.LoadEnv(aCtx.Ctx, filepath.Join(s.selfPath, ".ayup-env"))
-	if err != nil && !os.IsNotExist(err) {
+	// Older clients upload secrets in .ayup-env, it isn't read and shouldn't be kept or built with
+	if err := os.Remove(filepath.Join(s.selfPath, ".ayup-env")); err != nil && !os.IsNotExist(err) {
+		return state, terror.Errorf(aCtx.Ctx, "os Remove: %w", err)
+	}
+
+	providerMap, secretsRunOpts, err := aCtx.LoadSecrets(s.Name())
+	if err != nil {
 		return state, err
 	}
 
@@ -164,7 +169,8 @@ func (s *Assistant) Assist(aCtx assist.Context, state assist.State) (assist.Stat
 		return state, terror.Errorf(aCtx.Ctx, "client is nil: %v", aCtx)
 	}
 
-	_, err = aCtx.Client.Build(aCtx.Ctx, client.SolveOpt{
+	buildCtx, stopWatch := aCtx.WatchCancel(s.Name())
+	_, err = aCtx.Client.Build(buildCtx.Ctx, client.SolveOpt{
 		Exports: []client.ExportEntry{
 			{
 				Type:      client.ExporterLocal,
@@ -182,7 +188,7 @@ func (s *Assistant) Assist(aCtx assist.Context, state assist.State) (assist.Stat
 		},
 	}, "ayup", b, aCtx.BuildkitStatusSender(s.Name(), nil))
 
-	if err != nil {
+	if err := stopWatch(err); err != nil {
 		return state, terror.Errorf(aCtx.Ctx, "client build: %w", err)
 	}
 
@@ -137,7 +137,7 @@ func (s *Assistant) pipreqs(aCtx assist.Context, state assist.State) error {
 	}
 
 	if r.Req.Cancel {
-		return terror.Errorf(aCtx.Ctx, "analysis canceled")
+		return &assist.CancelledError{Step: "pipreqs"}
 	}
 
 	choice := r.Req.Choice.GetBool()
@@ -192,11 +192,14 @@ func (s *Assistant) pipreqs(aCtx assist.Context, state assist.State) error {
 		return terror.Errorf(aCtx.Ctx, "fsutil newfs: %w", err)
 	}
 
-	if _, err := aCtx.Client.Build(aCtx.Ctx, client.SolveOpt{
+	buildCtx, stopWatch := aCtx.WatchCancel("pipreqs")
+	_, err = aCtx.Client.Build(buildCtx.Ctx, client.SolveOpt{
 		LocalMounts: map[string]fsutil.FS{
 			"context": contextFS,
 		},
-	}, "ayup", b, aCtx.BuildkitStatusSender("pipreqs", nil)); err != nil {
+	}, "ayup", b, aCtx.BuildkitStatusSender("pipreqs", nil))
+
+	if err := stopWatch(err); err != nil {
 		return terror.Errorf(aCtx.Ctx, "build: %w", err)
 	}
 
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"go.opentelemetry.io/otel/attribute"
 
@@ -18,6 +19,7 @@ import (
 )
 
 type Registry struct {
+	mutex sync.Mutex
 	table map[string]assist.Assistant
 }
 
@@ -42,6 +44,9 @@ func (s *Registry) RegisterDir(ctx context.Context, kind assist.Kind, path strin
 	fullName := assist.FullName(kind, name)
 	trace.Event(ctx, "register assistant", attribute.String("name", fullName), attribute.String("path", path))
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if _, ok := s.table[fullName]; ok {
 		return nil, terror.Errorf(ctx, "already exists: %s", fullName)
 	}
@@ -96,11 +101,15 @@ func (s *Registry) Get(ctx context.Context, name string) (assist.Assistant, erro
 	case string(assist.Builtin):
 	case string(assist.Local):
 	case string(assist.Remote):
+	case string(assist.App):
 	default:
 		return nil, terror.Errorf(ctx, "Invalid assistant kind: %s", name)
 	}
 
+	s.mutex.Lock()
 	assist, ok := s.table[name]
+	s.mutex.Unlock()
+
 	if !ok {
 		return nil, terror.Errorf(ctx, "assist.Assistant not found: %s", name)
 	}
@@ -108,6 +117,9 @@ func (s *Registry) Get(ctx context.Context, name string) (assist.Assistant, erro
 }
 
 func (s *Registry) List() []assist.Assistant {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	list := make([]assist.Assistant, len(s.table))
 
 	i := 0
@@ -120,5 +132,63 @@ func (s *Registry) List() []assist.Assistant {
 }
 
 func (s *Registry) Del(fullName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	delete(s.table, fullName)
 }
+
+// AppRegistry is the registry one app's assistants are found in. The assistant uploaded with the
+// app is kept here rather than in the shared registry, so pushing an app can't replace the
+// assistants other apps use.
+type AppRegistry struct {
+	shared *Registry
+	app    assist.Assistant
+}
+
+var _ assist.Registry = (*AppRegistry)(nil)
+
+// ForApp returns a registry with the app's assistant in path, if there is one, added to the
+// shared ones under the app kind
+func (s *Registry) ForApp(ctx context.Context, path string) (*AppRegistry, error) {
+	r := &AppRegistry{shared: s}
+	if path == "" {
+		return r, nil
+	}
+
+	bs, err := assist.LoadName(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.app = extern.New(assist.App, string(bs), path)
+	trace.Event(ctx, "app assistant", attribute.String("name", r.app.Name()), attribute.String("path", path))
+
+	return r, nil
+}
+
+// Get finds the app's assistant under the app kind or a shared one. Assistants pushed with an app
+// used to be local, so local:foo is also the app's assistant app:foo if it has one.
+func (s *AppRegistry) Get(ctx context.Context, name string) (assist.Assistant, error) {
+	name = strings.TrimSpace(name)
+	kind, bare, _ := strings.Cut(name, ":")
+	isLocal := kind == string(assist.Local)
+
+	if s.app != nil {
+		if name == s.app.Name() {
+			return s.app, nil
+		}
+
+		if isLocal && assist.FullName(assist.App, bare) == s.app.Name() {
+			trace.Event(ctx, "using the app assistant for its old name", attribute.String("name", name))
+			return s.app, nil
+		}
+	}
+
+	a, err := s.shared.Get(ctx, name)
+	if err != nil && isLocal {
+		return nil, terror.Errorf(ctx, "%w; if it was pushed with the app, it is named %s now", err, assist.FullName(assist.App, bare))
+	}
+
+	return a, err
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"context"
+	"fmt"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+func printResult(ctx context.Context, title string, app string, rerr *pb.Error) error {
+	if rerr != nil {
+		return terror.Errorf(ctx, "%s", rerr.Error)
+	}
+
+	fmt.Println(tui.TitleStyle.Render(title), app)
+
+	return nil
+}
+
+// Start runs an app which has already been pushed in the background
+func Start(pctx context.Context, host string, privKey string, app string) error {
+	ctx, span := trace.Span(pctx, "app start")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.AppStart(ctx, &pb.AppStartReq{App: app})
+	if err != nil {
+		return terror.Errorf(ctx, "client AppStart: %w", err)
+	}
+
+	return printResult(ctx, "Started:", app, resp.Error)
+}
+
+// Stop an app running in the background
+func Stop(pctx context.Context, host string, privKey string, app string) error {
+	ctx, span := trace.Span(pctx, "app stop")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.AppStop(ctx, &pb.AppStopReq{App: app})
+	if err != nil {
+		return terror.Errorf(ctx, "client AppStop: %w", err)
+	}
+
+	return printResult(ctx, "Stopped:", app, resp.Error)
+}
+
+// Restart an app in the background, it is started if it is not running
+func Restart(pctx context.Context, host string, privKey string, app string) error {
+	ctx, span := trace.Span(pctx, "app restart")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.AppRestart(ctx, &pb.AppRestartReq{App: app})
+	if err != nil {
+		return terror.Errorf(ctx, "client AppRestart: %w", err)
+	}
+
+	return printResult(ctx, "Restarted:", app, resp.Error)
+}
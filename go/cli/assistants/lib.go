@@ -53,6 +53,7 @@ func Push(ctx context.Context, host string, privKey string, path string) error {
 	pusher := push.Pusher{
 		Host:         host,
 		Client:       c,
+		App:          push.AppName("", path),
 		AssistantDir: path,
 	}
 
@@ -60,7 +61,7 @@ func Push(ctx context.Context, host string, privKey string, path string) error {
 		return err
 	}
 
-	if _, err := c.AssistantsPush(ctx, &pb.AssistantsPushReq{}); err != nil {
+	if _, err := c.AssistantsPush(ctx, &pb.AssistantsPushReq{App: pusher.App}); err != nil {
 		return terror.Errorf(ctx, "client AssistantsPush: %w", err)
 	}
 
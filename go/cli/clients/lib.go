@@ -0,0 +1,122 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// List prints the clients which are authorized to connect to the server with libp2p
+func List(pctx context.Context, host string, privKey string) error {
+	ctx, span := trace.Span(pctx, "clients list")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.ClientsList(ctx, &pb.ClientsListReq{})
+	if err != nil {
+		return terror.Errorf(ctx, "client ClientsList: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	if len(resp.Clients) < 1 {
+		fmt.Println("No clients have been authorized")
+		return nil
+	}
+
+	for _, client := range resp.Clients {
+		// Pre-authorized clients have no approval time
+		approved := "pre-authorized"
+		if client.Approved > 0 {
+			approved = time.Unix(client.Approved, 0).Format(time.DateTime)
+		}
+
+		fmt.Println(tui.TitleStyle.Render(client.Peer), client.Label, client.Role, tui.VersionStyle.Render(approved))
+	}
+
+	return nil
+}
+
+// Revoke removes the client's authorization and disconnects it
+func Revoke(pctx context.Context, host string, privKey string, client string) error {
+	ctx, span := trace.Span(pctx, "clients revoke")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.ClientsRevoke(ctx, &pb.ClientsRevokeReq{Client: client})
+	if err != nil {
+		return terror.Errorf(ctx, "client ClientsRevoke: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Revoked:"), client)
+
+	return nil
+}
+
+// Rename changes the label the client is listed with
+func Rename(pctx context.Context, host string, privKey string, client string, label string) error {
+	ctx, span := trace.Span(pctx, "clients rename")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.ClientsRename(ctx, &pb.ClientsRenameReq{Client: client, Label: label})
+	if err != nil {
+		return terror.Errorf(ctx, "client ClientsRename: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Renamed:"), client, "to", label)
+
+	return nil
+}
+
+// SetRole changes what the client is allowed to do
+func SetRole(pctx context.Context, host string, privKey string, client string, role string) error {
+	ctx, span := trace.Span(pctx, "clients set role")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.ClientsSetRole(ctx, &pb.ClientsSetRoleReq{Client: client, Role: role})
+	if err != nil {
+		return terror.Errorf(ctx, "client ClientsSetRole: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Role set:"), client, "is now", role)
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// RotateKey makes the daemon create its next key and prints the handoff clients need to accept it
+func RotateKey(pctx context.Context, host string, privKey string) error {
+	ctx, span := trace.Span(pctx, "daemon rotate key")
+	defer span.End()
+
+	c, err := controlClient(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.ServerRotateKey(ctx, &pb.ServerRotateKeyReq{})
+	if err != nil {
+		return terror.Errorf(ctx, "client ServerRotateKey: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("New Peer ID:"), resp.Peer)
+	fmt.Println(tui.TitleStyle.Render("Handoff:"), resp.Handoff)
+	fmt.Println()
+	fmt.Println("The new key was saved to the daemon's env file as AYUP_SERVER_P2P_PRIV_KEY, or its encrypted")
+	fmt.Println("key file, whichever it was loaded from.")
+	fmt.Println()
+	fmt.Println("Until the daemon restarts, clients can switch to the new peer ID by running")
+	fmt.Println("\t", "ay servers accept")
+	fmt.Println("After it restarts, give them the handoff to run")
+	fmt.Println("\t", fmt.Sprintf("ay servers accept %s", resp.Handoff))
+
+	return nil
+}
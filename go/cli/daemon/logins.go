@@ -0,0 +1,113 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"premai.io/Ayup/go/internal/conf"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// controlClient connects to the host or if it is empty, the local daemon's control socket
+func controlClient(ctx context.Context, host string, privKey string) (pb.SrvClient, error) {
+	if host == "" {
+		host = "unix://" + conf.ControlSocket()
+	}
+
+	return rpc.ClientEnsureKey(ctx, host, privKey)
+}
+
+// Logins prints the logins which are waiting to be approved
+func Logins(pctx context.Context, host string, privKey string) error {
+	ctx, span := trace.Span(pctx, "daemon logins")
+	defer span.End()
+
+	c, err := controlClient(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.LoginsList(ctx, &pb.LoginsListReq{})
+	if err != nil {
+		return terror.Errorf(ctx, "client LoginsList: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	if len(resp.Logins) < 1 {
+		fmt.Println("No logins are waiting to be approved")
+		return nil
+	}
+
+	for _, l := range resp.Logins {
+		expires := time.Until(time.Unix(l.Expires, 0)).Round(time.Second)
+		fmt.Println(tui.TitleStyle.Render(l.Peer), l.Label, tui.VersionStyle.Render(fmt.Sprintf("expires in %s", expires)))
+	}
+
+	return nil
+}
+
+// Approve lets a client which is waiting to login use the server with the given role, or rejects
+// it
+func Approve(pctx context.Context, host string, privKey string, client string, role string, reject bool) error {
+	ctx, span := trace.Span(pctx, "daemon approve")
+	defer span.End()
+
+	c, err := controlClient(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.LoginApprove(ctx, &pb.LoginApproveReq{Client: client, Role: role, Reject: reject})
+	if err != nil {
+		return terror.Errorf(ctx, "client LoginApprove: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	if reject {
+		fmt.Println(tui.TitleStyle.Render("Rejected:"), client)
+	} else {
+		fmt.Println(tui.TitleStyle.Render("Approved:"), client, "as", role)
+	}
+
+	return nil
+}
+
+// Invite creates a code which lets a client login once without being approved
+func Invite(pctx context.Context, host string, privKey string, role string, expiresIn time.Duration) error {
+	ctx, span := trace.Span(pctx, "daemon invite")
+	defer span.End()
+
+	c, err := controlClient(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.InviteCreate(ctx, &pb.InviteCreateReq{Role: role, ExpiresIn: int64(expiresIn.Seconds())})
+	if err != nil {
+		return terror.Errorf(ctx, "client InviteCreate: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	expires := time.Unix(resp.Expires, 0).Format(time.DateTime)
+	fmt.Println(tui.TitleStyle.Render("Invite:"), resp.Code)
+	fmt.Println(tui.VersionStyle.Render(fmt.Sprintf("It can be used once until %s and gives the %s role, login with one of", expires, role)))
+	for _, addr := range resp.Addrs {
+		fmt.Println("\t", fmt.Sprintf("ay login %s --invite %s", addr, resp.Code))
+	}
+
+	return nil
+}
@@ -8,6 +8,10 @@ import (
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 
+	"premai.io/Ayup/go/cli/profiles"
+	"premai.io/Ayup/go/internal/conf"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
 	"premai.io/Ayup/go/internal/terror"
 	"premai.io/Ayup/go/internal/trace"
 	"premai.io/Ayup/go/internal/tui"
@@ -43,3 +47,104 @@ func New(ctx context.Context) error {
 	return nil
 
 }
+
+// Rotate replaces the client's key for the server at host. The server is sent a handoff signed
+// with the old and new keys, which it uses to replace the client's peer ID.
+func Rotate(pctx context.Context, host string, b64PrivKey string) error {
+	ctx, span := trace.Span(pctx, "key rotate")
+	defer span.End()
+
+	if b64PrivKey == "" && !conf.HasKeyFile("AYUP_CLIENT_P2P_PRIV_KEY") {
+		return terror.Errorf(ctx, "There is no client key to rotate, it is created on login")
+	}
+
+	info, err := peer.AddrInfoFromString(host)
+	if err != nil {
+		return terror.Errorf(ctx, "Only keys used with libp2p can be rotated, the host should be the server's multiaddress: %w", err)
+	}
+
+	oldKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", b64PrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.ClientWithKey(ctx, host, oldKey)
+	if err != nil {
+		return err
+	}
+
+	newKey, b64NewKey, err := rpc.GenerateKey()
+	if err != nil {
+		return terror.Errorf(ctx, "rpc GenerateKey: %w", err)
+	}
+
+	handoff, err := rpc.NewHandoff(oldKey, newKey, info.ID)
+	if err != nil {
+		return terror.Errorf(ctx, "rpc NewHandoff: %w", err)
+	}
+
+	resp, err := c.ClientRotateKey(ctx, &pb.ClientRotateKeyReq{Handoff: handoff})
+	if err != nil {
+		return terror.Errorf(ctx, "client ClientRotateKey: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	titleStyle := tui.TitleStyle
+
+	newId, err := peer.IDFromPrivateKey(newKey)
+	if err != nil {
+		return terror.Errorf(ctx, "peer IDFromPrivateKey: %w", err)
+	}
+
+	fmt.Println(titleStyle.Render("Rotated!"), "The server now knows this client as", newId)
+
+	where, err := profiles.SaveKey(ctx, host, b64NewKey)
+	if err != nil {
+		// The server only accepts the new key now, so it mustn't be lost
+		fmt.Println(titleStyle.Render("Private Key: "), b64NewKey)
+		return terror.Errorf(ctx, "The new key couldn't be saved, set AYUP_CLIENT_P2P_PRIV_KEY to the key above: %w", err)
+	}
+
+	fmt.Println("Saved the new key in", where)
+
+	return nil
+}
+
+// Encrypt moves the key from the env file to a key file encrypted with a passphrase. The key is
+// unlocked with a prompt or AYUP_KEY_PASSPHRASE when it is used.
+func Encrypt(pctx context.Context, confName string, b64PrivKey string) error {
+	ctx, span := trace.Span(pctx, "key encrypt")
+	defer span.End()
+
+	if conf.HasKeyFile(confName) {
+		return terror.Errorf(ctx, "The key is already encrypted")
+	}
+
+	if b64PrivKey == "" {
+		return terror.Errorf(ctx, "There is no key to encrypt, %s isn't set", confName)
+	}
+
+	// Make sure what is encrypted can be used
+	privKey, err := rpc.EnsurePrivKey(ctx, confName, b64PrivKey)
+	if err != nil {
+		return err
+	}
+
+	path, err := conf.EncryptKey(ctx, confName, b64PrivKey)
+	if err != nil {
+		return err
+	}
+
+	peerId, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return terror.Errorf(ctx, "peer IDFromPrivateKey: %w", err)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Encrypted!"), "The key for", peerId, "was moved to", path)
+	fmt.Println("If", confName, "is set anywhere other than the env file, then remove it")
+
+	return nil
+}
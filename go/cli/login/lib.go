@@ -3,9 +3,11 @@ package login
 import (
 	"context"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
-	"premai.io/Ayup/go/internal/conf"
+	"premai.io/Ayup/go/cli/profiles"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
 	"premai.io/Ayup/go/internal/rpc"
 	"premai.io/Ayup/go/internal/terror"
@@ -13,15 +15,49 @@ import (
 	"premai.io/Ayup/go/internal/tui"
 )
 
+// checkInvite makes sure the invite is for the server we are logging into, so that it is not
+// given away to some other server
+func checkInvite(host string, invite string) error {
+	server, _, err := rpc.ParseInvite(invite)
+	if err != nil {
+		return err
+	}
+
+	info, err := peer.AddrInfoFromString(host)
+	if err != nil {
+		return fmt.Errorf("invites need the server's multiaddress including its peer ID: %w", err)
+	}
+
+	if info.ID != server {
+		return fmt.Errorf("the invite is for the server %s, not %s", server, info.ID)
+	}
+
+	return nil
+}
+
 type Login struct {
 	Host       string
 	P2pPrivKey string
+	// Shown to the server's admin when they approve the login and when they list clients
+	Label string
+	// How long to wait for the login to be approved
+	Timeout time.Duration
+	// A code from 'ay daemon invite' which authorizes the client straight away
+	Invite string
+	// The name of the context the server is saved as, derived from the host if empty
+	Context string
 }
 
 func (s *Login) Run(pctx context.Context) error {
 	ctx, span := trace.Span(pctx, "login")
 	defer span.End()
 
+	if s.Invite != "" {
+		if err := checkInvite(s.Host, s.Invite); err != nil {
+			return err
+		}
+	}
+
 	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
 	if err != nil {
 		return err
@@ -38,9 +74,29 @@ func (s *Login) Run(pctx context.Context) error {
 	}
 
 	fmt.Println(tui.TitleStyle.Render("Peer ID:"), peerId)
-	fmt.Println(tui.TitleStyle.Render("Sending login request;"), "use the server console to confirm the request from this peer ID")
+	if s.Invite != "" {
+		fmt.Println(tui.TitleStyle.Render("Sending login request with an invite"))
+	} else {
+		fmt.Println(tui.TitleStyle.Render("Sending login request;"), "waiting for it to be approved on the server with", tui.TitleStyle.Render(fmt.Sprintf("ay daemon approve %s", peerId)))
+	}
+
+	label := s.Label
+	if label == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			label = hostname
+		}
+	}
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
 
-	res, err := c.Login(ctx, &pb.LoginReq{})
+	res, err := c.Login(ctx, &pb.LoginReq{Label: label, Invite: s.Invite})
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("the login was not approved within %s", s.Timeout)
+	}
 	if err != nil {
 		return terror.Errorf(ctx, "grpc login: %w", err)
 	}
@@ -49,11 +105,19 @@ func (s *Login) Run(pctx context.Context) error {
 		return fmt.Errorf("remote error: %s", res.GetError().Error)
 	}
 
-	fmt.Println(tui.TitleStyle.Render("Authorized!"), "The server will now accept requests from this client.")
+	fmt.Println(tui.TitleStyle.Render("Authorized!"), "The server will now accept requests from this client with the role:", res.Role)
+
+	if err := rpc.TrustServer(ctx, s.Host); err != nil {
+		return err
+	}
 
-	if err := conf.Set(ctx, "AYUP_PUSH_HOST", s.Host); err == nil {
-		fmt.Println("Setting this server as the push default, you can override it with", tui.TitleStyle.Render("AYUP_PUSH_HOST"))
+	name, err := profiles.Remember(ctx, s.Context, s.Host, s.P2pPrivKey)
+	if err != nil {
+		terror.Ackf(ctx, "profiles Remember: %w", err)
+		return nil
 	}
 
+	fmt.Println("Saved this server as the context", tui.TitleStyle.Render(name), "and made it the current one, switch between servers with", tui.TitleStyle.Render("ay context use"))
+
 	return nil
 }
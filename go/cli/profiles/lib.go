@@ -0,0 +1,367 @@
+package profiles
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+
+	"premai.io/Ayup/go/internal/conf"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// serverPeer returns the peer ID in the host's multiaddr or an empty string if it doesn't
+// have one
+func serverPeer(host string) (string, error) {
+	maddr, err := multiaddr.NewMultiaddr(host)
+	if err != nil {
+		// host:port, which is connected to without libp2p
+		return "", nil
+	}
+
+	if _, err := maddr.ValueForProtocol(multiaddr.P_P2P); err != nil {
+		return "", nil
+	}
+
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return "", fmt.Errorf("peer AddrInfoFromP2pAddr: %w", err)
+	}
+
+	return info.ID.String(), nil
+}
+
+// defaultName derives a profile name from the server's DNS name or IP address
+func defaultName(host string) string {
+	maddr, err := multiaddr.NewMultiaddr(host)
+	if err != nil {
+		return "default"
+	}
+
+	for _, proto := range []int{multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6, multiaddr.P_IP4, multiaddr.P_IP6} {
+		if val, err := maddr.ValueForProtocol(proto); err == nil {
+			return val
+		}
+	}
+
+	return "default"
+}
+
+func checkName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n/") {
+		return fmt.Errorf("the context name can't be empty or contain spaces or slashes: %q", name)
+	}
+
+	return nil
+}
+
+// Add saves a profile for the server at host. The peer ID is taken from the host's multiaddr if
+// it is not given.
+func Add(pctx context.Context, name string, host string, peerId string, privKey string) error {
+	ctx, span := trace.Span(pctx, "context add")
+	defer span.End()
+
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	hostPeer, err := serverPeer(host)
+	if err != nil {
+		return terror.Errorf(ctx, "The host is not a valid server multiaddr: %w", err)
+	}
+
+	if peerId != "" {
+		id, err := peer.Decode(peerId)
+		if err != nil {
+			return terror.Errorf(ctx, "The peer ID is not valid: %w", err)
+		}
+		peerId = id.String()
+
+		if hostPeer != "" && hostPeer != peerId {
+			return terror.Errorf(ctx, "The host has the peer ID %s, not %s", hostPeer, peerId)
+		}
+		if hostPeer == "" {
+			if _, err := multiaddr.NewMultiaddr(host); err != nil {
+				return terror.Errorf(ctx, "A peer ID can only be pinned for a libp2p multiaddr, not %s", host)
+			}
+		}
+	} else {
+		peerId = hostPeer
+	}
+
+	if privKey != "" {
+		bs, err := base64.StdEncoding.DecodeString(privKey)
+		if err != nil {
+			return terror.Errorf(ctx, "The key is not valid base64, it can be made with 'ay key new': %w", err)
+		}
+		if _, err := crypto.UnmarshalPrivateKey(bs); err != nil {
+			return terror.Errorf(ctx, "The key is not valid, it can be made with 'ay key new': %w", err)
+		}
+	}
+
+	profiles, err := conf.LoadProfiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := profiles.Profiles[name]; ok {
+		return terror.Errorf(ctx, "The context %s already exists, remove it first with 'ay context rm %s'", name, name)
+	}
+
+	profiles.Profiles[name] = conf.Profile{Host: host, Peer: peerId, P2pPrivKey: privKey}
+	if profiles.Current == "" {
+		profiles.Current = name
+	}
+
+	if err := profiles.Save(ctx); err != nil {
+		return err
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Added:"), name, profiles.Profiles[name].Target())
+	if profiles.Current == name {
+		fmt.Println("It is the current context")
+	}
+
+	return nil
+}
+
+// Remember saves the server the client just logged into as a profile and makes it the current
+// one. If a profile already has the same host then it is reused, otherwise a new one is added.
+// The client key is saved if it is not the default one.
+func Remember(ctx context.Context, name string, host string, privKey string) (string, error) {
+	profiles, err := conf.LoadProfiles(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if name == "" {
+		name = profiles.Find(host)
+	}
+
+	if name == "" {
+		base := defaultName(host)
+		name = base
+		for i := 2; ; i++ {
+			if _, ok := profiles.Profiles[name]; !ok {
+				break
+			}
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+	}
+
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+
+	peerId, err := serverPeer(host)
+	if err != nil {
+		return "", terror.Errorf(ctx, "serverPeer: %w", err)
+	}
+
+	profile := profiles.Profiles[name]
+	profile.Host = host
+	profile.Peer = peerId
+
+	defaultKey, err := conf.Get(ctx, "AYUP_CLIENT_P2P_PRIV_KEY")
+	if err != nil {
+		return "", err
+	}
+	if privKey != defaultKey {
+		if _, err := setKey(ctx, name, &profile, privKey); err != nil {
+			return "", err
+		}
+	}
+
+	profiles.Profiles[name] = profile
+	profiles.Current = name
+
+	return name, profiles.Save(ctx)
+}
+
+// Use makes the named profile the current one, or if project is set, the one used by the project
+// in dir. An empty name removes the project's override.
+func Use(pctx context.Context, name string, project bool, dir string) error {
+	ctx, span := trace.Span(pctx, "context use")
+	defer span.End()
+
+	profiles, err := conf.LoadProfiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		if !project {
+			return terror.Errorf(ctx, "Say which context to use, see 'ay context list'")
+		}
+
+		if err := conf.SetProjectProfile(ctx, dir, ""); err != nil {
+			return err
+		}
+
+		fmt.Println(tui.TitleStyle.Render("Using the current context:"), "this project no longer has its own")
+		return nil
+	}
+
+	if _, ok := profiles.Profiles[name]; !ok {
+		return terror.Errorf(ctx, "The context %s doesn't exist, see 'ay context list'", name)
+	}
+
+	if project {
+		if err := conf.SetProjectProfile(ctx, dir, name); err != nil {
+			return err
+		}
+
+		fmt.Println(tui.TitleStyle.Render("Using:"), name, "in this project")
+		return nil
+	}
+
+	profiles.Current = name
+	if err := profiles.Save(ctx); err != nil {
+		return err
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Using:"), name)
+
+	return nil
+}
+
+// List prints the profiles, marking the one used in the project dir
+func List(pctx context.Context, dir string) error {
+	ctx, span := trace.Span(pctx, "context list")
+	defer span.End()
+
+	profiles, err := conf.LoadProfiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(profiles.Profiles) < 1 {
+		fmt.Println("No contexts have been added, see 'ay context add' and 'ay login'")
+		return nil
+	}
+
+	project, err := conf.ProjectProfile(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	active, err := profiles.Active(dir)
+	if err != nil {
+		return terror.Errorf(ctx, "profiles Active: %w", err)
+	}
+
+	for _, name := range profiles.Names() {
+		profile := profiles.Profiles[name]
+
+		mark := " "
+		if name == active {
+			mark = "*"
+		}
+
+		var notes []string
+		if name == profiles.Current {
+			notes = append(notes, "current")
+		}
+		if name == project {
+			notes = append(notes, "project")
+		}
+		if profile.P2pKeyFile != "" {
+			notes = append(notes, "own encrypted key")
+		} else if profile.P2pPrivKey != "" {
+			notes = append(notes, "own key")
+		}
+
+		fmt.Println(mark, tui.TitleStyle.Render(name), profile.Target(), tui.VersionStyle.Render(strings.Join(notes, ", ")))
+	}
+
+	return nil
+}
+
+// Rm removes the named profile
+func Rm(pctx context.Context, name string) error {
+	ctx, span := trace.Span(pctx, "context rm")
+	defer span.End()
+
+	profiles, err := conf.LoadProfiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := profiles.Profiles[name]; !ok {
+		return terror.Errorf(ctx, "The context %s doesn't exist, see 'ay context list'", name)
+	}
+
+	if path := profiles.Profiles[name].P2pKeyFile; path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return terror.Errorf(ctx, "os Remove: %w", err)
+		}
+	}
+
+	delete(profiles.Profiles, name)
+	if profiles.Current == name {
+		profiles.Current = ""
+	}
+
+	if err := profiles.Save(ctx); err != nil {
+		return err
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Removed:"), name)
+
+	return nil
+}
+
+// setKey sets the client key used with the named profile. It is encrypted if the profile's key
+// already was or the client's keys have been encrypted, so it isn't left in contexts.json.
+func setKey(ctx context.Context, name string, profile *conf.Profile, privKey string) (string, error) {
+	if profile.P2pKeyFile == "" && !conf.HasKeyFile("AYUP_CLIENT_P2P_PRIV_KEY") {
+		profile.P2pPrivKey = privKey
+		return fmt.Sprintf("the context %s", name), nil
+	}
+
+	path, err := conf.SaveProfileKey(ctx, name, privKey)
+	if err != nil {
+		return "", err
+	}
+	profile.P2pKeyFile = path
+	profile.P2pPrivKey = ""
+
+	return fmt.Sprintf("the context %s's encrypted key file", name), nil
+}
+
+// SaveKey saves the client's new key for the server at host. It goes in the server's context if
+// it has one, so that other servers are still connected to with the old key. Otherwise it
+// replaces AYUP_CLIENT_P2P_PRIV_KEY in the env file or encrypted key file. If the keys are
+// encrypted, then so is the context's key.
+func SaveKey(ctx context.Context, host string, privKey string) (string, error) {
+	profiles, err := conf.LoadProfiles(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if name := profiles.Find(host); name != "" {
+		profile := profiles.Profiles[name]
+
+		where, err := setKey(ctx, name, &profile, privKey)
+		if err != nil {
+			return "", err
+		}
+		profiles.Profiles[name] = profile
+
+		return where, profiles.Save(ctx)
+	}
+
+	where := "AYUP_CLIENT_P2P_PRIV_KEY in the env file"
+	if conf.HasKeyFile("AYUP_CLIENT_P2P_PRIV_KEY") {
+		where = "the encrypted key file"
+	}
+
+	return where, conf.SaveKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", privKey)
+}
@@ -27,6 +27,7 @@ type AssistView struct {
 	span      tr.Span
 	stream    pb.Srv_AssistClient
 	forwarder *Forwarder
+	progress  *sessionProgress
 
 	choice       *huh.Form
 	spinner      spinner.Model
@@ -44,7 +45,7 @@ type AssistView struct {
 
 type choiceMsg *pb.ChoiceBool
 
-func NewAssistView(ctx context.Context, stream pb.Srv_AssistClient, fwd *Forwarder) AssistView {
+func NewAssistView(ctx context.Context, stream pb.Srv_AssistClient, fwd *Forwarder, progress *sessionProgress) AssistView {
 	var hist strings.Builder
 	s := spinner.New()
 	s.Spinner = spinner.Points
@@ -56,6 +57,7 @@ func NewAssistView(ctx context.Context, stream pb.Srv_AssistClient, fwd *Forward
 		hist:      &hist,
 		stream:    stream,
 		forwarder: fwd,
+		progress:  progress,
 
 		spinner: s,
 
@@ -73,9 +75,17 @@ func (s AssistView) recvMsgCmd() tea.Cmd {
 			if err == io.EOF {
 				return func() DoneMsg { return DoneMsg{} }
 			}
+			if s.progress.id != "" {
+				return terror.Errorf(s.ctx, "stream recv: %w; reconnect with 'ay app attach'", err)
+			}
 			return terror.Errorf(s.ctx, "stream recv: %w", err)
 		}
 
+		if res.Seq > 0 {
+			s.progress.id = res.Session
+			s.progress.seq = res.Seq
+		}
+
 		if res.Variant == nil {
 			trace.Event(s.ctx, "recv nil done")
 			return DoneMsg{}
@@ -83,7 +93,7 @@ func (s AssistView) recvMsgCmd() tea.Cmd {
 
 		switch v := res.Variant.(type) {
 		case *pb.ActReply_Error:
-			return terror.Errorf(s.ctx, "%s", v.Error)
+			return replyError(s.ctx, v.Error)
 		case *pb.ActReply_Log:
 			return LogMsg{
 				source: res.GetSource(),
@@ -95,6 +105,12 @@ func (s AssistView) recvMsgCmd() tea.Cmd {
 				return choiceMsg(choice)
 			}
 		case *pb.ActReply_Expose:
+			if s.forwarder == nil {
+				return LogMsg{
+					source: "proxy",
+					body:   fmt.Sprintf("Exposed port: %d", v.Expose.Port),
+				}
+			}
 			if err := s.forwarder.startPortForwarder(s.ctx, v.Expose.Port); err != nil {
 				return LogMsg{
 					source: "proxy",
@@ -303,8 +319,24 @@ func (s AssistView) View() string {
 	}
 }
 
-func (s *Pusher) Assist(pctx context.Context, fwd *Forwarder) (err error) {
-	ctx, span := trace.Span(pctx, "assist")
+func (s *Pusher) Assist(ctx context.Context, fwd *Forwarder) error {
+	return s.assist(ctx, fwd, &pb.ActReq{App: s.App, Detach: s.Detach})
+}
+
+// Attach to the app's current session, replaying anything we missed since we were last attached
+func (s *Pusher) Attach(ctx context.Context, fwd *Forwarder) error {
+	progress := loadSession(ctx, s.App)
+
+	return s.assist(ctx, fwd, &pb.ActReq{
+		App:     s.App,
+		Attach:  true,
+		Session: progress.id,
+		Seq:     progress.seq,
+	})
+}
+
+func (s *Pusher) assist(pctx context.Context, fwd *Forwarder, req *pb.ActReq) (err error) {
+	ctx, span := trace.Span(pctx, "assist", attr.Bool("attach", req.Attach))
 	defer span.End()
 
 	stream, err := s.Client.Assist(ctx)
@@ -318,12 +350,17 @@ func (s *Pusher) Assist(pctx context.Context, fwd *Forwarder) (err error) {
 		}
 	}()
 
-	err = stream.Send(&pb.ActReq{})
+	err = stream.Send(req)
 	if err != nil {
 		return err
 	}
 
-	view := NewAssistView(ctx, stream, fwd)
+	progress := sessionProgress{}
+	if req.Attach {
+		progress = sessionProgress{id: req.Session, seq: req.Seq}
+	}
+
+	view := NewAssistView(ctx, stream, fwd, &progress)
 	prog := tea.NewProgram(view, tea.WithContext(ctx))
 	model, err := prog.Run()
 	if err != nil {
@@ -333,8 +370,10 @@ func (s *Pusher) Assist(pctx context.Context, fwd *Forwarder) (err error) {
 	view = model.(AssistView)
 
 	if view.err != nil {
+		terror.Ackf(ctx, "saveSession: %w", saveSession(ctx, s.App, progress))
 		return view.err
 	}
+	forgetSession(ctx, s.App)
 
 	msg, err := stream.Recv()
 	if msg != nil {
@@ -18,13 +18,15 @@ import (
 type Forwarder struct {
 	wg     sync.WaitGroup
 	Client pb.SrvClient
+	App    string
 
 	listeners map[uint32]net.Listener
 }
 
-func newForwarder(client pb.SrvClient) Forwarder {
+func newForwarder(client pb.SrvClient, app string) Forwarder {
 	return Forwarder{
 		Client:    client,
+		App:       app,
 		listeners: map[uint32]net.Listener{},
 	}
 }
@@ -33,6 +35,12 @@ func (s *Forwarder) startPortForwarder(ctx context.Context, port uint32) error {
 	ctx, span := trace.Span(ctx, "start port forwarder")
 	defer span.End()
 
+	// The server exposes the ports again when we reattach to a session
+	if _, ok := s.listeners[port]; ok {
+		trace.Event(ctx, "already forwarding", attribute.Int("port", int(port)))
+		return nil
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
 	if err != nil {
 		return terror.Errorf(ctx, "net listen: %w", err)
@@ -65,6 +73,7 @@ func (s *Forwarder) startPortForwarder(ctx context.Context, port uint32) error {
 			if err := stream.Send(&pb.ForwardRequest{
 				Data: buf[:len],
 				Port: port,
+				App:  s.App,
 			}); err != nil {
 				terror.Ackf(ctx, "stream send: %w", err)
 				return
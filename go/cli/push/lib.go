@@ -3,6 +3,8 @@ package push
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/charmbracelet/bubbles/spinner"
@@ -10,6 +12,7 @@ import (
 	"github.com/charmbracelet/lipgloss"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
 	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
 	"premai.io/Ayup/go/internal/trace"
 
 	tr "go.opentelemetry.io/otel/trace"
@@ -20,8 +23,66 @@ type Pusher struct {
 	P2pPrivKey string
 	Client     pb.SrvClient
 
+	// The name of the app on the server
+	App          string
 	AssistantDir string
 	SrcDir       string
+
+	// Leave the app running on the server after the client exits
+	Detach bool
+	// Push again whenever the source changes, implies Detach
+	Watch bool
+	// The names of the ignore files which say what not to upload, see IgnoreFiles
+	IgnoreFiles []string
+	// How to resolve conflicts between local and server changes when downloading, see ConflictAsk
+	Conflicts string
+	// Only print the changes a download would make
+	DryRun bool
+
+	// The compression the server accepts for uploads, set by the manifest exchange
+	compression pb.Compression
+}
+
+// IgnoreFiles returns the names of the ignore files to read, .ayupignore is always read
+func IgnoreFiles(gitIgnore bool, dockerIgnore bool) []string {
+	names := []string{rpc.AyupIgnore}
+
+	if gitIgnore {
+		names = append(names, rpc.GitIgnore)
+	}
+
+	if dockerIgnore {
+		names = append(names, rpc.DockerIgnore)
+	}
+
+	return names
+}
+
+// replyError converts an error from the server, pointing out where to find the quotas if one
+// was exceeded
+func replyError(ctx context.Context, rerr *pb.Error) error {
+	if rerr.Quota != nil {
+		return terror.Errorf(ctx, "%s; see 'ay server info' for your usage", rerr.Error)
+	}
+
+	return terror.Errorf(ctx, "%s", rerr.Error)
+}
+
+var appNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// AppName returns name if it is set, otherwise it derives one from the source directory's name
+func AppName(name string, srcDir string) string {
+	if name != "" {
+		return name
+	}
+
+	name = appNameInvalidChars.ReplaceAllString(filepath.Base(srcDir), "-")
+	name = strings.TrimLeft(name, "-_.")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+
+	return name
 }
 
 type LogView struct {
@@ -128,11 +189,15 @@ func (s *Pusher) Run(ctx context.Context) error {
 	}
 	s.Client = client
 
+	if s.Watch {
+		s.Detach = true
+	}
+
 	if err := s.Upload(ctx); err != nil {
 		return err
 	}
 
-	forwarder := newForwarder(client)
+	forwarder := newForwarder(client, s.App)
 	defer func() {
 		for _, lis := range forwarder.listeners {
 			_ = lis.Close()
@@ -141,10 +206,52 @@ func (s *Pusher) Run(ctx context.Context) error {
 		forwarder.wg.Wait()
 	}()
 
-	err = s.Assist(ctx, &forwarder)
+	// There's no point forwarding ports if we are about to exit
+	fwd := &forwarder
+	if s.Detach && !s.Watch {
+		fwd = nil
+	}
+
+	err = s.Assist(ctx, fwd)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Download(ctx); err != nil {
+		return err
+	}
+
+	if s.Watch {
+		return s.watch(ctx, &forwarder)
+	}
+
+	return nil
+}
+
+// RunAttach reattaches to the app's session then downloads the result like Run
+func (s *Pusher) RunAttach(ctx context.Context) error {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindClient)
+	ctx, span := trace.Span(ctx, "attach")
+	defer span.End()
+
+	client, err := rpc.ClientEnsureKey(ctx, s.Host, s.P2pPrivKey)
 	if err != nil {
 		return err
 	}
+	s.Client = client
+
+	forwarder := newForwarder(client, s.App)
+	defer func() {
+		for _, lis := range forwarder.listeners {
+			_ = lis.Close()
+		}
+
+		forwarder.wg.Wait()
+	}()
+
+	if err := s.Attach(ctx, &forwarder); err != nil {
+		return err
+	}
 
 	if err := s.Download(ctx); err != nil {
 		return err
@@ -152,3 +259,18 @@ func (s *Pusher) Run(ctx context.Context) error {
 
 	return nil
 }
+
+// RunDownload applies the changes made to the source on the server, see Download
+func (s *Pusher) RunDownload(ctx context.Context) error {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindClient)
+	ctx, span := trace.Span(ctx, "download")
+	defer span.End()
+
+	client, err := rpc.ClientEnsureKey(ctx, s.Host, s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+	s.Client = client
+
+	return s.Download(ctx)
+}
@@ -0,0 +1,455 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/huh"
+	attr "go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/conf"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// How conflicts between local and server changes are resolved when downloading
+const (
+	ConflictAsk    = "ask"
+	ConflictKeep   = "keep"
+	ConflictServer = "server"
+)
+
+type baseEntry struct {
+	Type   pb.FileType `json:"type"`
+	Mode   uint32      `json:"mode"`
+	Hash   []byte      `json:"hash,omitempty"`
+	Target string      `json:"target,omitempty"`
+}
+
+// The source as it was when it was last uploaded or downloaded. Changes made on the server are
+// found by comparing its copy with this.
+type downloadBase struct {
+	SrcDir  string               `json:"srcDir"`
+	Entries map[string]baseEntry `json:"entries"`
+}
+
+func basePath(app string) string {
+	return filepath.Join(conf.UserRoot(), "uploads", app+".json")
+}
+
+func newBaseEntries(entries []*pb.ManifestEntry) map[string]baseEntry {
+	base := make(map[string]baseEntry, len(entries))
+	for _, e := range entries {
+		if e.Source != pb.Source_app {
+			continue
+		}
+
+		base[filepath.ToSlash(e.Path)] = baseEntry{
+			Type:   e.Type,
+			Mode:   e.Mode,
+			Hash:   e.Hash,
+			Target: e.Target,
+		}
+	}
+
+	return base
+}
+
+func (s *Pusher) loadBase(ctx context.Context) (map[string]baseEntry, bool) {
+	bs, err := os.ReadFile(basePath(s.App))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			terror.Ackf(ctx, "os ReadFile: %w", err)
+		}
+		return nil, false
+	}
+
+	var base downloadBase
+	if err := json.Unmarshal(bs, &base); err != nil {
+		terror.Ackf(ctx, "json Unmarshal: %w", err)
+		return nil, false
+	}
+
+	// The same app name may have been pushed from somewhere else
+	if base.SrcDir != s.SrcDir {
+		return nil, false
+	}
+
+	return base.Entries, true
+}
+
+func (s *Pusher) saveBase(ctx context.Context, entries map[string]baseEntry) error {
+	bs, err := json.Marshal(downloadBase{SrcDir: s.SrcDir, Entries: entries})
+	if err != nil {
+		return terror.Errorf(ctx, "json Marshal: %w", err)
+	}
+
+	path := basePath(s.App)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+
+	if err := os.WriteFile(path+".tmp", bs, 0600); err != nil {
+		return terror.Errorf(ctx, "os WriteFile: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return terror.Errorf(ctx, "os Rename: %w", err)
+	}
+
+	return nil
+}
+
+// saveUploadBase records what was uploaded, entries may be nil if the manifest was not built
+func (s *Pusher) saveUploadBase(ctx context.Context, entries []*pb.ManifestEntry) error {
+	if entries == nil {
+		var err error
+		if entries, err = rpc.BuildManifest(ctx, pb.Source_app, s.SrcDir, s.IgnoreFiles, nil); err != nil {
+			return err
+		}
+	}
+
+	return s.saveBase(ctx, newBaseEntries(entries))
+}
+
+// updateUploadBase replaces the entries for the paths which were uploaded and what is below them,
+// so that only those are hashed again
+func (s *Pusher) updateUploadBase(ctx context.Context, paths []string) error {
+	base, ok := s.loadBase(ctx)
+	if !ok {
+		return s.saveUploadBase(ctx, nil)
+	}
+
+	entries, err := rpc.BuildManifestPaths(ctx, pb.Source_app, s.SrcDir, s.IgnoreFiles, paths)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		path = filepath.ToSlash(path)
+
+		for key := range base {
+			if key == path || strings.HasPrefix(key, path+"/") {
+				delete(base, key)
+			}
+		}
+	}
+
+	maps.Copy(base, newBaseEntries(entries))
+
+	return s.saveBase(ctx, base)
+}
+
+func sameEntry(a baseEntry, aOk bool, b baseEntry, bOk bool) bool {
+	if !aOk || !bOk {
+		return aOk == bOk
+	}
+
+	if a.Type != b.Type {
+		return false
+	}
+
+	switch a.Type {
+	case pb.FileType_dir:
+		// The server gives the owner full access to directories
+		return true
+	case pb.FileType_symlink:
+		return a.Target == b.Target
+	default:
+		return a.Mode == b.Mode && bytes.Equal(a.Hash, b.Hash)
+	}
+}
+
+type change struct {
+	path     string
+	deleted  bool
+	added    bool
+	conflict bool
+}
+
+func (c change) String() string {
+	kind := "M"
+	if c.deleted {
+		kind = "D"
+	} else if c.added {
+		kind = "A"
+	}
+
+	if c.conflict {
+		return fmt.Sprintf("%s %s (conflict)", kind, c.path)
+	}
+
+	return fmt.Sprintf("%s %s", kind, c.path)
+}
+
+// diff finds the changes made on the server since base. A change conflicts if the local copy
+// also changed. Without a base anything that differs from the local copy is a conflict, except
+// for new files, and nothing is deleted.
+func diff(base map[string]baseEntry, haveBase bool, local map[string]baseEntry, remote map[string]baseEntry) []change {
+	paths := make(map[string]struct{}, len(remote))
+	for path := range remote {
+		paths[path] = struct{}{}
+	}
+	if haveBase {
+		for path := range base {
+			paths[path] = struct{}{}
+		}
+	}
+
+	var changes []change
+	for path := range paths {
+		b, bOk := base[path]
+		l, lOk := local[path]
+		r, rOk := remote[path]
+
+		if !haveBase {
+			if !rOk || sameEntry(l, lOk, r, rOk) {
+				continue
+			}
+
+			changes = append(changes, change{path: path, added: !lOk, conflict: lOk})
+			continue
+		}
+
+		// Unchanged on the server or already the same locally
+		if sameEntry(b, bOk, r, rOk) || sameEntry(l, lOk, r, rOk) {
+			continue
+		}
+
+		changes = append(changes, change{
+			path:     path,
+			deleted:  !rOk,
+			added:    !bOk,
+			conflict: !sameEntry(b, bOk, l, lOk),
+		})
+	}
+
+	slices.SortFunc(changes, func(a, b change) int {
+		if a.path < b.path {
+			return -1
+		} else if a.path > b.path {
+			return 1
+		}
+		return 0
+	})
+
+	return changes
+}
+
+func askConflict(c change) (bool, error) {
+	choice := &pb.ChoiceBool{
+		Title:       fmt.Sprintf("Conflict: %s", c.path),
+		Description: "The file was changed locally and on the server",
+		Affirmative: "Use the server's",
+		Negative:    "Keep mine",
+	}
+
+	if c.deleted {
+		choice.Description = "The file was changed locally and deleted on the server"
+	}
+
+	v := choice.Value
+	if err := huh.NewConfirm().
+		Title(choice.Title).
+		Description(choice.Description).
+		Affirmative(choice.Affirmative).
+		Negative(choice.Negative).
+		Value(&v).
+		Run(); err != nil {
+		return false, err
+	}
+
+	return v, nil
+}
+
+// copyEntry replaces the local path with the one downloaded to stageDir
+func copyEntry(ctx context.Context, stageDir string, srcDir string, path string, e baseEntry) error {
+	// The local source may have symlinks which the server's copy doesn't, nothing is written
+	// through them in case they point out of the source directory
+	if err := rpc.CheckBeneath(srcDir, filepath.FromSlash(path)); err != nil {
+		return terror.Errorf(ctx, "rpc CheckBeneath: %w", err)
+	}
+
+	src := filepath.Join(stageDir, filepath.FromSlash(path))
+	dst := filepath.Join(srcDir, filepath.FromSlash(path))
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+
+	if info, err := os.Lstat(dst); err == nil && (e.Type != pb.FileType_dir || !info.IsDir()) {
+		if err := os.RemoveAll(dst); err != nil {
+			return terror.Errorf(ctx, "os RemoveAll: %w", err)
+		}
+	}
+
+	switch e.Type {
+	case pb.FileType_dir:
+		if err := os.MkdirAll(dst, os.FileMode(e.Mode)); err != nil {
+			return terror.Errorf(ctx, "os MkdirAll: %w", err)
+		}
+		return nil
+	case pb.FileType_symlink:
+		if !rpc.SymlinkIsLocal(srcDir, filepath.FromSlash(path), e.Target) {
+			return terror.Errorf(ctx, "symlink points outside of the source directory: %s -> %s", path, e.Target)
+		}
+
+		if err := os.Symlink(e.Target, dst); err != nil {
+			return terror.Errorf(ctx, "os Symlink: %w", err)
+		}
+		return nil
+	}
+
+	r, err := os.Open(src)
+	if err != nil {
+		return terror.Errorf(ctx, "os Open: %w", err)
+	}
+	defer func() { terror.Ackf(ctx, "r Close: %w", r.Close()) }()
+
+	w, err := os.CreateTemp(filepath.Dir(dst), ".ayup-download-*")
+	if err != nil {
+		return terror.Errorf(ctx, "os CreateTemp: %w", err)
+	}
+	defer func() { _ = os.Remove(w.Name()) }()
+
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return terror.Errorf(ctx, "io Copy: %w", err)
+	}
+
+	if err := w.Chmod(os.FileMode(e.Mode)); err != nil {
+		_ = w.Close()
+		return terror.Errorf(ctx, "w Chmod: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return terror.Errorf(ctx, "w Close: %w", err)
+	}
+
+	if err := os.Rename(w.Name(), dst); err != nil {
+		return terror.Errorf(ctx, "os Rename: %w", err)
+	}
+
+	return nil
+}
+
+// dropIgnored removes the entries which the local ignore files exclude. They are left out of the
+// local manifest, so if the server has them they would look added and overwrite the local files.
+func (s *Pusher) dropIgnored(ctx context.Context, entries map[string]baseEntry) error {
+	ignore := rpc.NewIgnore(s.SrcDir, s.IgnoreFiles)
+
+	for path, e := range entries {
+		ignored, err := ignore.Match(ctx, path, e.Type == pb.FileType_dir)
+		if err != nil {
+			return err
+		}
+
+		if ignored {
+			delete(entries, path)
+		}
+	}
+
+	return nil
+}
+
+// merge applies the changes the server made, which were downloaded to stageDir, to the source
+func (s *Pusher) merge(ctx context.Context, stageDir string) error {
+	ctx, span := trace.Span(ctx, "merge", attr.Bool("dryRun", s.DryRun))
+	defer span.End()
+
+	remoteEntries, err := rpc.BuildManifest(ctx, pb.Source_app, stageDir, nil, nil)
+	if err != nil {
+		return err
+	}
+	remote := newBaseEntries(remoteEntries)
+	if err := s.dropIgnored(ctx, remote); err != nil {
+		return err
+	}
+
+	localEntries, err := rpc.BuildManifest(ctx, pb.Source_app, s.SrcDir, s.IgnoreFiles, nil)
+	if err != nil {
+		return err
+	}
+	local := newBaseEntries(localEntries)
+
+	base, haveBase := s.loadBase(ctx)
+	changes := diff(base, haveBase, local, remote)
+
+	span.SetAttributes(attr.Int("changes", len(changes)), attr.Bool("haveBase", haveBase))
+
+	if len(changes) < 1 {
+		fmt.Println(tui.TitleStyle.Render("Download:"), "no changes from the server")
+	}
+
+	if s.DryRun {
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+
+		return nil
+	}
+
+	conflicts := 0
+	var deleted []change
+	for _, c := range changes {
+		if c.conflict {
+			useServer := s.Conflicts == ConflictServer
+			if s.Conflicts == ConflictAsk {
+				if useServer, err = askConflict(c); err != nil {
+					return terror.Errorf(ctx, "askConflict: %w", err)
+				}
+			}
+
+			if !useServer {
+				fmt.Println(tui.ErrorStyle.Render("Conflict:"), c.path, "kept the local version")
+				conflicts++
+				continue
+			}
+		}
+
+		// Delete after everything else, deepest first, so directories are empty
+		if c.deleted {
+			deleted = append(deleted, c)
+			continue
+		}
+
+		fmt.Println(tui.TitleStyle.Render("Updated:"), c.path)
+		if err := copyEntry(ctx, stageDir, s.SrcDir, c.path, remote[c.path]); err != nil {
+			return err
+		}
+	}
+
+	for i := len(deleted) - 1; i >= 0; i-- {
+		c := deleted[i]
+		if err := rpc.CheckBeneath(s.SrcDir, filepath.FromSlash(c.path)); err != nil {
+			fmt.Println(tui.ErrorStyle.Render("Not deleted:"), c.path, err)
+			continue
+		}
+		path := filepath.Join(s.SrcDir, filepath.FromSlash(c.path))
+
+		// A directory which still has local files in it is left alone
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Println(tui.ErrorStyle.Render("Not deleted:"), c.path, err)
+			continue
+		}
+
+		fmt.Println(tui.TitleStyle.Render("Deleted:"), c.path)
+	}
+
+	if conflicts > 0 {
+		fmt.Println(tui.ErrorStyle.Render("Conflicts:"), conflicts, "files were changed locally and on the server, see above")
+	}
+
+	return s.saveBase(ctx, remote)
+}
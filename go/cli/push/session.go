@@ -0,0 +1,64 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"premai.io/Ayup/go/internal/conf"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// The session the client is attached to and the last reply it received, saved so that it can
+// reattach with 'ay app attach'
+type sessionProgress struct {
+	id  string
+	seq uint32
+}
+
+func sessionPath(app string) string {
+	return filepath.Join(conf.UserRoot(), "sessions", app)
+}
+
+func loadSession(ctx context.Context, app string) sessionProgress {
+	var progress sessionProgress
+
+	bs, err := os.ReadFile(sessionPath(app))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			terror.Ackf(ctx, "os ReadFile: %w", err)
+		}
+		return progress
+	}
+
+	if _, err := fmt.Sscanf(string(bs), "%s %d", &progress.id, &progress.seq); err != nil {
+		terror.Ackf(ctx, "fmt Sscanf: %w", err)
+		return sessionProgress{}
+	}
+
+	return progress
+}
+
+func saveSession(ctx context.Context, app string, progress sessionProgress) error {
+	if progress.id == "" {
+		return nil
+	}
+
+	path := sessionPath(app)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%s %d", progress.id, progress.seq)), 0600); err != nil {
+		return terror.Errorf(ctx, "os WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+func forgetSession(ctx context.Context, app string) {
+	if err := os.Remove(sessionPath(app)); err != nil && !os.IsNotExist(err) {
+		terror.Ackf(ctx, "os Remove: %w", err)
+	}
+}
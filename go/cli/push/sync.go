@@ -2,23 +2,51 @@ package push
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	attr "go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
 	"premai.io/Ayup/go/internal/rpc"
 	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
 
 	"premai.io/Ayup/go/internal/terror"
 )
 
+// Download fetches the app's source from the server and applies the changes made there since
+// the last upload. Local changes are kept and conflicts are resolved according to s.Conflicts.
 func (s *Pusher) Download(ctx context.Context) error {
 	ctx, span := trace.Span(ctx, "download")
 	defer span.End()
 
-	stream, err := s.Client.Download(ctx, &pb.DownloadReq{})
+	stageDir, err := os.MkdirTemp("", "ayup-download-")
+	if err != nil {
+		return terror.Errorf(ctx, "os MkdirTemp: %w", err)
+	}
+	defer func() { terror.Ackf(ctx, "os RemoveAll: %w", os.RemoveAll(stageDir)) }()
+
+	if err := s.recvDownload(ctx, stageDir); err != nil {
+		return err
+	}
+
+	return s.merge(ctx, stageDir)
+}
+
+// recvDownload receives the app's source into dir
+func (s *Pusher) recvDownload(ctx context.Context, dir string) error {
+	stream, err := s.Client.Download(ctx, &pb.DownloadReq{App: s.App, Accept: rpc.AcceptCompression})
 	if err != nil {
 		return terror.Errorf(ctx, "client Download: %w", err)
 	}
@@ -32,7 +60,7 @@ func (s *Pusher) Download(ctx context.Context) error {
 
 	logChan := make(chan string)
 	cancelChan := make(chan struct{})
-	fileRecver := rpc.NewFileRecver(stream, logChan, retError, retError, s.SrcDir, s.AssistantDir)
+	fileRecver := rpc.NewFileRecver(stream, logChan, retError, retError, dir, s.AssistantDir)
 	logViewProg := tea.NewProgram(NewLogView("sync", cancelChan))
 
 	var g errgroup.Group
@@ -76,10 +104,212 @@ func (s *Pusher) Download(ctx context.Context) error {
 	return g.Wait()
 }
 
-func (s *Pusher) Upload(pctx context.Context) (err error) {
-	ctx, span := trace.Span(pctx, "upload")
+// Upload sends the source and assistant to the server. Only the files which the server doesn't
+// already have are sent, unless the server is too old to tell us which those are.
+func (s *Pusher) Upload(ctx context.Context) error {
+	warnAyupEnv(s.AssistantDir)
+
+	missing, entries, err := s.uploadManifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.upload(ctx, missing, false); err != nil {
+		return err
+	}
+
+	return s.saveUploadBase(ctx, entries)
+}
+
+// warnAyupEnv says that the assistant's .ayup-env file is no longer uploaded. It could contain
+// secrets, which are set on the server instead.
+func warnAyupEnv(dir string) {
+	if dir == "" {
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".ayup-env")); err != nil {
+		return
+	}
+
+	fmt.Println(tui.ErrorStyle.Render("Not uploaded:"), filepath.Join(dir, ".ayup-env"), "set the assistant's secrets with 'ay secrets set --assistant' instead")
+}
+
+// UploadPaths only uploads the given paths in the source dir, the server keeps the rest
+func (s *Pusher) UploadPaths(ctx context.Context, paths []string) error {
+	if paths == nil {
+		paths = []string{}
+	}
+
+	if err := s.upload(ctx, map[pb.Source][]string{pb.Source_app: paths}, true); err != nil {
+		return err
+	}
+
+	return s.updateUploadBase(ctx, paths)
+}
+
+// uploadManifest tells the server what we are about to upload and returns the paths it is
+// missing along with the manifest. If the server doesn't support manifests then the paths are nil.
+func (s *Pusher) uploadManifest(pctx context.Context) (map[pb.Source][]string, []*pb.ManifestEntry, error) {
+	ctx, span := trace.Span(pctx, "upload manifest")
+	defer span.End()
+
+	entries, err := s.buildManifest(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := s.Client.UploadManifest(ctx, &pb.Manifest{App: s.App, Entries: entries})
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			trace.Event(ctx, "server doesn't support manifests")
+			return nil, entries, nil
+		}
+		return nil, nil, terror.Errorf(ctx, "client UploadManifest: %w", err)
+	}
+
+	if res.Error != nil {
+		return nil, nil, replyError(ctx, res.Error)
+	}
+
+	s.compression = rpc.NegotiateCompression(res.Accept)
+
+	missing := map[pb.Source][]string{
+		pb.Source_app:       {},
+		pb.Source_assistant: {},
+	}
+	for _, entry := range res.Missing {
+		missing[entry.Source] = append(missing[entry.Source], entry.Path)
+	}
+
+	span.SetAttributes(attr.Int("entries", len(entries)), attr.Int("missing", len(res.Missing)))
+
+	return missing, entries, nil
+}
+
+// buildManifest lists what would be uploaded from the source and assistant dirs and prints the
+// paths which are skipped
+func (s *Pusher) buildManifest(ctx context.Context) ([]*pb.ManifestEntry, error) {
+	logChan := make(chan string)
+	logDone := make(chan struct{})
+	go func() {
+		defer close(logDone)
+
+		for log := range logChan {
+			fmt.Println(log)
+		}
+	}()
+	defer func() {
+		close(logChan)
+		<-logDone
+	}()
+
+	var entries []*pb.ManifestEntry
+	for source, dir := range map[pb.Source]string{pb.Source_app: s.SrcDir, pb.Source_assistant: s.AssistantDir} {
+		if dir == "" {
+			continue
+		}
+
+		dirEntries, err := rpc.BuildManifest(ctx, source, dir, s.IgnoreFiles, logChan)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dirEntries...)
+	}
+
+	return entries, nil
+}
+
+// How many times an upload is resumed after losing the connection before giving up
+const uploadRetries = 5
+
+func connLost(err error) bool {
+	return status.Code(err) == codes.Unavailable || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func newUploadId() (string, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bs), nil
+}
+
+// upload sends the given paths of each source as a partial upload, or everything if paths is nil.
+// Directories are sent with their contents if recursive is set. If the connection is lost then
+// the upload is resumed from where the server got to.
+func (s *Pusher) upload(pctx context.Context, paths map[pb.Source][]string, recursive bool) error {
+	ctx, span := trace.Span(pctx, "upload", attr.Bool("partial", paths != nil))
 	defer span.End()
 
+	id, err := newUploadId()
+	if err != nil {
+		return terror.Errorf(ctx, "newUploadId: %w", err)
+	}
+
+	var resume rpc.ResumeFrom
+	for attempt := 1; ; attempt++ {
+		err := s.uploadOnce(ctx, paths, recursive, id, resume)
+		if err == nil || ctx.Err() != nil || !connLost(err) || attempt > uploadRetries {
+			return err
+		}
+
+		fmt.Println(tui.ErrorStyle.Render("Connection lost:"), err)
+		trace.Event(ctx, "resume upload", attr.Int("attempt", attempt))
+
+		if resume, err = s.uploadProgress(ctx, id); err != nil {
+			return err
+		}
+	}
+}
+
+// uploadProgress asks the server how much of the upload it received, waiting for it to notice
+// that the last stream was lost. If the upload has to start again then nil is returned.
+func (s *Pusher) uploadProgress(ctx context.Context, id string) (rpc.ResumeFrom, error) {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(1<<min(attempt-1, 4)) * time.Second):
+		}
+
+		res, err := s.Client.UploadProgress(ctx, &pb.UploadProgressReq{App: s.App, Upload: id})
+		if err != nil {
+			if status.Code(err) == codes.Unimplemented {
+				return nil, nil
+			}
+
+			if connLost(err) && attempt < uploadRetries {
+				continue
+			}
+
+			return nil, terror.Errorf(ctx, "client UploadProgress: %w", err)
+		}
+
+		if res.Error != nil {
+			return nil, terror.Errorf(ctx, "%s", res.Error.Error)
+		}
+
+		if !res.Found {
+			fmt.Println(tui.TitleStyle.Render("Upload:"), "starting again")
+			return nil, nil
+		}
+
+		if res.Active {
+			if attempt < uploadRetries {
+				continue
+			}
+
+			return nil, terror.Errorf(ctx, "the server is still receiving the lost upload, try again later")
+		}
+
+		fmt.Println(tui.TitleStyle.Render("Upload:"), "resuming")
+		return rpc.NewResumeFrom(res.Files), nil
+	}
+}
+
+func (s *Pusher) uploadOnce(ctx context.Context, paths map[pb.Source][]string, recursive bool, id string, resume rpc.ResumeFrom) (err error) {
 	stream, err := s.Client.Upload(ctx)
 	if err != nil {
 		return terror.Errorf(ctx, "sync stream: %w", err)
@@ -91,13 +321,14 @@ func (s *Pusher) Upload(pctx context.Context) (err error) {
 			if res == nil {
 				err2 = terror.Errorf(ctx, "stream close and recv: no response")
 			} else if res.Error != nil {
-				err = terror.Errorf(ctx, "%s", res.Error.Error)
+				err = replyError(ctx, res.Error)
 			}
 		} else {
 			err2 = terror.Errorf(ctx, "stream close and recv: %w", err2)
 		}
 
-		if err == nil {
+		// The stream's status says why sending failed
+		if err == nil || (err2 != nil && errors.Is(err, io.EOF)) {
 			err = err2
 		}
 	}()
@@ -139,7 +370,39 @@ func (s *Pusher) Upload(pctx context.Context) (err error) {
 		return terror.Errorf(ctx, msg, args...)
 	}
 
-	sender := rpc.NewFileSender(stream, cancelChan, logChan, retError, retError)
+	// Tell the server which app this is for, even if there are no files to send
+	if err := stream.Send(&pb.FileChunks{
+		App:     s.App,
+		Partial: paths != nil,
+		Upload:  id,
+		Resume:  resume != nil,
+	}); err != nil {
+		return terror.Errorf(ctx, "stream Send: %w", err)
+	}
+
+	sender := rpc.NewFileSender(stream, s.App, cancelChan, logChan, retError, retError)
+	sender.SetCompression(s.compression)
+	sender.SetIgnoreFiles(s.IgnoreFiles)
+	sender.SetResume(resume)
+
+	if paths != nil {
+		for source, dir := range map[pb.Source]string{pb.Source_app: s.SrcDir, pb.Source_assistant: s.AssistantDir} {
+			if dir == "" || len(paths[source]) < 1 {
+				continue
+			}
+
+			send := sender.SendEntries
+			if recursive {
+				send = sender.SendPaths
+			}
+
+			if err := send(ctx, source, dir, paths[source]); err != nil {
+				return err
+			}
+		}
+
+		return
+	}
 
 	if s.SrcDir != "" {
 		if err := sender.SendDir(ctx, pb.Source_app, s.SrcDir); err != nil {
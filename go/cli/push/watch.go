@@ -0,0 +1,142 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// How long to wait after a change for more changes before pushing
+const watchDebounce = 300 * time.Millisecond
+
+// Hidden files and directories are not uploaded, so changes to them are ignored. Except for the
+// ones Ayup uses.
+func ignoreWatchPath(path string) bool {
+	for _, name := range strings.Split(filepath.ToSlash(path), "/") {
+		if strings.HasPrefix(name, ".") && name != ".ayup" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterIgnored removes the paths which are ignored and so wouldn't be uploaded
+func (s *Pusher) filterIgnored(ctx context.Context, paths []string) ([]string, error) {
+	// Read the ignore files each time in case they changed
+	ignore := rpc.NewIgnore(s.SrcDir, s.IgnoreFiles)
+
+	kept := make([]string, 0, len(paths))
+	for _, path := range paths {
+		isDir := false
+		if info, err := os.Lstat(filepath.Join(s.SrcDir, path)); err == nil {
+			isDir = info.IsDir()
+		}
+
+		ignored, err := ignore.Match(ctx, path, isDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ignored {
+			kept = append(kept, path)
+		}
+	}
+
+	return kept, nil
+}
+
+// next waits for a change then collects further changes until there are none for the debounce
+// period
+func (s *watcher) next(ctx context.Context) ([]string, error) {
+	changed := make(map[string]struct{})
+	var debounce <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case err := <-s.errs:
+			return nil, err
+		case path, ok := <-s.events:
+			if !ok {
+				return nil, terror.Errorf(ctx, "watcher stopped")
+			}
+
+			changed[path] = struct{}{}
+			debounce = time.After(watchDebounce)
+		case <-debounce:
+			paths := make([]string, 0, len(changed))
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			slices.Sort(paths)
+
+			return paths, nil
+		}
+	}
+}
+
+// watch uploads the changes made to the source and pushes them, replacing the app running on
+// the server. It carries on until interrupted, the port forwards stay open throughout.
+func (s *Pusher) watch(pctx context.Context, fwd *Forwarder) error {
+	ctx, span := trace.Span(pctx, "watch")
+	defer span.End()
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	w, err := newWatcher(ctx, s.SrcDir)
+	if err != nil {
+		return err
+	}
+	defer func() { terror.Ackf(ctx, "watcher Close: %w", w.Close()) }()
+
+	for {
+		fmt.Println(tui.TitleStyle.Render("Watching:"), s.SrcDir)
+
+		paths, err := w.next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+
+		trace.Event(ctx, "changed", attribute.StringSlice("paths", paths))
+
+		if paths, err = s.filterIgnored(ctx, paths); err != nil {
+			return err
+		}
+
+		if len(paths) < 1 {
+			continue
+		}
+
+		if err := s.UploadPaths(ctx, paths); err != nil {
+			return err
+		}
+
+		// A failed build shouldn't stop us watching, the next change may fix it
+		if err := s.Assist(ctx, fwd); err != nil {
+			fmt.Println(tui.ErrorStyle.Render("Error!"), err)
+		}
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Stopped watching:"), "the app is still running, stop it with 'ay app stop'")
+
+	// Use the original context, ours has been cancelled
+	return s.Download(pctx)
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package push
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE |
+	syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO
+
+// Watches a directory tree for changes using inotify
+type watcher struct {
+	ctx  context.Context
+	root string
+	file *os.File
+	// Maps watch descriptors to the directory they watch, relative to the root
+	dirs map[int32]string
+
+	events chan string
+	errs   chan error
+	// Closed by Close so the reader stops if nobody is receiving events
+	done chan struct{}
+}
+
+func newWatcher(ctx context.Context, root string) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "syscall InotifyInit1: %w", err)
+	}
+
+	w := &watcher{
+		ctx:    ctx,
+		root:   root,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]string),
+		events: make(chan string),
+		errs:   make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+
+	if err := w.addTree("."); err != nil {
+		_ = w.file.Close()
+		return nil, err
+	}
+
+	go w.read()
+
+	return w, nil
+}
+
+// addTree watches dir and the directories below it
+func (s *watcher) addTree(dir string) error {
+	return fs.WalkDir(os.DirFS(s.root), dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// It may have been deleted while we were walking it
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return terror.Errorf(s.ctx, "walkdir func(%s): %w", path, err)
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if path != "." && ignoreWatchPath(path) {
+			return fs.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(int(s.file.Fd()), filepath.Join(s.root, path), watchMask)
+		if err != nil {
+			return terror.Errorf(s.ctx, "syscall InotifyAddWatch(%s): %w", path, err)
+		}
+		s.dirs[int32(wd)] = path
+
+		return nil
+	})
+}
+
+func (s *watcher) read() {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := s.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				s.errs <- terror.Errorf(s.ctx, "inotify read: %w", err)
+			}
+			close(s.events)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBs := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			dir, ok := s.dirs[event.Wd]
+			if !ok {
+				continue
+			}
+
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(s.dirs, event.Wd)
+				continue
+			}
+
+			name := strings.TrimRight(string(nameBs), "\x00")
+			path := filepath.Join(dir, name)
+			if ignoreWatchPath(path) {
+				continue
+			}
+
+			trace.Event(s.ctx, "watch event", attribute.String("path", path), attribute.Int("mask", int(event.Mask)))
+
+			isDir := event.Mask&syscall.IN_ISDIR != 0
+			if isDir && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if err := s.addTree(path); err != nil {
+					s.errs <- err
+					close(s.events)
+					return
+				}
+			}
+
+			select {
+			case s.events <- path:
+			case <-s.done:
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (s *watcher) Close() error {
+	close(s.done)
+
+	return s.file.Close()
+}
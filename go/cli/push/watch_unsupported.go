@@ -0,0 +1,23 @@
+//go:build !linux
+
+package push
+
+import (
+	"context"
+	"runtime"
+
+	"premai.io/Ayup/go/internal/terror"
+)
+
+type watcher struct {
+	events chan string
+	errs   chan error
+}
+
+func newWatcher(ctx context.Context, root string) (*watcher, error) {
+	return nil, terror.Errorf(ctx, "Watch mode is not supported on: %s", runtime.GOOS)
+}
+
+func (s *watcher) Close() error {
+	return nil
+}
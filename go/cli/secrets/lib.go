@@ -0,0 +1,143 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/huh"
+	"github.com/mattn/go-isatty"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// scope is the assistant's secrets if it is set, otherwise the app's
+func scope(app string, assistant string) (*pb.SecretScope, string) {
+	if assistant != "" {
+		return &pb.SecretScope{Assistant: assistant}, assistant
+	}
+
+	return &pb.SecretScope{App: app}, app
+}
+
+// readValue asks for the secret at the terminal, otherwise it is read from stdin. This keeps it
+// out of the shell's history.
+func readValue(ctx context.Context, name string) (string, error) {
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		bs, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", terror.Errorf(ctx, "io ReadAll: %w", err)
+		}
+
+		return strings.TrimSuffix(strings.TrimSuffix(string(bs), "\n"), "\r"), nil
+	}
+
+	var value string
+	input := huh.NewInput().
+		Title(fmt.Sprintf("Value of %s", name)).
+		EchoMode(huh.EchoModePassword).
+		Value(&value)
+
+	if err := huh.NewForm(huh.NewGroup(input)).Run(); err != nil {
+		return "", terror.Errorf(ctx, "form Run: %w", err)
+	}
+
+	return value, nil
+}
+
+// Set stores the secret on the server, replacing it if it is already set. If the value is empty
+// then it is asked for.
+func Set(pctx context.Context, host string, privKey string, app string, assistant string, name string, value string) error {
+	ctx, span := trace.Span(pctx, "secrets set")
+	defer span.End()
+
+	if value == "" {
+		var err error
+		if value, err = readValue(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	sc, scName := scope(app, assistant)
+	resp, err := c.SecretsSet(ctx, &pb.SecretsSetReq{Scope: sc, Name: name, Value: value})
+	if err != nil {
+		return terror.Errorf(ctx, "client SecretsSet: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Set:"), name, tui.VersionStyle.Render(scName))
+
+	return nil
+}
+
+// List prints the names of the secrets set on the server, the values can't be read back
+func List(pctx context.Context, host string, privKey string, app string, assistant string) error {
+	ctx, span := trace.Span(pctx, "secrets list")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	sc, scName := scope(app, assistant)
+	resp, err := c.SecretsList(ctx, &pb.SecretsListReq{Scope: sc})
+	if err != nil {
+		return terror.Errorf(ctx, "client SecretsList: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	if len(resp.Secrets) < 1 {
+		fmt.Println("No secrets have been set for", scName)
+		return nil
+	}
+
+	for _, secret := range resp.Secrets {
+		fmt.Println(tui.TitleStyle.Render(secret.Name), tui.VersionStyle.Render(time.Unix(secret.Updated, 0).Format(time.DateTime)))
+	}
+
+	return nil
+}
+
+// Rm deletes the secret from the server
+func Rm(pctx context.Context, host string, privKey string, app string, assistant string, name string) error {
+	ctx, span := trace.Span(pctx, "secrets rm")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	sc, scName := scope(app, assistant)
+	resp, err := c.SecretsRm(ctx, &pb.SecretsRmReq{Scope: sc, Name: name})
+	if err != nil {
+		return terror.Errorf(ctx, "client SecretsRm: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Removed:"), name, tui.VersionStyle.Render(scName))
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	units "github.com/docker/go-units"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+func formatQuota(q *pb.QuotaUsage) string {
+	limit := "unlimited"
+	if q.Limit > 0 {
+		limit = units.BytesSize(float64(q.Limit))
+	}
+
+	// The upload quota applies to each upload separately
+	if q.Name == "upload" {
+		return fmt.Sprintf("%s per upload", limit)
+	}
+
+	return fmt.Sprintf("%s of %s", units.BytesSize(float64(q.Used)), limit)
+}
+
+// Info prints what the server knows about the client, including its usage of each quota
+func Info(pctx context.Context, host string, privKey string) error {
+	ctx, span := trace.Span(pctx, "server info")
+	defer span.End()
+
+	c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.ServerInfo(ctx, &pb.ServerInfoReq{})
+	if err != nil {
+		return terror.Errorf(ctx, "client ServerInfo: %w", err)
+	}
+
+	if resp.Error != nil {
+		return terror.Errorf(ctx, "%s", resp.Error.Error)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Peer:"), resp.Peer)
+	fmt.Println(tui.TitleStyle.Render("Role:"), resp.Role)
+	fmt.Println(tui.TitleStyle.Render("Quotas:"))
+	for _, q := range resp.Quotas {
+		fmt.Println("\t", tui.VersionStyle.Render(q.Name), formatQuota(q))
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package servers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+
+	"premai.io/Ayup/go/internal/conf"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// knownAddr returns the address a server is known by, given a context name or the server's
+// multiaddr with or without the peer ID
+func knownAddr(ctx context.Context, server string) (string, error) {
+	profiles, err := conf.LoadProfiles(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if profile, ok := profiles.Profiles[server]; ok {
+		server = profile.Target()
+	}
+
+	maddr, err := multiaddr.NewMultiaddr(server)
+	if err != nil {
+		return server, nil
+	}
+
+	if _, err := maddr.ValueForProtocol(multiaddr.P_P2P); err != nil {
+		return maddr.String(), nil
+	}
+
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return "", terror.Errorf(ctx, "peer AddrInfoFromP2pAddr: %w", err)
+	}
+
+	return rpc.ServerAddr(info), nil
+}
+
+// List prints the servers the client has logged into and the peer IDs they must have
+func List(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "servers list")
+	defer span.End()
+
+	known, err := conf.LoadKnownServers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(known) < 1 {
+		fmt.Println("No servers are known yet, they are added when you login")
+		return nil
+	}
+
+	for _, addr := range known.Addrs() {
+		server := known[addr]
+		fmt.Println(tui.TitleStyle.Render(addr), server.Peer, tui.VersionStyle.Render(server.Added.Format(time.DateTime)))
+	}
+
+	return nil
+}
+
+// Forget removes the server's peer ID, so that the next login records a new one
+func Forget(pctx context.Context, server string) error {
+	ctx, span := trace.Span(pctx, "servers forget")
+	defer span.End()
+
+	addr, err := knownAddr(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	known, err := conf.LoadKnownServers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := known[addr]; !ok {
+		return terror.Errorf(ctx, "The server %s is not known, see 'ay servers list'", addr)
+	}
+
+	delete(known, addr)
+	if err := known.Save(ctx); err != nil {
+		return err
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Forgot:"), addr)
+
+	return nil
+}
+
+// Accept switches the known servers and contexts from a server's old peer ID to its new one,
+// given the handoff it signed with both keys. The handoff is fetched from the server at host if
+// it is not given.
+func Accept(pctx context.Context, host string, privKey string, handoff string) error {
+	ctx, span := trace.Span(pctx, "servers accept")
+	defer span.End()
+
+	if handoff == "" {
+		c, err := rpc.ClientEnsureKey(ctx, host, privKey)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.ServerInfo(ctx, &pb.ServerInfoReq{})
+		if err != nil {
+			return terror.Errorf(ctx, "client ServerInfo: %w", err)
+		}
+
+		if resp.Error != nil {
+			return terror.Errorf(ctx, "%s", resp.Error.Error)
+		}
+
+		if resp.Handoff == "" {
+			fmt.Println("The server's key hasn't been rotated")
+			return nil
+		}
+
+		handoff = resp.Handoff
+	}
+
+	h, err := rpc.ParseHandoff(handoff)
+	if err != nil {
+		return terror.Errorf(ctx, "rpc ParseHandoff: %w", err)
+	}
+
+	if h.For != "" {
+		return terror.Errorf(ctx, "This is a client's handoff, not a server's")
+	}
+
+	oldId, newId := h.Old.String(), h.New.String()
+	changed := 0
+
+	known, err := conf.LoadKnownServers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range known.Addrs() {
+		if server := known[addr]; server.Peer == oldId {
+			server.Peer = newId
+			known[addr] = server
+			changed++
+
+			fmt.Println(tui.TitleStyle.Render("Updated server:"), addr)
+		}
+	}
+
+	if err := known.Save(ctx); err != nil {
+		return err
+	}
+
+	profiles, err := conf.LoadProfiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range profiles.Names() {
+		profile := profiles.Profiles[name]
+		if profile.Peer != oldId && !strings.Contains(profile.Host, "/p2p/"+oldId) {
+			continue
+		}
+
+		profile.Peer = newId
+		profile.Host = strings.ReplaceAll(profile.Host, "/p2p/"+oldId, "/p2p/"+newId)
+		profiles.Profiles[name] = profile
+		changed++
+
+		fmt.Println(tui.TitleStyle.Render("Updated context:"), name)
+	}
+
+	if err := profiles.Save(ctx); err != nil {
+		return err
+	}
+
+	pushHost, err := conf.Get(ctx, "AYUP_PUSH_HOST")
+	if err != nil {
+		return err
+	}
+
+	if strings.Contains(pushHost, "/p2p/"+oldId) {
+		if err := conf.Set(ctx, "AYUP_PUSH_HOST", strings.ReplaceAll(pushHost, "/p2p/"+oldId, "/p2p/"+newId)); err != nil {
+			return err
+		}
+		changed++
+
+		fmt.Println(tui.TitleStyle.Render("Updated:"), "AYUP_PUSH_HOST in the env file")
+	}
+
+	if changed < 1 {
+		return terror.Errorf(ctx, "Nothing refers to the server %s, so the handoff wasn't needed", oldId)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Accepted!"), oldId, "is now", newId)
+
+	return nil
+}
@@ -43,7 +43,7 @@ func ShowAssistant(ctx context.Context, path string) error {
 
 func SetAssistant(ctx context.Context, path string, name string) error {
 	if name != "nil" && strings.Count(name, ":") != 1 {
-		return terror.Errorf(ctx, "Assistant name does not appear to be valid, it should have the type of assistant (builtin, local or remote) followed by a ':' and the name name like 'builtin:dockerfile'")
+		return terror.Errorf(ctx, "Assistant name does not appear to be valid, it should have the type of assistant (builtin, local, remote or app) followed by a ':' and the name name like 'builtin:dockerfile'")
 	}
 
 	if err := fs.MkdirAll(ctx, path, ".ayup"); err != nil {
@@ -9,7 +9,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 
 	"go.opentelemetry.io/otel"
@@ -19,11 +21,17 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/muesli/termenv"
 
+	"premai.io/Ayup/go/cli/app"
 	"premai.io/Ayup/go/cli/assistants"
+	"premai.io/Ayup/go/cli/clients"
 	"premai.io/Ayup/go/cli/daemon"
 	"premai.io/Ayup/go/cli/key"
 	"premai.io/Ayup/go/cli/login"
+	"premai.io/Ayup/go/cli/profiles"
 	"premai.io/Ayup/go/cli/push"
+	"premai.io/Ayup/go/cli/secrets"
+	"premai.io/Ayup/go/cli/server"
+	"premai.io/Ayup/go/cli/servers"
 	"premai.io/Ayup/go/cli/state"
 	"premai.io/Ayup/go/internal/conf"
 	"premai.io/Ayup/go/internal/semver"
@@ -45,8 +53,57 @@ func (s *DaemonPreauthCmd) Run(g Globals) (err error) {
 	return daemon.RunPreauth(g.Ctx, s.P2pPrivKey)
 }
 
+type DaemonCtlFlags struct {
+	Host       string `env:"AYUP_DAEMON_CONTROL_HOST" help:"The daemon to send the request to, from a client with the admin role. The local daemon's control socket is used if not set"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+type DaemonLoginsCmd struct {
+	DaemonCtlFlags `embed:""`
+}
+
+func (s *DaemonLoginsCmd) Run(g Globals) error {
+	return daemon.Logins(g.Ctx, s.Host, s.P2pPrivKey)
+}
+
+type DaemonApproveCmd struct {
+	DaemonCtlFlags `embed:""`
+
+	Client string `arg:"" help:"The peer ID, or the start of it, of the client waiting to login"`
+	Role   string `enum:"viewer,developer,admin" default:"developer" help:"What the client will be allowed to do"`
+}
+
+func (s *DaemonApproveCmd) Run(g Globals) error {
+	return daemon.Approve(g.Ctx, s.Host, s.P2pPrivKey, s.Client, s.Role, false)
+}
+
+type DaemonInviteCmd struct {
+	DaemonCtlFlags `embed:""`
+
+	Role    string        `enum:"viewer,developer,admin" default:"developer" help:"What the invited client will be allowed to do"`
+	Expires time.Duration `default:"1h" help:"How long the invite can be used for"`
+}
+
+func (s *DaemonInviteCmd) Run(g Globals) error {
+	return daemon.Invite(g.Ctx, s.Host, s.P2pPrivKey, s.Role, s.Expires)
+}
+
+type DaemonRejectCmd struct {
+	DaemonCtlFlags `embed:""`
+
+	Client string `arg:"" help:"The peer ID, or the start of it, of the client waiting to login"`
+}
+
+func (s *DaemonRejectCmd) Run(g Globals) error {
+	return daemon.Approve(g.Ctx, s.Host, s.P2pPrivKey, s.Client, "", true)
+}
+
 type PushCmd struct {
 	Assistant string `env:"AYUP_ASSISTANT_PATH" help:"The path of a local assistant to use during this operation. To push multiple assistants see 'ay assistants'" type:"path"`
+	Detach    bool   `help:"Leave the app running on the server after the client exits, see 'ay app stop'"`
+	Watch     bool   `help:"Push again whenever the source changes, the app is left running on exit like --detach"`
+
+	SyncFlags `embed:""`
 
 	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of a service we can push to"`
 	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
@@ -76,8 +133,13 @@ func (s *PushCmd) Run(g Globals) (err error) {
 		p := push.Pusher{
 			Host:         s.Host,
 			P2pPrivKey:   s.P2pPrivKey,
+			App:          push.AppName(cli.App.Name, path),
 			AssistantDir: s.Assistant,
 			SrcDir:       path,
+			Detach:       s.Detach,
+			Watch:        s.Watch,
+			IgnoreFiles:  push.IgnoreFiles(s.GitIgnore, s.DockerIgnore),
+			Conflicts:    s.Conflicts,
 		}
 
 		err = p.Run(pprof.WithLabels(g.Ctx, pprof.Labels("command", "push")))
@@ -86,26 +148,239 @@ func (s *PushCmd) Run(g Globals) (err error) {
 	return
 }
 
+type SyncFlags struct {
+	GitIgnore    bool   `name:"gitignore" env:"AYUP_PUSH_GITIGNORE" help:"Don't upload files matched by .gitignore files, .ayupignore files are always read"`
+	DockerIgnore bool   `name:"dockerignore" env:"AYUP_PUSH_DOCKERIGNORE" help:"Don't upload files matched by the .dockerignore file in the source directory"`
+	Conflicts    string `env:"AYUP_DOWNLOAD_CONFLICTS" enum:"ask,keep,server" default:"ask" help:"When a file was changed locally and on the server; ask, keep the local version or use the server's"`
+}
+
+type AppCtlFlags struct {
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of a service we can push to"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func appName(ctx context.Context) (string, error) {
+	path, err := ensurePath(ctx, cli.App.Path)
+	if err != nil {
+		return "", err
+	}
+
+	return push.AppName(cli.App.Name, path), nil
+}
+
+type AppStartCmd struct {
+	AppCtlFlags `embed:""`
+}
+
+func (s *AppStartCmd) Run(g Globals) error {
+	name, err := appName(g.Ctx)
+	if err != nil {
+		return err
+	}
+
+	return app.Start(g.Ctx, s.Host, s.P2pPrivKey, name)
+}
+
+type AppStopCmd struct {
+	AppCtlFlags `embed:""`
+}
+
+func (s *AppStopCmd) Run(g Globals) error {
+	name, err := appName(g.Ctx)
+	if err != nil {
+		return err
+	}
+
+	return app.Stop(g.Ctx, s.Host, s.P2pPrivKey, name)
+}
+
+type AppRestartCmd struct {
+	AppCtlFlags `embed:""`
+}
+
+func (s *AppRestartCmd) Run(g Globals) error {
+	name, err := appName(g.Ctx)
+	if err != nil {
+		return err
+	}
+
+	return app.Restart(g.Ctx, s.Host, s.P2pPrivKey, name)
+}
+
+type AppAttachCmd struct {
+	AppCtlFlags `embed:""`
+	SyncFlags   `embed:""`
+}
+
+func (s *AppAttachCmd) Run(g Globals) (err error) {
+	pprof.Do(g.Ctx, pprof.Labels("command", "attach"), func(ctx context.Context) {
+		var path string
+		path, err = ensurePath(ctx, cli.App.Path)
+		if err != nil {
+			return
+		}
+
+		p := push.Pusher{
+			Host:        s.Host,
+			P2pPrivKey:  s.P2pPrivKey,
+			App:         push.AppName(cli.App.Name, path),
+			SrcDir:      path,
+			IgnoreFiles: push.IgnoreFiles(s.GitIgnore, s.DockerIgnore),
+			Conflicts:   s.Conflicts,
+		}
+
+		err = p.RunAttach(ctx)
+	})
+
+	return
+}
+
+type AppDownloadCmd struct {
+	AppCtlFlags `embed:""`
+	SyncFlags   `embed:""`
+
+	DryRun bool `help:"Print the changes which would be made to the source without making them"`
+}
+
+func (s *AppDownloadCmd) Run(g Globals) (err error) {
+	pprof.Do(g.Ctx, pprof.Labels("command", "download"), func(ctx context.Context) {
+		var path string
+		path, err = ensurePath(ctx, cli.App.Path)
+		if err != nil {
+			return
+		}
+
+		p := push.Pusher{
+			Host:        s.Host,
+			P2pPrivKey:  s.P2pPrivKey,
+			App:         push.AppName(cli.App.Name, path),
+			SrcDir:      path,
+			IgnoreFiles: push.IgnoreFiles(s.GitIgnore, s.DockerIgnore),
+			Conflicts:   s.Conflicts,
+			DryRun:      s.DryRun,
+		}
+
+		err = p.RunDownload(ctx)
+	})
+
+	return
+}
+
 type LoginCmd struct {
-	Host       string `arg:"" env:"AYUP_LOGIN_HOST" help:"The server's P2P multi-address including the peer ID e.g. /dns4/example.com/50051/p2p/1..."`
-	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"The client's private key, generated automatically if not set, also see 'ay key new'"`
+	Host       string        `arg:"" env:"AYUP_LOGIN_HOST" help:"The server's P2P multi-address including the peer ID e.g. /dns4/example.com/50051/p2p/1..."`
+	P2pPrivKey string        `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"The client's private key, generated automatically if not set, also see 'ay key new'"`
+	Label      string        `env:"AYUP_LOGIN_LABEL" help:"A name the server's admin will see this client as, the hostname is used if not set"`
+	Timeout    time.Duration `env:"AYUP_LOGIN_TIMEOUT" default:"5m" help:"How long to wait for the server's admin to approve the login"`
+	Invite     string        `env:"AYUP_LOGIN_INVITE" help:"A code from 'ay daemon invite', which logs in without waiting for approval"`
+	Context    string        `env:"AYUP_LOGIN_CONTEXT" help:"The name to save the server as, see 'ay context'. Derived from the server's address if not set"`
 }
 
 func (s *LoginCmd) Run(g Globals) error {
 	l := login.Login{
 		Host:       s.Host,
 		P2pPrivKey: s.P2pPrivKey,
+		Label:      s.Label,
+		Timeout:    s.Timeout,
+		Invite:     s.Invite,
+		Context:    s.Context,
 	}
 
 	return l.Run(g.Ctx)
 }
 
+type ContextAddCmd struct {
+	Name string `arg:"" help:"What to call the server"`
+	Host string `arg:"" help:"The server's P2P multi-address including the peer ID e.g. /dns4/example.com/50051/p2p/1..."`
+	Peer string `help:"The server's peer ID, taken from the host if not set"`
+	Key  string `help:"The client key to use with this server, produced by 'ay key new'. AYUP_CLIENT_P2P_PRIV_KEY is used if not set"`
+}
+
+func (s *ContextAddCmd) Run(g Globals) error {
+	return profiles.Add(g.Ctx, s.Name, s.Host, s.Peer, s.Key)
+}
+
+type ContextUseCmd struct {
+	Name    string `arg:"" optional:"" help:"The context to use. Leave blank with --project to remove the project's context"`
+	Project bool   `help:"Only use the context in this project, it is saved in the .ayup directory"`
+}
+
+func (s *ContextUseCmd) Run(g Globals) error {
+	return profiles.Use(g.Ctx, s.Name, s.Project, cli.App.Path)
+}
+
+type ContextListCmd struct{}
+
+func (s *ContextListCmd) Run(g Globals) error {
+	return profiles.List(g.Ctx, cli.App.Path)
+}
+
+type ContextRmCmd struct {
+	Name string `arg:"" help:"The context to remove"`
+}
+
+func (s *ContextRmCmd) Run(g Globals) error {
+	return profiles.Rm(g.Ctx, s.Name)
+}
+
+type ServersListCmd struct{}
+
+func (s *ServersListCmd) Run(g Globals) error {
+	return servers.List(g.Ctx)
+}
+
+type ServersForgetCmd struct {
+	Server string `arg:"" help:"The server's multi-address, with or without the peer ID, or the name of its context"`
+}
+
+func (s *ServersForgetCmd) Run(g Globals) error {
+	return servers.Forget(g.Ctx, s.Server)
+}
+
+type ServersAcceptCmd struct {
+	AppCtlFlags `embed:""`
+
+	Handoff string `arg:"" optional:"" help:"The handoff printed by 'ay key rotate --server'. Fetched from the server if not set, which only works until it restarts"`
+}
+
+func (s *ServersAcceptCmd) Run(g Globals) error {
+	return servers.Accept(g.Ctx, s.Host, s.P2pPrivKey, s.Handoff)
+}
+
 type KeyNewCmd struct{}
 
 func (s *KeyNewCmd) Run(g Globals) error {
 	return key.New(g.Ctx)
 }
 
+type KeyEncryptCmd struct {
+	Server bool `help:"Encrypt the daemon's key instead of the client's"`
+
+	ClientP2pPrivKey string `name:"client-p2p-priv-key" env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"The client's private key"`
+	ServerP2pPrivKey string `name:"server-p2p-priv-key" env:"AYUP_SERVER_P2P_PRIV_KEY" help:"The server's private key"`
+}
+
+func (s *KeyEncryptCmd) Run(g Globals) error {
+	if s.Server {
+		return key.Encrypt(g.Ctx, "AYUP_SERVER_P2P_PRIV_KEY", s.ServerP2pPrivKey)
+	}
+
+	return key.Encrypt(g.Ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.ClientP2pPrivKey)
+}
+
+type KeyRotateCmd struct {
+	AppCtlFlags `embed:""`
+
+	Server bool `help:"Rotate the local daemon's key instead, through its control socket"`
+}
+
+func (s *KeyRotateCmd) Run(g Globals) error {
+	if s.Server {
+		return daemon.RotateKey(g.Ctx, "", s.P2pPrivKey)
+	}
+
+	return key.Rotate(g.Ctx, s.Host, s.P2pPrivKey)
+}
+
 type StateAssistantCmd struct {
 	Name string `arg:"" optional:"" help:"The name of the assistant to set. Leave blank to see the current one."`
 }
@@ -135,26 +410,145 @@ func (s *AssistantsPush) Run(g Globals) error {
 	return assistants.Push(g.Ctx, cli.Assistants.Host, cli.Assistants.P2pPrivKey, path)
 }
 
+type ServerInfoCmd struct {
+	AppCtlFlags `embed:""`
+}
+
+func (s *ServerInfoCmd) Run(g Globals) error {
+	return server.Info(g.Ctx, s.Host, s.P2pPrivKey)
+}
+
+type ClientsListCmd struct {
+	AppCtlFlags `embed:""`
+}
+
+func (s *ClientsListCmd) Run(g Globals) error {
+	return clients.List(g.Ctx, s.Host, s.P2pPrivKey)
+}
+
+type ClientsRevokeCmd struct {
+	AppCtlFlags `embed:""`
+
+	Client string `arg:"" help:"The peer ID or label of the client"`
+}
+
+func (s *ClientsRevokeCmd) Run(g Globals) error {
+	return clients.Revoke(g.Ctx, s.Host, s.P2pPrivKey, s.Client)
+}
+
+type ClientsRenameCmd struct {
+	AppCtlFlags `embed:""`
+
+	Client string `arg:"" help:"The peer ID or label of the client"`
+	Label  string `arg:"" help:"The client's new label"`
+}
+
+func (s *ClientsRenameCmd) Run(g Globals) error {
+	return clients.Rename(g.Ctx, s.Host, s.P2pPrivKey, s.Client, s.Label)
+}
+
+type ClientsRoleCmd struct {
+	AppCtlFlags `embed:""`
+
+	Client string `arg:"" help:"The peer ID or label of the client"`
+	Role   string `arg:"" enum:"viewer,developer,admin" help:"viewer can see assistants and attach to logs, developer can also push and control apps, admin can also replace assistants and manage clients"`
+}
+
+func (s *ClientsRoleCmd) Run(g Globals) error {
+	return clients.SetRole(g.Ctx, s.Host, s.P2pPrivKey, s.Client, s.Role)
+}
+
+type SecretsFlags struct {
+	AppCtlFlags `embed:""`
+
+	App       string `help:"The app the secrets belong to. Its name is found the same way as 'ay app push' if not set"`
+	Assistant string `help:"Use the secrets of this assistant instead of an app's, e.g. local:prem. They are given to it whichever app it runs on"`
+}
+
+// scope returns the app or assistant whose secrets to change
+func (s *SecretsFlags) scope(ctx context.Context) (string, string, error) {
+	if s.Assistant != "" || s.App != "" {
+		return s.App, s.Assistant, nil
+	}
+
+	name, err := appName(ctx)
+	return name, "", err
+}
+
+type SecretsSetCmd struct {
+	SecretsFlags `embed:""`
+
+	Name  string `arg:"" help:"The environment variable the assistant gets the secret in"`
+	Value string `arg:"" optional:"" help:"Read from stdin, or asked for at the terminal, if not set. This keeps it out of the shell's history"`
+}
+
+func (s *SecretsSetCmd) Run(g Globals) error {
+	app, assistant, err := s.scope(g.Ctx)
+	if err != nil {
+		return err
+	}
+
+	return secrets.Set(g.Ctx, s.Host, s.P2pPrivKey, app, assistant, s.Name, s.Value)
+}
+
+type SecretsListCmd struct {
+	SecretsFlags `embed:""`
+}
+
+func (s *SecretsListCmd) Run(g Globals) error {
+	app, assistant, err := s.scope(g.Ctx)
+	if err != nil {
+		return err
+	}
+
+	return secrets.List(g.Ctx, s.Host, s.P2pPrivKey, app, assistant)
+}
+
+type SecretsRmCmd struct {
+	SecretsFlags `embed:""`
+
+	Name string `arg:"" help:"The secret's name"`
+}
+
+func (s *SecretsRmCmd) Run(g Globals) error {
+	app, assistant, err := s.scope(g.Ctx)
+	if err != nil {
+		return err
+	}
+
+	return secrets.Rm(g.Ctx, s.Host, s.P2pPrivKey, app, assistant, s.Name)
+}
+
 type AssistantsList struct{}
 
 func (s *AssistantsList) Run(g Globals) error {
 	return assistants.List(g.Ctx, cli.Assistants.Host, cli.Assistants.P2pPrivKey)
 }
 
-var cli struct {
+type CLI struct {
 	Login LoginCmd `group:"Client:" cmd:"" help:"Login to the Ayup service"`
 
 	Daemon struct {
 		Start           DaemonStartCmd           `cmd:"" help:"Start an Ayup service Daemon"`
 		StartInRootless DaemonStartInRootlessCmd `cmd:"" passthrough:"" help:"Start a utility daemon to do tasks such as port forwarding in the Rootlesskit namesapce" hidden:""`
 		Preauth         DaemonPreauthCmd         `cmd:"" help:"Create a server config where this client's peer ID is pre-authorised"`
+		Logins          DaemonLoginsCmd          `cmd:"" help:"List the logins waiting to be approved"`
+		Approve         DaemonApproveCmd         `cmd:"" help:"Approve a client's login"`
+		Reject          DaemonRejectCmd          `cmd:"" help:"Reject a client's login"`
+		Invite          DaemonInviteCmd          `cmd:"" help:"Create a code which lets a client login once without being approved"`
 	} `group:"Server:" cmd:"" help:"Self host Ayup on Linux"`
 
 	App struct {
 		Path string `env:"AYUP_APP_PATH" help:"The path to application source directory. The current working directory is used if not set"`
+		Name string `env:"AYUP_APP_NAME" help:"The application's name on the server. Derived from the source directory's name if not set"`
 
 		Push      PushCmd           `cmd:"" help:"Figure out how to deploy your application"`
 		Assistant StateAssistantCmd `cmd:"" help:"Set or get the first assistant to run. Left unset we'll try to detect what to run"`
+		Attach    AppAttachCmd      `cmd:"" help:"Reconnect to the app's push after the connection was lost"`
+		Download  AppDownloadCmd    `cmd:"" help:"Apply the changes made to the app's source on the server"`
+		Start     AppStartCmd       `cmd:"" help:"Start the app in the background using its last build"`
+		Stop      AppStopCmd        `cmd:"" help:"Stop the app running in the background"`
+		Restart   AppRestartCmd     `cmd:"" help:"Restart the app in the background using its last build"`
 	} `group:"Client:" cmd:"" help:"Manage the application state"`
 
 	Assistants struct {
@@ -165,6 +559,42 @@ var cli struct {
 		List AssistantsList `cmd:"" help:"List the available assistants on the server"`
 	} `group:"Client:" cmd:"" help:"Manage build and deployment assistants"`
 
+	Secrets struct {
+		Set  SecretsSetCmd  `cmd:"" help:"Set a secret which is given to assistants as an environment variable"`
+		List SecretsListCmd `cmd:"" help:"List the names of the secrets, their values can't be read back"`
+		Rm   SecretsRmCmd   `cmd:"" help:"Remove a secret"`
+	} `group:"Client:" cmd:"" help:"Manage the secrets of apps and assistants, they are stored encrypted on the server"`
+
+	Server struct {
+		Info ServerInfoCmd `cmd:"" help:"Show the server's quotas and how much of them this client is using"`
+	} `group:"Client:" cmd:"" help:"Query the server"`
+
+	Clients struct {
+		List   ClientsListCmd   `cmd:"" help:"List the clients which are authorized to use the server"`
+		Revoke ClientsRevokeCmd `cmd:"" help:"Stop a client from using the server, it is disconnected straight away"`
+		Rename ClientsRenameCmd `cmd:"" help:"Change the label a client is listed with"`
+		Role   ClientsRoleCmd   `cmd:"" help:"Change what a client is allowed to do"`
+	} `group:"Client:" cmd:"" help:"Manage the clients authorized to use the server"`
+
+	Context struct {
+		Add  ContextAddCmd  `cmd:"" help:"Save a server to switch to later"`
+		Use  ContextUseCmd  `cmd:"" help:"Send requests to the named server by default"`
+		List ContextListCmd `cmd:"" help:"List the saved servers, the one in use is marked with a *"`
+		Rm   ContextRmCmd   `cmd:"" help:"Forget a saved server"`
+	} `group:"Client:" cmd:"" help:"Switch between servers"`
+
+	Servers struct {
+		List   ServersListCmd   `cmd:"" help:"List the servers logged into and the peer IDs they must have"`
+		Forget ServersForgetCmd `cmd:"" help:"Forget a server's peer ID, so that a new one is accepted on the next login"`
+		Accept ServersAcceptCmd `cmd:"" help:"Switch to a server's new peer ID after its key was rotated"`
+	} `group:"Client:" cmd:"" help:"Manage the servers this client trusts"`
+
+	Key struct {
+		New     KeyNewCmd     `cmd:"" help:"Print a new private key and its peer ID"`
+		Rotate  KeyRotateCmd  `cmd:"" help:"Replace this client's key for a server, or with --server the local daemon's key"`
+		Encrypt KeyEncryptCmd `cmd:"" help:"Move this client's key, or with --server the daemon's key, to a file encrypted with a passphrase"`
+	} `group:"Client:" cmd:"" help:"Manage the keys used to connect with libp2p"`
+
 	// maybe effected by https://github.com/open-telemetry/opentelemetry-go/issues/5562
 	// also https://github.com/moby/moby/issues/46129#issuecomment-2016552967
 	TelemetryEndpoint       string `group:"Monitoring:" env:"OTEL_EXPORTER_OTLP_ENDPOINT" help:"the host that telemetry data is sent to; e.g. http://localhost:4317"`
@@ -172,6 +602,36 @@ var cli struct {
 	ProfilingEndpoint       string `group:"Monitoring:" env:"PYROSCOPE_ADHOC_SERVER_ADDRESS" help:"URL performance data is sent to; e.g. http://localhost:4040"`
 }
 
+var cli CLI
+
+// Set by CLI.BeforeReset and reported once tracing is setup
+var (
+	profileName     string
+	profileErr      error
+	godotenvLoadErr error
+	// The server key was in the environment before the env file was loaded, so it overrides the
+	// env file
+	serverKeyInEnv bool
+)
+
+// BeforeReset applies the project's context and then the env file. It runs after the command line
+// is read, so the context is found using --path if it was given, but before the flags' defaults
+// are taken from the environment.
+func (s *CLI) BeforeReset(ktx *kong.Context) error {
+	appPath := os.Getenv("AYUP_APP_PATH")
+	for _, trace := range ktx.Path {
+		if trace.Flag != nil && trace.Flag.Name == "path" {
+			appPath, _ = ktx.FlagValue(trace.Flag).(string)
+		}
+	}
+
+	profileName, profileErr = conf.ApplyProfile(appPath)
+	_, serverKeyInEnv = os.LookupEnv("AYUP_SERVER_P2P_PRIV_KEY")
+	godotenvLoadErr = godotenv.Load(filepath.Join(conf.UserConfigDir(), "env"))
+
+	return nil
+}
+
 func Main(version []byte) {
 	ctx := context.Background()
 
@@ -189,12 +649,16 @@ func Main(version []byte) {
 	fmt.Fprintln(os.Stderr, titleStyle.Render("Ayup!"), versionStyle.Render("v"+string(version)))
 	fmt.Fprintln(os.Stderr)
 
-	confDir := conf.UserConfigDir()
-	godotenvLoadErr := godotenv.Load(filepath.Join(confDir, "env"))
+	// Logging is needed by the hooks which run while parsing, such as loading config sources
+	ayTrace.SetupZapLogging(filepath.Join(conf.UserRoot(), "logs"))
 
-	ktx := kong.Parse(&cli, kong.UsageOnError(), kong.Description("Just make it run!"))
+	ktx := kong.Parse(
+		&cli,
+		kong.UsageOnError(),
+		kong.Description("Just make it run!"),
+		kong.BindTo(ctx, (*context.Context)(nil)),
+	)
 
-	ayTrace.SetupZapLogging(filepath.Join(conf.UserRoot(), "logs"))
 	ayTrace.SetupPyroscopeProfiling(cli.ProfilingEndpoint)
 
 	if cli.TelemetryEndpoint != "" || cli.TelemetryEndpointTraces != "" {
@@ -216,6 +680,11 @@ func Main(version []byte) {
 	defer span.End()
 
 	terror.Ackf(ctx, "godotenv load: %w", godotenvLoadErr)
+	if profileErr != nil {
+		fmt.Fprintln(os.Stderr, errorStyle.Render("Context not used!"), profileErr)
+	} else if profileName != "" {
+		ayTrace.Event(ctx, "using context", attribute.String("name", profileName))
+	}
 
 	err := ktx.Run(Globals{
 		Ctx:    ctx,
@@ -8,10 +8,12 @@ import (
 	"path/filepath"
 	"runtime/pprof"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/alecthomas/kong"
+	units "github.com/docker/go-units"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"go.opentelemetry.io/otel/attribute"
 	"premai.io/Ayup/go/inrootless"
 	"premai.io/Ayup/go/internal/conf"
 	"premai.io/Ayup/go/internal/terror"
@@ -23,11 +25,106 @@ type DaemonStartCmd struct {
 	Host string `env:"AYUP_DAEMON_HOST" default:":50051" help:"The addresses and port to listen on"`
 
 	P2pPrivKey           string `env:"AYUP_SERVER_P2P_PRIV_KEY" help:"The server's private key, generated automatically if not set, also see 'ay key new'"`
-	P2pAuthorizedClients string `env:"AYUP_P2P_AUTHORIZED_CLIENTS" help:"Comma deliminated public keys of logged in clients"`
+	P2pAuthorizedClients string `env:"AYUP_P2P_AUTHORIZED_CLIENTS" help:"Comma deliminated peer IDs of clients to authorize without logging in. Clients that log in are recorded in the data directory instead, see 'ay clients'"`
 
-	Aws bool `env:"AYUP_AWS" help:"Indicate we are running in an Amazon ec2 instance and can use services like the secrets store"`
+	ConfigSource []string `env:"AYUP_CONFIG_SOURCE" help:"Where to load config from besides the environment; e.g. file:///etc/ayup/env, env://?prefix=PROD_, exec:///path/to/cmd?arg=x or aws-sm://secret-name. Later sources take precedence, command line switches take precedence over all of them"`
+	Aws          bool     `env:"AYUP_AWS" hidden:"" help:"Deprecated, the same as --config-source=aws-sm://ayup-preauth-conf"`
 
 	AssistantsDir string `env:"AYUP_ASSISTANTS_DIR" help:"Local path to the source code for the 'remote' assistants. That is assistants distributed with Ayup or from somewhere other than the client machine"`
+
+	RestartApps bool `env:"AYUP_RESTART_APPS" help:"Restart the apps which were running in the background when the daemon was last stopped"`
+
+	QuotaUpload  string `env:"AYUP_QUOTA_UPLOAD" help:"The most data each client can send in one upload; e.g. 500MB. Unlimited if not set"`
+	QuotaApps    string `env:"AYUP_QUOTA_APPS" help:"The disk space each client's apps can take up, not including scratch space; e.g. 10GB. Unlimited if not set"`
+	QuotaScratch string `env:"AYUP_QUOTA_SCRATCH" help:"The scratch space each client's apps can use while building; e.g. 20GB. Unlimited if not set"`
+
+	StopSignal  string        `env:"AYUP_STOP_SIGNAL" enum:"SIGTERM,SIGINT,SIGQUIT,SIGHUP,SIGUSR1,SIGUSR2" default:"SIGTERM" help:"The signal sent to apps to stop them, including when the daemon shuts down"`
+	StopTimeout time.Duration `env:"AYUP_STOP_TIMEOUT" default:"10s" help:"How long apps have to exit after the stop signal before they are killed"`
+
+	LoginTimeout time.Duration `env:"AYUP_DAEMON_LOGIN_TIMEOUT" default:"5m" help:"How long a login waits to be approved with 'ay daemon approve' or at the terminal before it expires"`
+
+	MetricsHost string `env:"AYUP_METRICS_HOST" help:"The address and port to serve Prometheus metrics on; e.g. :9090. Metrics are not served if not set"`
+
+	// Where P2pPrivKey was set if not in the env file, see BeforeResolve
+	keySource string
+}
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// parseSize converts a human readable size such as 10GB to bytes, an empty string is zero
+func parseSize(ctx context.Context, name string, size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+
+	n, err := units.RAMInBytes(size)
+	if err != nil {
+		return 0, terror.Errorf(ctx, "%s: units RAMInBytes: %w", name, err)
+	}
+
+	return n, nil
+}
+
+// BeforeResolve loads the config sources and adds them as a resolver, so that they take
+// precedence over the environment and env file, but not the command line. It also records where
+// the server key was set, because a rotated key is only saved in the env file or key file.
+func (s *DaemonStartCmd) BeforeResolve(ctx context.Context, ktx *kong.Context, path *kong.Path) error {
+	config, err := loadSources(ctx, ktx, path)
+	if err != nil {
+		return err
+	}
+
+	if config != nil {
+		ktx.AddResolver(conf.Resolver(config))
+	}
+
+	s.keySource = ""
+	if serverKeyInEnv {
+		s.keySource = "the environment"
+	}
+	if _, ok := config["AYUP_SERVER_P2P_PRIV_KEY"]; ok {
+		s.keySource = "a config source"
+	}
+	for _, trace := range ktx.Path {
+		if trace.Flag != nil && trace.Flag.Name == "p2p-priv-key" {
+			s.keySource = "the command line"
+		}
+	}
+
+	return nil
+}
+
+// loadSources loads the config from the sources given by --config-source and --aws, it is nil if
+// there are none
+func loadSources(ctx context.Context, ktx *kong.Context, path *kong.Path) (map[string]string, error) {
+	var sources []string
+	for _, flag := range path.Node().Flags {
+		switch flag.Name {
+		case "aws":
+			if aws, _ := ktx.FlagValue(flag).(bool); aws {
+				sources = append([]string{conf.AwsPreauthSource}, sources...)
+			}
+		case "config-source":
+			val, _ := ktx.FlagValue(flag).([]string)
+			sources = append(sources, val...)
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil, nil
+	}
+
+	ctx, span := trace.Span(ctx, "load config sources")
+	defer span.End()
+
+	return conf.LoadSources(ctx, sources)
 }
 
 func (s *DaemonStartCmd) Run(g Globals) (err error) {
@@ -35,13 +132,6 @@ func (s *DaemonStartCmd) Run(g Globals) (err error) {
 	defer span.End()
 
 	pprof.Do(ctx, pprof.Labels("command", "deamon start"), func(ctx context.Context) {
-		var tmp string
-		tmp, err = os.MkdirTemp("", "ayup-*")
-		if err != nil {
-			err = terror.Errorf(ctx, "MkdirTemp: %w", err)
-			return
-		}
-
 		err = os.MkdirAll(conf.UserRuntimeDir(), 0770)
 		if err != nil {
 			err = terror.Errorf(ctx, "MkdirAll: %w", err)
@@ -55,45 +145,37 @@ func (s *DaemonStartCmd) Run(g Globals) (err error) {
 		}
 
 		r := srv.Srv{
-			AssistantDir:        filepath.Join(tmp, "assist"),
 			RemoteAssistantsDir: s.AssistantsDir,
 			LocalAssistantsDir:  assistantsDataDir,
-			AppDir:              filepath.Join(tmp, "app"),
-			StateDir:            filepath.Join(tmp, "state"),
-			ScratchDir:          filepath.Join(tmp, "scratch"),
+			AppsDir:             filepath.Join(conf.UserRoot(), "apps"),
+			ClientsFile:         filepath.Join(conf.UserRoot(), "clients.json"),
+			KeyHandoffFile:      filepath.Join(conf.UserRoot(), "key-handoff"),
+			SecretsFile:         filepath.Join(conf.UserRoot(), "secrets.json"),
+			SecretsKeyFile:      filepath.Join(conf.UserRoot(), "secrets.key"),
+			RestartApps:         s.RestartApps,
+			StopSignal:          stopSignals[s.StopSignal],
+			StopTimeout:         s.StopTimeout,
+			MetricsHost:         s.MetricsHost,
+			ControlSocket:       conf.ControlSocket(),
+			LoginTimeout:        s.LoginTimeout,
 			Host:                s.Host,
 			P2pPrivKey:          s.P2pPrivKey,
+			P2pPrivKeySource:    s.keySource,
 		}
 
-		authedClientsStr := s.P2pAuthorizedClients
-		if s.Aws {
-			var confStr string
-			confStr, err = conf.LoadConfigFromAWS(ctx)
-			if err != nil {
-				return
-			}
-
-			var conf map[string]string
-			conf, err = godotenv.Unmarshal(confStr)
-			if err != nil {
-				err = terror.Errorf(ctx, "godotenv Unmarshal: %w", err)
-				return
-			}
-
-			if key, ok := conf["AYUP_SERVER_P2P_PRIV_KEY"]; ok {
-				trace.Event(ctx, "set private key from AWS config")
-				r.P2pPrivKey = key
-			}
-
-			if clients, ok := conf["AYUP_P2P_AUTHORIZED_CLIENTS"]; ok {
-				trace.Event(ctx, "set authorized clients from AWS config", attribute.String("clients", clients))
-				authedClientsStr = clients
-			}
+		if r.Quotas.Upload, err = parseSize(ctx, "quota-upload", s.QuotaUpload); err != nil {
+			return
+		}
+		if r.Quotas.Apps, err = parseSize(ctx, "quota-apps", s.QuotaApps); err != nil {
+			return
+		}
+		if r.Quotas.Scratch, err = parseSize(ctx, "quota-scratch", s.QuotaScratch); err != nil {
+			return
 		}
 
 		var authedClients []peer.ID
-		if authedClientsStr != "" {
-			for _, peerStr := range strings.Split(authedClientsStr, ",") {
+		if s.P2pAuthorizedClients != "" {
+			for _, peerStr := range strings.Split(s.P2pAuthorizedClients, ",") {
 
 				var peerId peer.ID
 				peerId, err = peer.Decode(peerStr)
@@ -105,7 +187,7 @@ func (s *DaemonStartCmd) Run(g Globals) (err error) {
 				authedClients = append(authedClients, peerId)
 			}
 		}
-		r.P2pAuthedClients = authedClients
+		r.P2pPreauthedClients = authedClients
 
 		err = r.RunServer(ctx)
 	})
@@ -1,14 +1,16 @@
 package inrootless
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -100,18 +102,86 @@ func startConn(g *errgroup.Group, pctx context.Context, port uint32, ip string,
 	return conn, nil
 }
 
-func (s *inrSrv) Forward(stream pb.InRootless_ForwardServer) error {
-	ctx := stream.Context()
+// Where libcni caches the result of setting up each container's network
+const cniResultsDir = "/var/lib/cni/results"
+
+// The parts of a libcni cache entry which are needed to find a container's IP
+type cniCachedResult struct {
+	CniArgs [][2]string `json:"cniArgs"`
+	Result  struct {
+		IPs []struct {
+			Address string `json:"address"`
+		} `json:"ips"`
+	} `json:"result"`
+}
+
+// containerIp finds the IP of the container created with hostname. Buildkit gives containers
+// with a hostname their own network namespace and passes the hostname to CNI, which caches it
+// with the IP it assigned.
+func containerIp(ctx context.Context, hostname string) (string, error) {
+	ents, err := os.ReadDir(cniResultsDir)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", terror.Errorf(ctx, "os ReadDir: %w", err)
+	}
+
+	for _, ent := range ents {
+		if !strings.HasPrefix(ent.Name(), "buildkit-") {
+			continue
+		}
 
-	bs, err := os.ReadFile("/var/lib/cni/networks/buildkit/last_reserved_ip.0")
+		bs, err := os.ReadFile(filepath.Join(cniResultsDir, ent.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", terror.Errorf(ctx, "os ReadFile: %w", err)
+		}
+
+		var res cniCachedResult
+		if err := json.Unmarshal(bs, &res); err != nil {
+			// It may be being written
+			trace.Event(ctx, "skip CNI result", attribute.String("name", ent.Name()), attribute.String("error", err.Error()))
+			continue
+		}
+
+		if !slices.Contains(res.CniArgs, [2]string{"K8S_POD_NAME", hostname}) || len(res.Result.IPs) < 1 {
+			continue
+		}
+
+		ip, _, err := net.ParseCIDR(res.Result.IPs[0].Address)
+		if err != nil {
+			return "", terror.Errorf(ctx, "net ParseCIDR: %w", err)
+		}
+
+		trace.Event(ctx, "container IP", attribute.String("hostname", hostname), attribute.String("ip", ip.String()))
+
+		return ip.String(), nil
+	}
+
+	return "", nil
+}
+
+func (s *inrSrv) ContainerIp(ctx context.Context, req *pb.ContainerIpRequest) (*pb.ContainerIpResponse, error) {
+	if req.Hostname == "" {
+		return nil, terror.Errorf(ctx, "no hostname")
+	}
+
+	ip, err := containerIp(ctx, req.Hostname)
 	if err != nil {
-		return terror.Errorf(ctx, "os ReadFile: %w", err)
+		return nil, err
 	}
-	ip := string(bytes.TrimSpace(bs))
+
+	return &pb.ContainerIpResponse{Ip: ip}, nil
+}
+
+func (s *inrSrv) Forward(stream pb.InRootless_ForwardServer) error {
+	ctx := stream.Context()
 
 	fmt.Println("starting forward")
-	trace.Event(ctx, "last reserved IP", attribute.String("ip", string(bs)))
 
+	var ip string
 	var conn net.Conn
 	var port uint32
 	var g errgroup.Group
@@ -140,6 +210,10 @@ func (s *inrSrv) Forward(stream pb.InRootless_ForwardServer) error {
 
 			if conn == nil {
 				port = req.Port
+				ip = req.Ip
+				if ip == "" {
+					return terror.Errorf(ctx, "no IP to forward port %d to", port)
+				}
 				err = withDetachedNetNSIfAny(ctx, func(ctx context.Context) error {
 					conn, err = startConn(&g, ctx, port, ip, stream)
 					return err
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -17,6 +18,7 @@ import (
 	gateway "github.com/moby/buildkit/frontend/gateway/client"
 	gatewayapi "github.com/moby/buildkit/frontend/gateway/pb"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/metrics"
 	"premai.io/Ayup/go/internal/terror"
 	"premai.io/Ayup/go/internal/trace"
 )
@@ -26,16 +28,26 @@ type RecvReq struct {
 	Err error
 }
 
+// Sender is where replies to the client go. Usually this is a session which outlives the
+// client's stream, so that the client can reattach.
+type Sender interface {
+	Send(*pb.ActReply) error
+}
+
 type Context struct {
 	Ctx         context.Context
 	SendMutex   *sync.Mutex
-	Stream      pb.Srv_AssistServer
+	Stream      Sender
 	Client      *client.Client
 	RecvChan    chan RecvReq
 	OnLog       func([]byte)
+	AppId       string
 	AppPath     string
 	StatePath   string
 	ScratchPath string
+	Procs       *Procs
+	// Returns the secrets set for the assistant and app with 'ay secrets', nil if there are none
+	Secrets func(ctx context.Context, assistant string) (map[string][]byte, error)
 }
 
 func (s *Context) Span(name string, attrs ...attribute.KeyValue) (Context, tr.Span) {
@@ -48,13 +60,89 @@ func (s *Context) Span(name string, attrs ...attribute.KeyValue) (Context, tr.Sp
 		Client:      s.Client,
 		RecvChan:    s.RecvChan,
 		OnLog:       s.OnLog,
+		AppId:       s.AppId,
 		AppPath:     s.AppPath,
 		StatePath:   s.StatePath,
 		ScratchPath: s.ScratchPath,
+		Procs:       s.Procs,
+		Secrets:     s.Secrets,
 	}, span
 }
 
+// CancelledError is returned by a step which the client cancelled
+type CancelledError struct {
+	Step string
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("cancelled at step %s", e.Step)
+}
+
+// WatchCancel returns a copy of the context which is cancelled if the client sends a cancel
+// request during step. It reads RecvChan, so nothing else may until stop is called. Stop
+// replaces the step's error with a CancelledError if it was cancelled.
+func (s Context) WatchCancel(step string) (Context, func(err error) error) {
+	ctx, cancel := context.WithCancel(s.Ctx)
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+
+	var cancelled bool
+	var recvErr error
+
+	go func() {
+		defer close(doneChan)
+
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ctx.Done():
+				return
+			case req := <-s.RecvChan:
+				if req.Err != nil {
+					recvErr = req.Err
+					cancel()
+					return
+				}
+
+				if req.Req.GetCancel() {
+					trace.Event(ctx, "Got cancel", attribute.String("step", step))
+					cancelled = true
+					cancel()
+					return
+				}
+
+				trace.Event(ctx, "Ignored request while watching for cancel", attribute.String("step", step))
+			}
+		}
+	}()
+
+	wctx := s
+	wctx.Ctx = ctx
+
+	return wctx, func(err error) error {
+		close(stopChan)
+		<-doneChan
+		cancel()
+
+		if cancelled {
+			return &CancelledError{Step: step}
+		}
+
+		if err != nil && recvErr != nil {
+			return terror.Errorf(s.Ctx, "stream recv: %w", recvErr)
+		}
+
+		return err
+	}
+}
+
+// Send a reply to the client, unless the app is detached and there is no client
 func (s *Context) Send(msg *pb.ActReply) error {
+	if s.Stream == nil {
+		return nil
+	}
+
 	s.SendMutex.Lock()
 	defer s.SendMutex.Unlock()
 
@@ -102,7 +190,8 @@ func (s *logWriter) Close() error {
 	return nil
 }
 
-func (s Context) ExecProc(ctr gateway.Container, source string, cwd string, cmd []string) error {
+// ExecProc runs cmd in ctr, which must have been created with hostname, until it exits
+func (s Context) ExecProc(ctr gateway.Container, hostname string, source string, cwd string, cmd []string) error {
 	logWriter := logWriter{aCtx: s, source: source, onLog: s.OnLog}
 
 	if err := s.Send(&pb.ActReply{
@@ -125,12 +214,22 @@ func (s Context) ExecProc(ctr gateway.Container, source string, cwd string, cmd
 		return terror.Errorf(s.Ctx, "ctr Start: %w", err)
 	}
 
+	if s.Procs != nil {
+		if err := s.Procs.Add(s.Ctx, source, hostname, pid); err != nil {
+			return err
+		}
+		defer s.Procs.Del(s.Ctx, source)
+	}
+
 	waitChan := make(chan error)
 
 	go func() {
 		var retErr error
 
+		exitCode := "0"
 		if err := pid.Wait(); err != nil {
+			exitCode = "unknown"
+
 			var exitError *gatewayapi.ExitError
 			if ok := errors.As(err, &exitError); ok {
 				trace.Event(s.Ctx, "Child exited",
@@ -140,9 +239,12 @@ func (s Context) ExecProc(ctr gateway.Container, source string, cwd string, cmd
 
 				if exitError.ExitCode >= gatewayapi.UnknownExitStatus {
 					retErr = exitError.Err
+				} else {
+					exitCode = strconv.FormatUint(uint64(exitError.ExitCode), 10)
 				}
 			}
 		}
+		metrics.ExecExits.WithLabelValues(exitCode).Inc()
 
 		if retErr != nil {
 			waitChan <- terror.Errorf(s.Ctx, "pid Wait: %w", retErr)
@@ -160,6 +262,12 @@ func (s Context) ExecProc(ctr gateway.Container, source string, cwd string, cmd
 				return err
 			}
 			return nil
+		case <-s.Ctx.Done():
+			trace.Event(s.Ctx, "Context done, killing process")
+			if err := pid.Signal(context.Background(), syscall.SIGKILL); err != nil {
+				terror.Ackf(s.Ctx, "pid Signal: %w", err)
+			}
+			return s.Ctx.Err()
 		case req := <-s.RecvChan:
 			trace.Event(s.Ctx, "Got user request")
 
@@ -19,6 +19,8 @@ const (
 	Builtin Kind = "builtin"
 	Local   Kind = "local"
 	Remote  Kind = "remote"
+	// Uploaded with an app by ay push --assistant, only that app can use it
+	App Kind = "app"
 )
 
 func LoadName(ctx context.Context, assistantPath string) ([]byte, error) {
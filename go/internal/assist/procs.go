@@ -0,0 +1,147 @@
+package assist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"sync"
+	"syscall"
+
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// Procs is the registry of processes an app has running and the ports they can be reached on
+type Procs struct {
+	mutex sync.Mutex
+	table map[string]gateway.ContainerProcess
+	ports []uint32
+	addr  string
+
+	lookupAddr func(ctx context.Context, hostname string) (string, error)
+}
+
+// NewProcs creates a registry which uses lookupAddr to find the address of an app's container,
+// from the hostname it was created with, after one of its processes is started
+func NewProcs(lookupAddr func(ctx context.Context, hostname string) (string, error)) *Procs {
+	return &Procs{
+		table:      make(map[string]gateway.ContainerProcess),
+		lookupAddr: lookupAddr,
+	}
+}
+
+// NewHostname returns a hostname for an app's container. Each container gets a different one, so
+// that its address can be found with it.
+func NewHostname() (string, error) {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+
+	return "ayup-" + hex.EncodeToString(bs), nil
+}
+
+// Add registers a process which was started in the container created with hostname
+func (s *Procs) Add(ctx context.Context, name string, hostname string, proc gateway.ContainerProcess) error {
+	var addr string
+	if s.lookupAddr != nil {
+		var err error
+		if addr, err = s.lookupAddr(ctx, hostname); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	trace.Event(ctx, "proc added", attribute.String("name", name), attribute.String("addr", addr))
+	s.table[name] = proc
+	s.addr = addr
+
+	return nil
+}
+
+// Del removes a process after it exits. Once none are left the app can't be reached, so its
+// address and ports are cleared.
+func (s *Procs) Del(ctx context.Context, name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	trace.Event(ctx, "proc deleted", attribute.String("name", name))
+	delete(s.table, name)
+
+	if len(s.table) < 1 {
+		s.addr = ""
+		s.ports = nil
+	}
+}
+
+func (s *Procs) Get(name string) (gateway.ContainerProcess, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	proc, ok := s.table[name]
+	return proc, ok
+}
+
+// Signal sends sig to every process the app has running
+func (s *Procs) Signal(ctx context.Context, sig syscall.Signal) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name, proc := range s.table {
+		trace.Event(ctx, "signal proc", attribute.String("name", name), attribute.Int("signal", int(sig)))
+
+		if err := proc.Signal(ctx, sig); err != nil {
+			return terror.Errorf(ctx, "proc Signal(%s): %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Procs) Names() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make([]string, 0, len(s.table))
+	for name := range s.table {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+func (s *Procs) SetPorts(ports []uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ports = slices.Clone(ports)
+}
+
+func (s *Procs) HasPort(port uint32) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return slices.Contains(s.ports, port)
+}
+
+func (s *Procs) Ports() []uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return slices.Clone(s.ports)
+}
+
+// Addr is the address of the app's container or empty if nothing has been started
+func (s *Procs) Addr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.addr
+}
@@ -0,0 +1,42 @@
+package assist
+
+import (
+	"slices"
+
+	"go.opentelemetry.io/otel/attribute"
+	"premai.io/Ayup/go/internal/trace"
+
+	"github.com/moby/buildkit/client/llb"
+)
+
+// LoadSecrets returns the assistant's secrets for the buildkit session and the run options which
+// give them to its command as environment variables
+func (s *Context) LoadSecrets(assistant string) (map[string][]byte, []llb.RunOption, error) {
+	providerMap := make(map[string][]byte)
+	var secretsRunOpts []llb.RunOption
+
+	if s.Secrets == nil {
+		return providerMap, secretsRunOpts, nil
+	}
+
+	secrets, err := s.Secrets(s.Ctx, assistant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Sorted so the build definition and its cache key don't change with the map's order
+	names := make([]string, 0, len(secrets))
+	for k := range secrets {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	for _, k := range names {
+		providerMap[k] = secrets[k]
+		secretsRunOpts = append(secretsRunOpts, llb.AddSecret(k, llb.SecretAsEnv(true)))
+	}
+
+	trace.Event(s.Ctx, "secrets loaded", attribute.String("assistant", assistant), attribute.Int("count", len(secrets)))
+
+	return providerMap, secretsRunOpts, nil
+}
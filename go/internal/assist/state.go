@@ -8,6 +8,7 @@ import (
 
 	"github.com/containerd/platforms"
 	"github.com/moby/buildkit/client/llb"
+	solverPb "github.com/moby/buildkit/solver/pb"
 	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/exp/constraints"
 
@@ -44,6 +45,13 @@ func NewState(srcPath string, path string, registry Registry) State {
 	}
 }
 
+// WithPath returns a copy of the state which reads and writes its files in path
+func (s State) WithPath(path string) State {
+	s.Path = path
+
+	return s
+}
+
 func (s State) Join(parts ...string) string {
 	return filepath.Join(s.Path, filepath.Join(parts...))
 }
@@ -279,6 +287,85 @@ func (s State) LoadState(ctx context.Context) (State, error) {
 	return s, nil
 }
 
+// SaveBuilt writes what is needed to execute the app into dir. So that it can be started again
+// after the daemon restarts.
+func (s State) SaveBuilt(ctx context.Context, dir string) error {
+	if s.buildDef == nil {
+		return terror.Errorf(ctx, "state has no build definition")
+	}
+
+	if err := fs.MkdirAll(ctx, dir); err != nil {
+		return err
+	}
+
+	def, err := s.buildDef.ToPB().Marshal()
+	if err != nil {
+		return terror.Errorf(ctx, "Definition Marshal: %w", err)
+	}
+
+	cmd, err := json.Marshal(s.cmd)
+	if err != nil {
+		return terror.Errorf(ctx, "json Marshal: %w", err)
+	}
+
+	ports, err := json.Marshal(s.ports)
+	if err != nil {
+		return terror.Errorf(ctx, "json Marshal: %w", err)
+	}
+
+	for name, bs := range map[string][]byte{
+		"def":        def,
+		"cmd":        cmd,
+		"ports":      ports,
+		"workingdir": []byte(s.workingDir),
+	} {
+		if err := fs.WriteFile(ctx, bs, dir, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadBuilt reads a state written by SaveBuilt. The state's path is set to srcPath, which is
+// where the app's .ayup dir is kept between pushes.
+func LoadBuilt(ctx context.Context, srcPath string, dir string, registry Registry) (State, error) {
+	s := NewState(srcPath, srcPath, registry)
+
+	bs, err := fs.ReadFile(ctx, dir, "def")
+	if err != nil {
+		return s, err
+	}
+
+	var def solverPb.Definition
+	if err := def.Unmarshal(bs); err != nil {
+		return s, terror.Errorf(ctx, "Definition Unmarshal: %w", err)
+	}
+	s.buildDef = &llb.Definition{}
+	s.buildDef.FromPB(&def)
+
+	if bs, err = fs.ReadFile(ctx, dir, "cmd"); err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(bs, &s.cmd); err != nil {
+		return s, terror.Errorf(ctx, "json Unmarshal: %w", err)
+	}
+
+	if bs, err = fs.ReadFile(ctx, dir, "ports"); err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(bs, &s.ports); err != nil {
+		return s, terror.Errorf(ctx, "json Unmarshal: %w", err)
+	}
+
+	if bs, err = fs.ReadFile(ctx, dir, "workingdir"); err != nil {
+		return s, err
+	}
+	s.workingDir = string(bs)
+
+	return s, nil
+}
+
 func (s State) GetNext() Assistant {
 	return s.next
 }
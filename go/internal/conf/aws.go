@@ -2,27 +2,64 @@ package conf
 
 import (
 	"context"
+	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
-	"premai.io/Ayup/go/internal/terror"
+	"github.com/joho/godotenv"
 )
 
-func LoadConfigFromAWS(ctx context.Context) (string, error) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithEC2IMDSRegion())
+// AwsPreauthSource is the secret read by 'ay daemon start --aws'
+const AwsPreauthSource = "aws-sm://ayup-preauth-conf"
+
+func init() {
+	RegisterProvider("aws-sm", newAwsProvider)
+}
+
+// awsProvider reads a secret from the AWS Secrets Manager in the dotenv format, for e.g.
+// aws-sm://ayup-preauth-conf?region=eu-west-1. The region is taken from the EC2 instance if not
+// set.
+type awsProvider struct {
+	secretName string
+	region     string
+}
+
+func newAwsProvider(u *url.URL) (Provider, error) {
+	secretName := strings.TrimPrefix(u.Host+u.Path, "/")
+	if secretName == "" {
+		return nil, fmt.Errorf("the aws-sm source has no secret name, e.g. aws-sm://ayup-preauth-conf")
+	}
+
+	return &awsProvider{secretName: secretName, region: u.Query().Get("region")}, nil
+}
+
+func (p *awsProvider) Load(ctx context.Context) (map[string]string, error) {
+	opts := []func(*config.LoadOptions) error{config.WithEC2IMDSRegion()}
+	if p.region != "" {
+		opts = append(opts, config.WithRegion(p.region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
-		return "", terror.Errorf(ctx, "config LoadDefaultConfig: %w", err)
+		return nil, fmt.Errorf("config LoadDefaultConfig: %w", err)
 	}
 
 	svc := secretsmanager.NewFromConfig(cfg)
 
-	secretValue, err := getSecretValue(ctx, svc, "ayup-preauth-conf")
+	secretValue, err := getSecretValue(ctx, svc, p.secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	confMap, err := godotenv.Unmarshal(secretValue)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("godotenv Unmarshal: %w", err)
 	}
 
-	return secretValue, nil
+	return confMap, nil
 }
 
 // getSecretValue retrieves the value of the specified secret
@@ -33,12 +70,12 @@ func getSecretValue(ctx context.Context, svc *secretsmanager.Client, secretName
 
 	result, err := svc.GetSecretValue(ctx, input)
 	if err != nil {
-		return "", terror.Errorf(ctx, "svc GetSecretValue: %w", err)
+		return "", fmt.Errorf("svc GetSecretValue: %w", err)
 	}
 
 	if result.SecretString != nil {
 		return *result.SecretString, nil
 	}
 
-	return "", terror.Errorf(ctx, "secret %s does not contain a SecretString", secretName)
+	return "", fmt.Errorf("secret %s does not contain a SecretString", secretName)
 }
@@ -0,0 +1,261 @@
+package conf
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/huh"
+	"github.com/mattn/go-isatty"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// PassphraseEnv unlocks the key files without a prompt, for e.g. when the daemon runs as a service
+const PassphraseEnv = "AYUP_KEY_PASSPHRASE"
+
+// A keyFile holds a private key encrypted with XChaCha20-Poly1305, using a key derived from a
+// passphrase with Argon2id
+type keyFile struct {
+	Kdf     string `json:"kdf"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Sealed  []byte `json:"sealed"`
+}
+
+// The passphrase entered at the prompt, so that it is only asked for once
+var (
+	passphraseMutex sync.Mutex
+	passphrase      string
+)
+
+// keyFileEnv is the variable which can set a different key file for confName, for e.g.
+// AYUP_CLIENT_P2P_KEY_FILE for AYUP_CLIENT_P2P_PRIV_KEY
+func keyFileEnv(confName string) string {
+	return strings.TrimSuffix(confName, "_PRIV_KEY") + "_KEY_FILE"
+}
+
+// keyFilePath returns where the key set by confName is kept, for e.g. AYUP_CLIENT_P2P_PRIV_KEY
+// is kept in keys/client.key unless AYUP_CLIENT_P2P_KEY_FILE is set
+func keyFilePath(confName string) string {
+	if path := os.Getenv(keyFileEnv(confName)); path != "" {
+		return path
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(confName, "AYUP_"), "_P2P_PRIV_KEY")
+
+	return filepath.Join(UserConfigDir(), "keys", strings.ToLower(name)+".key")
+}
+
+// ProfileKeyFile returns where the client key used with the named profile is kept if it is
+// encrypted
+func ProfileKeyFile(name string) string {
+	return filepath.Join(UserConfigDir(), "keys", "contexts", name+".key")
+}
+
+// HasKeyFile is true if the key set by confName has been encrypted with 'ay key encrypt'
+func HasKeyFile(confName string) bool {
+	_, err := os.Stat(keyFilePath(confName))
+	return err == nil
+}
+
+// getPassphrase returns the passphrase from the environment, or asks for it if there is a
+// terminal. If confirm is set then it is asked for twice.
+func getPassphrase(ctx context.Context, title string, confirm bool) (string, error) {
+	passphraseMutex.Lock()
+	defer passphraseMutex.Unlock()
+
+	if p := knownPassphrase(); p != "" {
+		return p, nil
+	}
+
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return "", terror.Errorf(ctx, "The private key is encrypted, set %s to unlock it without a terminal", PassphraseEnv)
+	}
+
+	var p, again string
+	fields := []huh.Field{
+		huh.NewInput().Title(title).EchoMode(huh.EchoModePassword).Value(&p),
+	}
+	if confirm {
+		fields = append(fields, huh.NewInput().Title("Repeat the passphrase").EchoMode(huh.EchoModePassword).Value(&again))
+	}
+
+	if err := huh.NewForm(huh.NewGroup(fields...)).Run(); err != nil {
+		return "", terror.Errorf(ctx, "form Run: %w", err)
+	}
+
+	if p == "" {
+		return "", terror.Errorf(ctx, "The passphrase can't be empty")
+	}
+	if confirm && p != again {
+		return "", terror.Errorf(ctx, "The passphrases don't match")
+	}
+
+	passphrase = p
+
+	return p, nil
+}
+
+// knownPassphrase is the passphrase from the environment or the one entered at the prompt, if
+// any. The caller holds passphraseMutex.
+func knownPassphrase() string {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return p
+	}
+
+	return passphrase
+}
+
+func (k *keyFile) aead(pass string) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(pass), k.Salt, k.Time, k.Memory, k.Threads, chacha20poly1305.KeySize)
+
+	return chacha20poly1305.NewX(key)
+}
+
+// LoadKeyFile decrypts the key set by confName, asking for the passphrase if needed
+func LoadKeyFile(ctx context.Context, confName string) (string, error) {
+	path := keyFilePath(confName)
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return "", terror.Errorf(ctx, "os ReadFile: %w", err)
+	}
+
+	var k keyFile
+	if err := json.Unmarshal(bs, &k); err != nil {
+		return "", terror.Errorf(ctx, "json Unmarshal(%s): %w", path, err)
+	}
+
+	if k.Kdf != "argon2id" {
+		return "", terror.Errorf(ctx, "%s uses %s, which is not supported", path, k.Kdf)
+	}
+
+	pass, err := getPassphrase(ctx, fmt.Sprintf("Passphrase for %s", path), false)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := k.aead(pass)
+	if err != nil {
+		return "", terror.Errorf(ctx, "chacha20poly1305 NewX: %w", err)
+	}
+
+	plain, err := aead.Open(nil, k.Nonce, k.Sealed, []byte(confName))
+	if err != nil {
+		// A wrong passphrase shouldn't be reused
+		passphraseMutex.Lock()
+		passphrase = ""
+		passphraseMutex.Unlock()
+
+		return "", terror.Errorf(ctx, "The passphrase is wrong or %s is corrupted", path)
+	}
+
+	return string(plain), nil
+}
+
+// writeKeyFile encrypts the base64 key with the passphrase and replaces the key file at path
+func writeKeyFile(ctx context.Context, path string, confName string, b64PrivKey string, pass string) error {
+	k := keyFile{
+		Kdf:     "argon2id",
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		Salt:    make([]byte, 16),
+		Nonce:   make([]byte, chacha20poly1305.NonceSizeX),
+	}
+
+	if _, err := rand.Read(k.Salt); err != nil {
+		return terror.Errorf(ctx, "rand Read: %w", err)
+	}
+	if _, err := rand.Read(k.Nonce); err != nil {
+		return terror.Errorf(ctx, "rand Read: %w", err)
+	}
+
+	aead, err := k.aead(pass)
+	if err != nil {
+		return terror.Errorf(ctx, "chacha20poly1305 NewX: %w", err)
+	}
+
+	// The key is bound to its name, so the client and server key files can't be swapped
+	k.Sealed = aead.Seal(nil, k.Nonce, []byte(b64PrivKey), []byte(confName))
+
+	return writeJSON(ctx, path, k)
+}
+
+// EncryptKey moves the base64 key set by confName from the env file to a key file encrypted with
+// a new passphrase
+func EncryptKey(ctx context.Context, confName string, b64PrivKey string) (string, error) {
+	pass, err := getPassphrase(ctx, "Passphrase to encrypt the key with", true)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeKeyFile(ctx, keyFilePath(confName), confName, b64PrivKey, pass); err != nil {
+		return "", err
+	}
+
+	if err := Unset(ctx, confName); err != nil {
+		return "", err
+	}
+
+	return keyFilePath(confName), nil
+}
+
+// SaveKey replaces the key set by confName. It goes in the key file if the key is encrypted,
+// otherwise in the env file.
+func SaveKey(ctx context.Context, confName string, b64PrivKey string) error {
+	if !HasKeyFile(confName) {
+		return Set(ctx, confName, b64PrivKey)
+	}
+
+	pass, err := getPassphrase(ctx, fmt.Sprintf("Passphrase for %s", keyFilePath(confName)), false)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyFile(ctx, keyFilePath(confName), confName, b64PrivKey, pass)
+}
+
+// SaveKeyFile replaces the key in the key file set by confName without asking for the
+// passphrase, for e.g. when the daemon rotates its key. The passphrase has to be in the
+// environment or have been entered when the key was loaded.
+func SaveKeyFile(ctx context.Context, confName string, b64PrivKey string) error {
+	passphraseMutex.Lock()
+	pass := knownPassphrase()
+	passphraseMutex.Unlock()
+
+	if pass == "" {
+		return terror.Errorf(ctx, "The passphrase for %s is not known, set %s", keyFilePath(confName), PassphraseEnv)
+	}
+
+	return writeKeyFile(ctx, keyFilePath(confName), confName, b64PrivKey, pass)
+}
+
+// SaveProfileKey encrypts the client key used with the named profile and returns the file it
+// was saved in
+func SaveProfileKey(ctx context.Context, name string, b64PrivKey string) (string, error) {
+	path := ProfileKeyFile(name)
+
+	pass, err := getPassphrase(ctx, fmt.Sprintf("Passphrase to encrypt %s with", path), true)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeKeyFile(ctx, path, "AYUP_CLIENT_P2P_PRIV_KEY", b64PrivKey, pass); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
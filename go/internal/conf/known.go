@@ -0,0 +1,81 @@
+package conf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// A KnownServer is the identity a server had when the client first logged into it
+type KnownServer struct {
+	Peer  string    `json:"peer"`
+	Added time.Time `json:"added"`
+}
+
+// KnownServers maps a server's address, without its peer ID, to the identity the client expects
+type KnownServers map[string]KnownServer
+
+func knownServersPath() string {
+	return filepath.Join(UserConfigDir(), "known_servers.json")
+}
+
+func LoadKnownServers(ctx context.Context) (KnownServers, error) {
+	known := make(KnownServers)
+
+	bs, err := os.ReadFile(knownServersPath())
+	if os.IsNotExist(err) {
+		return known, nil
+	} else if err != nil {
+		return nil, terror.Errorf(ctx, "os ReadFile: %w", err)
+	}
+
+	if err := json.Unmarshal(bs, &known); err != nil {
+		return nil, terror.Errorf(ctx, "json Unmarshal(%s): %w", knownServersPath(), err)
+	}
+
+	return known, nil
+}
+
+func (k KnownServers) Save(ctx context.Context) error {
+	return writeJSON(ctx, knownServersPath(), k)
+}
+
+// Addrs returns the server addresses in order
+func (k KnownServers) Addrs() []string {
+	addrs := make([]string, 0, len(k))
+	for addr := range k {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// writeJSON replaces the file at path with v, so that it is not left half written
+func writeJSON(ctx context.Context, path string, v any) error {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return terror.Errorf(ctx, "json MarshalIndent: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp", path)
+	if err := os.WriteFile(tmp, bs, 0600); err != nil {
+		return terror.Errorf(ctx, "os WriteFile: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return terror.Errorf(ctx, "os Rename: %w", err)
+	}
+
+	return nil
+}
@@ -57,6 +57,12 @@ func InrootlessAddr() string {
 	return filepath.Join(UserRuntimeDir(), "rootless.sock")
 }
 
+// ControlSocket is where the daemon accepts local admin requests, for e.g. approving logins. It
+// has a directory of its own which only the daemon's user can access.
+func ControlSocket() string {
+	return filepath.Join(UserRuntimeDir(), "control", "control.sock")
+}
+
 func confFilePath(ctx context.Context) (string, error) {
 	confDir := UserConfigDir()
 
@@ -122,6 +128,21 @@ func Append(ctx context.Context, key string, val string) error {
 	return write(ctx, path, confMap)
 }
 
+// Get returns the value of key in the env file, ignoring the environment
+func Get(ctx context.Context, key string) (string, error) {
+	path, err := confFilePath(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	confMap, err := read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	return confMap[key], nil
+}
+
 func Set(ctx context.Context, key string, val string) error {
 	path, err := confFilePath(ctx)
 	if err != nil {
@@ -138,4 +159,25 @@ func Set(ctx context.Context, key string, val string) error {
 	return write(ctx, path, confMap)
 }
 
+// Unset removes key from the env file
+func Unset(ctx context.Context, key string) error {
+	path, err := confFilePath(ctx)
+	if err != nil {
+		return err
+	}
+
+	confMap, err := read(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := confMap[key]; !ok {
+		return nil
+	}
+
+	delete(confMap, key)
+
+	return write(ctx, path, confMap)
+}
+
 // Adapted from buildkit appdefaults
@@ -0,0 +1,212 @@
+package conf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"premai.io/Ayup/go/internal/fs"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// A Profile is a server the client can switch to with 'ay context use'
+type Profile struct {
+	// The server's multiaddr or host:port
+	Host string `json:"host"`
+	// The server's peer ID, which the connection has to be made to if it is set
+	Peer string `json:"peer,omitempty"`
+	// The client key to use with this server instead of AYUP_CLIENT_P2P_PRIV_KEY
+	P2pPrivKey string `json:"p2pPrivKey,omitempty"`
+	// The encrypted file holding the client key to use with this server, instead of P2pPrivKey
+	P2pKeyFile string `json:"p2pKeyFile,omitempty"`
+}
+
+// Target is the address to connect to, including the pinned peer ID
+func (p Profile) Target() string {
+	if p.Peer == "" || strings.Contains(p.Host, "/p2p/") {
+		return p.Host
+	}
+
+	return fmt.Sprintf("%s/p2p/%s", p.Host, p.Peer)
+}
+
+// Env is the environment the client commands take the profile's settings from
+func (p Profile) Env() map[string]string {
+	env := map[string]string{
+		"AYUP_PUSH_HOST": p.Target(),
+	}
+
+	if p.P2pKeyFile != "" {
+		// Set but empty, so the key isn't taken from the env file instead of the key file
+		env["AYUP_CLIENT_P2P_PRIV_KEY"] = ""
+		env[keyFileEnv("AYUP_CLIENT_P2P_PRIV_KEY")] = p.P2pKeyFile
+	} else if p.P2pPrivKey != "" {
+		env["AYUP_CLIENT_P2P_PRIV_KEY"] = p.P2pPrivKey
+	}
+
+	return env
+}
+
+type Profiles struct {
+	Current  string             `json:"current,omitempty"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// Names returns the profile names in order
+func (p *Profiles) Names() []string {
+	names := make([]string, 0, len(p.Profiles))
+	for name := range p.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Find returns the name of the profile for the host or an empty string
+func (p *Profiles) Find(host string) string {
+	for _, name := range p.Names() {
+		if p.Profiles[name].Target() == host {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func profilesPath() string {
+	return filepath.Join(UserConfigDir(), "contexts.json")
+}
+
+// projectProfilePath is the file in the project's state directory which overrides the current
+// profile
+func projectProfilePath(dir string) string {
+	return filepath.Join(dir, ".ayup", "context")
+}
+
+// readProfiles is used before logging is setup, so it doesn't use terror
+func readProfiles() (*Profiles, error) {
+	p := &Profiles{Profiles: make(map[string]Profile)}
+
+	bs, err := os.ReadFile(profilesPath())
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("os ReadFile: %w", err)
+	}
+
+	if err := json.Unmarshal(bs, p); err != nil {
+		return nil, fmt.Errorf("json Unmarshal(%s): %w", profilesPath(), err)
+	}
+
+	if p.Profiles == nil {
+		p.Profiles = make(map[string]Profile)
+	}
+
+	return p, nil
+}
+
+func LoadProfiles(ctx context.Context) (*Profiles, error) {
+	p, err := readProfiles()
+	if err != nil {
+		return nil, terror.Errorf(ctx, "readProfiles: %w", err)
+	}
+
+	return p, nil
+}
+
+func (p *Profiles) Save(ctx context.Context) error {
+	return writeJSON(ctx, profilesPath(), p)
+}
+
+func readProjectProfile(dir string) (string, error) {
+	bs, err := os.ReadFile(projectProfilePath(dir))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("os ReadFile: %w", err)
+	}
+
+	return strings.TrimSpace(string(bs)), nil
+}
+
+// ProjectProfile returns the profile the project in dir uses or an empty string if it uses the
+// current one
+func ProjectProfile(ctx context.Context, dir string) (string, error) {
+	name, err := readProjectProfile(dir)
+	if err != nil {
+		return "", terror.Errorf(ctx, "readProjectProfile: %w", err)
+	}
+
+	return name, nil
+}
+
+// SetProjectProfile makes the project in dir use the named profile, an empty name removes the
+// override
+func SetProjectProfile(ctx context.Context, dir string, name string) error {
+	path := projectProfilePath(dir)
+
+	if name == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return terror.Errorf(ctx, "os Remove: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := fs.MkdirAll(ctx, filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	return fs.WriteFile(ctx, []byte(name+"\n"), path)
+}
+
+// Active returns the name of the profile used in the project dir, which is the project's
+// override or the current profile. The name is empty if there is no profile.
+func (p *Profiles) Active(dir string) (string, error) {
+	name, err := readProjectProfile(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if name == "" {
+		name = p.Current
+	}
+
+	if _, ok := p.Profiles[name]; name != "" && !ok {
+		return "", fmt.Errorf("the context %s doesn't exist, see 'ay context list'", name)
+	}
+
+	return name, nil
+}
+
+// ApplyProfile sets the environment from the profile active in dir. Variables which are already
+// set are left alone, so the environment takes precedence over the profile. This needs to be
+// called before the env file is loaded for the profile to take precedence over it.
+func ApplyProfile(dir string) (string, error) {
+	profiles, err := readProfiles()
+	if err != nil {
+		return "", err
+	}
+
+	name, err := profiles.Active(dir)
+	if err != nil || name == "" {
+		return "", err
+	}
+
+	for key, val := range profiles.Profiles[name].Env() {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+
+		if err := os.Setenv(key, val); err != nil {
+			return "", fmt.Errorf("os Setenv: %w", err)
+		}
+	}
+
+	return name, nil
+}
@@ -0,0 +1,196 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/joho/godotenv"
+
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// A Provider loads config from somewhere, such as a file or secrets store, as environment
+// variables. Sources are given as URIs, the scheme selects the provider.
+type Provider interface {
+	Load(ctx context.Context) (map[string]string, error)
+}
+
+// NewProviderFunc creates a provider from a source URI with its scheme
+type NewProviderFunc func(source *url.URL) (Provider, error)
+
+var providers = map[string]NewProviderFunc{
+	"file": newFileProvider,
+	"env":  newEnvProvider,
+	"exec": newExecProvider,
+}
+
+// RegisterProvider adds a provider for sources with the scheme
+func RegisterProvider(scheme string, f NewProviderFunc) {
+	providers[scheme] = f
+}
+
+// NewProvider creates the provider for the source URI, for e.g. file:///etc/ayup/env
+func NewProvider(source string) (Provider, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("url Parse: %w", err)
+	}
+
+	f, ok := providers[u.Scheme]
+	if !ok {
+		var schemes []string
+		for scheme := range providers {
+			schemes = append(schemes, scheme)
+		}
+		sort.Strings(schemes)
+
+		return nil, fmt.Errorf("unknown config source %q, the scheme should be one of: %s", source, strings.Join(schemes, ", "))
+	}
+
+	return f(u)
+}
+
+// LoadSources loads and merges the config from each source. Sources later in the list take
+// precedence over the earlier ones.
+func LoadSources(ctx context.Context, sources []string) (map[string]string, error) {
+	merged := make(map[string]string)
+
+	for _, source := range sources {
+		p, err := NewProvider(source)
+		if err != nil {
+			return nil, terror.Errorf(ctx, "NewProvider: %w", err)
+		}
+
+		config, err := p.Load(ctx)
+		if err != nil {
+			return nil, terror.Errorf(ctx, "%s: %w", source, err)
+		}
+
+		trace.Event(ctx, "loaded config source")
+
+		for key, val := range config {
+			merged[key] = val
+		}
+	}
+
+	return merged, nil
+}
+
+// Resolver sets the flags from the config by their environment variable names. Kong uses it for
+// flags which weren't set on the command line, so the config takes precedence over the
+// environment.
+func Resolver(config map[string]string) kong.Resolver {
+	return kong.ResolverFunc(func(_ *kong.Context, _ *kong.Path, flag *kong.Flag) (any, error) {
+		for _, env := range flag.Tag.Envs {
+			if val, ok := config[env]; ok {
+				return val, nil
+			}
+		}
+
+		return nil, nil
+	})
+}
+
+// sourcePath is the path in file:///etc/ayup/env or a relative one in file:env
+func sourcePath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+
+	return u.Path
+}
+
+// fileProvider reads a file in the same dotenv format as the env file
+type fileProvider struct {
+	path string
+}
+
+func newFileProvider(u *url.URL) (Provider, error) {
+	path := sourcePath(u)
+	if path == "" {
+		return nil, fmt.Errorf("the file source has no path, e.g. file:///etc/ayup/env")
+	}
+
+	return &fileProvider{path: path}, nil
+}
+
+func (p *fileProvider) Load(ctx context.Context) (map[string]string, error) {
+	config, err := godotenv.Read(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("godotenv Read: %w", err)
+	}
+
+	return config, nil
+}
+
+// envProvider takes the config from the environment. Without a prefix it is the AYUP_ variables,
+// which is useful to put the environment after other sources. With env://?prefix=PROD_ it is
+// variables like PROD_AYUP_QUOTA_APPS, with the prefix removed.
+type envProvider struct {
+	prefix string
+}
+
+func newEnvProvider(u *url.URL) (Provider, error) {
+	return &envProvider{prefix: u.Query().Get("prefix")}, nil
+}
+
+func (p *envProvider) Load(ctx context.Context) (map[string]string, error) {
+	config := make(map[string]string)
+
+	for _, kv := range os.Environ() {
+		key, val, _ := strings.Cut(kv, "=")
+
+		if p.prefix == "" {
+			if strings.HasPrefix(key, "AYUP_") {
+				config[key] = val
+			}
+		} else if name, ok := strings.CutPrefix(key, p.prefix); ok && name != "" {
+			config[name] = val
+		}
+	}
+
+	return config, nil
+}
+
+// execProvider runs a command which prints the config in the dotenv format, for e.g.
+// exec:///usr/local/bin/ayup-conf?arg=--prod
+type execProvider struct {
+	path string
+	args []string
+}
+
+func newExecProvider(u *url.URL) (Provider, error) {
+	path := sourcePath(u)
+	if path == "" {
+		return nil, fmt.Errorf("the exec source has no command, e.g. exec:///usr/local/bin/ayup-conf")
+	}
+
+	return &execProvider{path: path, args: u.Query()["arg"]}, nil
+}
+
+func (p *execProvider) Load(ctx context.Context) (map[string]string, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, p.path, p.args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("exec %s: %w: %s", p.path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	config, err := godotenv.Unmarshal(string(out))
+	if err != nil {
+		return nil, fmt.Errorf("godotenv Unmarshal: %w", err)
+	}
+
+	return config, nil
+}
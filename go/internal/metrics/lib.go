@@ -0,0 +1,137 @@
+// Package metrics holds the daemon's Prometheus collectors and serves them over HTTP. The
+// collectors are always updated, but they are only exposed when a metrics address is configured.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"premai.io/Ayup/go/internal/terror"
+)
+
+const namespace = "ayup"
+
+var (
+	Pushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pushes_total",
+		Help:      "Pushes (assist sessions) that finished, by result: ok, error, cancelled or shutdown",
+	}, []string{"result"})
+
+	UploadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Uncompressed bytes of source received from clients",
+	})
+
+	AssistantDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "assistant_duration_seconds",
+		Help:      "How long each assistant took to build, by assistant and result",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"assistant", "result"})
+
+	ExecExits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exec_exits_total",
+		Help:      "Apps that exited, by exit code",
+	}, []string{"code"})
+
+	ActiveForwards = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "forwards_active",
+		Help:      "Port forwarding streams that are open",
+	})
+
+	ForwardBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "forward_bytes_total",
+		Help:      "Bytes forwarded to and from apps, by app port and direction: in (to the app) or out",
+	}, []string{"port", "direction"})
+
+	LoginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_attempts_total",
+		Help:      "Client logins, by result: authorized, approved, invited, rejected, bad_invite, limited, expired, cancelled or error",
+	}, []string{"result"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Pushes,
+		UploadBytes,
+		AssistantDuration,
+		ExecExits,
+		ActiveForwards,
+		ForwardBytes,
+		LoginAttempts,
+	)
+}
+
+// Result is the label used for an outcome that either succeeded or failed
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "ok"
+}
+
+// ObserveDuration records how long an assistant took since start
+func ObserveDuration(assistant string, start time.Time, err error) {
+	AssistantDuration.WithLabelValues(assistant, Result(err)).Observe(time.Since(start).Seconds())
+}
+
+// AddForwarded counts n bytes forwarded to (in) or from (out) an app's port
+func AddForwarded(port uint32, direction string, n int) {
+	ForwardBytes.WithLabelValues(strconv.FormatUint(uint64(port), 10), direction).Add(float64(n))
+}
+
+// Server serves the collectors on /metrics at addr
+type Server struct {
+	http *http.Server
+}
+
+func NewServer(addr string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	return &Server{
+		http: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Listen blocks until the server is shutdown or fails
+func (s *Server) Listen(ctx context.Context) error {
+	if err := s.http.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return terror.Errorf(ctx, "http ListenAndServe: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := s.http.Shutdown(ctx); err != nil {
+		return terror.Errorf(ctx, "http Shutdown: %w", err)
+	}
+
+	return nil
+}
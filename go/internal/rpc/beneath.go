@@ -0,0 +1,145 @@
+package rpc
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The most symlinks followed while resolving one path, the same as Linux's limit
+const maxSymlinks = 40
+
+// resolveBeneath follows the symlinks in path, which is relative to root, and fails if it leaves
+// root at any point. Components which don't exist yet are taken as they are. This is like
+// openat2 with RESOLVE_BENEATH, but it works on every OS the client runs on.
+func resolveBeneath(root string, path string) error {
+	pending := strings.Split(filepath.ToSlash(path), "/")
+	var resolved []string
+	links := 0
+
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) < 1 {
+				return fmt.Errorf("%s leaves the directory", path)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		cur := filepath.Join(root, filepath.Join(resolved...), name)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			resolved = append(resolved, name)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, name)
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return fmt.Errorf("%s has too many levels of symlinks", path)
+		}
+
+		target, err := os.Readlink(cur)
+		if err != nil {
+			return err
+		}
+
+		if target == "" || filepath.IsAbs(target) {
+			return fmt.Errorf("%s goes through a symlink to %s", path, target)
+		}
+
+		// The target replaces the symlink, relative to the directory it is in
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+
+	return nil
+}
+
+// targetIsLocal checks a symlink's target without looking at the disk. The target may start with
+// ".." as long as it doesn't climb above root from the symlink's directory, after that it may only
+// descend. A ".." after a name is rejected because the name can be replaced by a symlink after
+// the target was checked. E.g. d/x/../.. is root while d/x is a directory or missing, but it is
+// above root once d/x -> .. is received.
+func targetIsLocal(path string, target string) bool {
+	if target == "" || filepath.IsAbs(target) {
+		return false
+	}
+
+	depth := 0
+	for _, name := range strings.Split(filepath.ToSlash(filepath.Dir(path)), "/") {
+		if name != "." && name != "" {
+			depth++
+		}
+	}
+
+	descending := false
+	for _, name := range strings.Split(filepath.ToSlash(target), "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			if descending || depth < 1 {
+				return false
+			}
+			depth--
+		default:
+			descending = true
+		}
+	}
+
+	return true
+}
+
+// SymlinkIsLocal checks that a symlink at path, which is relative to root, points to something
+// inside root. The target must stay inside root whatever is received after it, see targetIsLocal,
+// and symlinks already in root are followed, so a chain of them can't escape.
+func SymlinkIsLocal(root string, path string, target string) bool {
+	if !targetIsLocal(path, target) {
+		return false
+	}
+
+	return resolveBeneath(root, filepath.Dir(path)+"/"+target) == nil
+}
+
+// CheckBeneath fails if path is not local to root or one of its parent directories is a symlink.
+// Then writing or removing path can't follow a symlink out of root. Path itself may be a symlink,
+// callers replace it rather than follow it.
+func CheckBeneath(root string, path string) error {
+	if !filepath.IsLocal(path) {
+		return fmt.Errorf("file path is not local: %s", path)
+	}
+
+	dir := root
+	parts := strings.Split(filepath.ToSlash(filepath.Dir(path)), "/")
+	for _, name := range parts {
+		if name == "." {
+			continue
+		}
+
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s is inside a symlink", path)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package rpc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A file received in order, a symlink if target is set otherwise a directory
+type beneathStep struct {
+	path   string
+	target string
+	ok     bool
+}
+
+func TestSymlinkIsLocal(t *testing.T) {
+	cases := []struct {
+		name  string
+		steps []beneathStep
+	}{
+		{"sibling", []beneathStep{{"s", "a", true}}},
+		{"dot", []beneathStep{{"s", ".", true}}},
+		{"subdir", []beneathStep{{"d/s", "../a/b", true}}},
+		{"up to root", []beneathStep{{"d/s", "..", true}}},
+		{"empty", []beneathStep{{"s", "", false}}},
+		{"absolute", []beneathStep{{"s", "/etc/passwd", false}}},
+		{"parent", []beneathStep{{"s", "..", false}}},
+		{"above root", []beneathStep{{"d/s", "../..", false}}},
+		{"name then parent", []beneathStep{{"s", "a/..", false}}},
+		{"missing then parents", []beneathStep{{"s", "d/x/../..", false}}},
+		{"existing then parents", []beneathStep{
+			{"d/x", "", true},
+			{"s", "d/x/../..", false},
+		}},
+		{"retarget earlier link", []beneathStep{
+			{"s", "d/x/../..", false},
+			{"d/x", "..", true},
+		}},
+		{"through link", []beneathStep{
+			{"d/e/x", "", true},
+			{"l", "d/e", true},
+			{"s", "l/x", true},
+		}},
+		{"through link above root", []beneathStep{
+			{"d/up", "..", true},
+			{"s", "d/up/..", false},
+			{"t", "d/up/d/up", true},
+		}},
+		{"replace dir with link", []beneathStep{
+			{"d/x/y", "", true},
+			{"d/s", "x/y", true},
+			{"d/x", "..", true},
+			{"t", "d/s", true},
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := t.TempDir()
+			var links []string
+
+			for _, step := range c.steps {
+				dst := filepath.Join(root, step.path)
+
+				if step.target == "" && step.ok {
+					if err := os.MkdirAll(dst, 0700); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+
+				if err := CheckBeneath(root, step.path); err != nil {
+					t.Fatalf("%s: %v", step.path, err)
+				}
+
+				if ok := SymlinkIsLocal(root, step.path, step.target); ok != step.ok {
+					t.Fatalf("SymlinkIsLocal(%s -> %s) = %v, want %v", step.path, step.target, ok, step.ok)
+				} else if !ok {
+					continue
+				}
+
+				if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.RemoveAll(dst); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(step.target, dst); err != nil {
+					t.Fatal(err)
+				}
+				links = append(links, step.path)
+			}
+
+			// Whatever order they were received in, every accepted link must resolve inside root
+			realRoot, err := filepath.EvalSymlinks(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, link := range links {
+				resolved, err := filepath.EvalSymlinks(filepath.Join(root, link))
+				if os.IsNotExist(err) {
+					continue
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				if resolved != realRoot && !strings.HasPrefix(resolved, realRoot+string(filepath.Separator)) {
+					t.Errorf("%s resolves outside of the root: %s", link, resolved)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckBeneath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d", filepath.Join(root, "l")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path string
+		ok   bool
+	}{
+		{"a", true},
+		{"d/a", true},
+		{"missing/a", true},
+		{"l", true},
+		{"l/a", false},
+		{"../a", false},
+		{"/a", false},
+	}
+
+	for _, c := range cases {
+		if err := CheckBeneath(root, c.path); (err == nil) != c.ok {
+			t.Errorf("CheckBeneath(%s) = %v, want ok=%v", c.path, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package rpc
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// The compression we can receive, in order of preference
+var AcceptCompression = []pb.Compression{pb.Compression_zstd}
+
+// If compressing a chunk doesn't reduce it to this fraction of its size, then the rest of the
+// file is sent raw. It is probably already compressed.
+const compressRatioLimit = 0.9
+
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+})
+
+// The most a compressed chunk may decompress to. Chunks are much smaller than this, the limit
+// stops a small frame from expanding to fill the receiver's memory.
+const maxDecompressedSize = 1024 * 1024
+
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+})
+
+// NegotiateCompression picks the compression to send with from what the other side accepts
+func NegotiateCompression(accept []pb.Compression) pb.Compression {
+	for _, c := range AcceptCompression {
+		if slices.Contains(accept, c) {
+			return c
+		}
+	}
+
+	return pb.Compression_none
+}
+
+// compress returns the compressed data or ok=false if it is not worth it
+func compress(ctx context.Context, compression pb.Compression, data []byte) (out []byte, ok bool, err error) {
+	switch compression {
+	case pb.Compression_none:
+		return data, false, nil
+	case pb.Compression_zstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, false, terror.Errorf(ctx, "zstd NewWriter: %w", err)
+		}
+
+		out = enc.EncodeAll(data, nil)
+		if float64(len(out)) > float64(len(data))*compressRatioLimit {
+			return data, false, nil
+		}
+
+		return out, true, nil
+	default:
+		return nil, false, terror.Errorf(ctx, "unrecognized compression: %d", compression)
+	}
+}
+
+func decompress(ctx context.Context, compression pb.Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case pb.Compression_none:
+		return data, nil
+	case pb.Compression_zstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, terror.Errorf(ctx, "zstd NewReader: %w", err)
+		}
+
+		out, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, terror.Errorf(ctx, "zstd DecodeAll: %w", err)
+		}
+
+		return out, nil
+	default:
+		return nil, terror.Errorf(ctx, "unrecognized compression: %d", compression)
+	}
+}
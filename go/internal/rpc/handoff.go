@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A Handoff says that the peer with the Old ID is now the peer with the New ID. It is signed by
+// both keys, so that it can only be made by whoever has the old key and the new one.
+type Handoff struct {
+	Old peer.ID `json:"old"`
+	New peer.ID `json:"new"`
+	// The server a client's handoff is for, so that it can't be replayed to another server. Empty
+	// for a server's handoff.
+	For  peer.ID `json:"for,omitempty"`
+	Time int64   `json:"time"`
+
+	OldSig []byte `json:"oldSig"`
+	NewSig []byte `json:"newSig"`
+}
+
+func (h *Handoff) message() []byte {
+	return []byte(fmt.Sprintf("ayup key handoff\n%s\n%s\n%s\n%d", h.Old, h.New, h.For, h.Time))
+}
+
+// NewHandoff signs a handoff from oldKey to newKey and encodes it
+func NewHandoff(oldKey crypto.PrivKey, newKey crypto.PrivKey, forServer peer.ID) (string, error) {
+	h := Handoff{For: forServer, Time: time.Now().Unix()}
+
+	var err error
+	if h.Old, err = peer.IDFromPrivateKey(oldKey); err != nil {
+		return "", fmt.Errorf("peer IDFromPrivateKey: %w", err)
+	}
+	if h.New, err = peer.IDFromPrivateKey(newKey); err != nil {
+		return "", fmt.Errorf("peer IDFromPrivateKey: %w", err)
+	}
+
+	if h.OldSig, err = oldKey.Sign(h.message()); err != nil {
+		return "", fmt.Errorf("oldKey Sign: %w", err)
+	}
+	if h.NewSig, err = newKey.Sign(h.message()); err != nil {
+		return "", fmt.Errorf("newKey Sign: %w", err)
+	}
+
+	bs, err := json.Marshal(h)
+	if err != nil {
+		return "", fmt.Errorf("json Marshal: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+func verify(id peer.ID, msg []byte, sig []byte) error {
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("peer ExtractPublicKey: %w", err)
+	}
+
+	ok, err := pub.Verify(msg, sig)
+	if err != nil {
+		return fmt.Errorf("pub Verify: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("the signature for %s is not valid", id)
+	}
+
+	return nil
+}
+
+// ParseHandoff decodes a handoff and checks it was signed by both keys
+func ParseHandoff(text string) (*Handoff, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("malformed handoff: base64 DecodeString: %w", err)
+	}
+
+	var h Handoff
+	if err := json.Unmarshal(bs, &h); err != nil {
+		return nil, fmt.Errorf("malformed handoff: json Unmarshal: %w", err)
+	}
+
+	if h.Old == h.New {
+		return nil, fmt.Errorf("the handoff's old and new peer IDs are the same")
+	}
+
+	if err := verify(h.Old, h.message(), h.OldSig); err != nil {
+		return nil, err
+	}
+	if err := verify(h.New, h.message(), h.NewSig); err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+// GenerateKey makes a new private key and returns it base64 encoded, like 'ay key new' prints
+func GenerateKey() (crypto.PrivKey, string, error) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("crypto GenerateEd25519Key: %w", err)
+	}
+
+	pbPrivKey, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, "", fmt.Errorf("crypto MarshalPrivateKey: %w", err)
+	}
+
+	return priv, base64.StdEncoding.EncodeToString(pbPrivKey), nil
+}
@@ -0,0 +1,246 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	attr "go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+const (
+	// Always read, it can be put in any directory like .gitignore
+	AyupIgnore = ".ayupignore"
+	GitIgnore  = ".gitignore"
+	// Only read in the root directory and all of its patterns are relative to the root
+	DockerIgnore = ".dockerignore"
+)
+
+type ignoreRule struct {
+	// The directory containing the ignore file, relative to the root
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// Match against the whole path relative to base instead of any name in it
+	anchored bool
+}
+
+// Ignore matches paths against the patterns in ignore files using the same rules as Git. The
+// ignore files are read from each directory the first time a path in it is matched.
+type Ignore struct {
+	root  string
+	names []string
+
+	mutex sync.Mutex
+	rules map[string][]ignoreRule
+}
+
+// NewIgnore creates an ignore matcher for the directory root which reads the ignore files with
+// the given names. If names is empty then nothing is ignored.
+func NewIgnore(root string, names []string) *Ignore {
+	return &Ignore{
+		root:  root,
+		names: names,
+		rules: make(map[string][]ignoreRule),
+	}
+}
+
+func parseIgnoreLine(base string, line string, anchored bool) (ignoreRule, bool) {
+	// Trailing spaces are removed unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base, anchored: anchored}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// A slash anywhere but the end anchors the pattern to the ignore file's directory
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+	}
+	line = strings.TrimPrefix(line, "/")
+
+	if anchored {
+		line = strings.TrimPrefix(path.Clean(line), "/")
+	}
+
+	if line == "" || line == "." {
+		return ignoreRule{}, false
+	}
+
+	rule.segments = strings.Split(line, "/")
+	for _, seg := range rule.segments {
+		if _, err := path.Match(seg, ""); err != nil {
+			return ignoreRule{}, false
+		}
+	}
+
+	return rule, true
+}
+
+// loadRules reads the ignore files in dir, which is relative to the root
+func (s *Ignore) loadRules(ctx context.Context, dir string) ([]ignoreRule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if rules, ok := s.rules[dir]; ok {
+		return rules, nil
+	}
+
+	var rules []ignoreRule
+	for _, name := range s.names {
+		anchored := name == DockerIgnore
+		if anchored && dir != "." {
+			continue
+		}
+
+		bs, err := os.ReadFile(filepath.Join(s.root, filepath.FromSlash(dir), name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, terror.Errorf(ctx, "os ReadFile: %w", err)
+		}
+
+		trace.Event(ctx, "read ignore file", attr.String("dir", dir), attr.String("name", name))
+
+		base := dir
+		if base == "." {
+			base = ""
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(bs))
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreLine(base, scanner.Text(), anchored); ok {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	s.rules[dir] = rules
+
+	return rules, nil
+}
+
+// matchSegments matches path segments against pattern segments where ** matches any number of
+// segments
+func matchSegments(pattern []string, names []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(names); i >= 0; i-- {
+				if matchSegments(pattern[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(names) < 1 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], names[0]); !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		names = names[1:]
+	}
+
+	return len(names) < 1
+}
+
+func (s *ignoreRule) match(p string, isDir bool) bool {
+	if s.dirOnly && !isDir {
+		return false
+	}
+
+	if s.base != "" {
+		if !strings.HasPrefix(p, s.base+"/") {
+			return false
+		}
+		p = p[len(s.base)+1:]
+	}
+
+	names := strings.Split(p, "/")
+	if !s.anchored {
+		names = names[len(names)-1:]
+	}
+
+	return matchSegments(s.segments, names)
+}
+
+// matchOne checks a path without considering if its parents are ignored
+func (s *Ignore) matchOne(ctx context.Context, p string, isDir bool) (bool, error) {
+	ignored := false
+
+	// Rules in deeper directories take precedence
+	var dirs []string
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, ".")
+	slices.Reverse(dirs)
+
+	for _, dir := range dirs {
+		rules, err := s.loadRules(ctx, dir)
+		if err != nil {
+			return false, err
+		}
+
+		for _, rule := range rules {
+			if rule.match(p, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored, nil
+}
+
+// Match reports if path, which is relative to the root, is ignored. A path is also ignored if
+// any of its parent directories are.
+func (s *Ignore) Match(ctx context.Context, p string, isDir bool) (bool, error) {
+	if len(s.names) < 1 {
+		return false, nil
+	}
+
+	p = filepath.ToSlash(filepath.Clean(p))
+	if p == "." {
+		return false, nil
+	}
+
+	names := strings.Split(p, "/")
+	for i := range names {
+		ignored, err := s.matchOne(ctx, strings.Join(names[:i+1], "/"), isDir || i < len(names)-1)
+		if err != nil || ignored {
+			return ignored, err
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,40 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var inviteEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewInvite creates an invite code for the server with the peer ID. The code contains the peer
+// ID so that the client can check it is giving the code to the right server.
+func NewInvite(server peer.ID) (code string, secret string, err error) {
+	bs := make([]byte, 20)
+	if _, err := rand.Read(bs); err != nil {
+		return "", "", fmt.Errorf("rand Read: %w", err)
+	}
+
+	secret = strings.ToLower(inviteEncoding.EncodeToString(bs))
+
+	return fmt.Sprintf("%s.%s", server.String(), secret), secret, nil
+}
+
+// ParseInvite splits an invite code into the server's peer ID and the secret
+func ParseInvite(code string) (server peer.ID, secret string, err error) {
+	idStr, secret, ok := strings.Cut(strings.TrimSpace(code), ".")
+	if !ok || secret == "" {
+		return "", "", fmt.Errorf("malformed invite code")
+	}
+
+	server, err = peer.Decode(idStr)
+	if err != nil {
+		return "", "", fmt.Errorf("malformed invite code: peer Decode: %w", err)
+	}
+
+	return server, secret, nil
+}
@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+
+	"premai.io/Ayup/go/internal/conf"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// ServerAddr is the address a server is known by, which is its multiaddr without the peer ID
+func ServerAddr(info *peer.AddrInfo) string {
+	if len(info.Addrs) < 1 {
+		return ""
+	}
+
+	return info.Addrs[0].String()
+}
+
+// checkKnownServer fails if the client logged into a server at the same address which had a
+// different peer ID. Either the address or the server's key changed, or someone is pretending to
+// be the server.
+func checkKnownServer(ctx context.Context, info *peer.AddrInfo) error {
+	addr := ServerAddr(info)
+	if addr == "" {
+		return nil
+	}
+
+	known, err := conf.LoadKnownServers(ctx)
+	if err != nil {
+		return err
+	}
+
+	server, ok := known[addr]
+	if !ok || server.Peer == info.ID.String() {
+		return nil
+	}
+
+	return terror.Errorf(ctx,
+		"The server at %s should have the peer ID %s, but %s was given. "+
+			"Either the address is wrong, the server's key changed or someone is impersonating it. "+
+			"If you are sure the new peer ID is right, run 'ay servers forget %s' and login again",
+		addr, server.Peer, info.ID, addr,
+	)
+}
+
+// TrustServer records the server's peer ID the first time the client logs into it, so that later
+// connections to a different peer at the same address fail
+func TrustServer(ctx context.Context, target string) error {
+	maddr, err := multiaddr.NewMultiaddr(target)
+	if err != nil {
+		return nil
+	}
+
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return terror.Errorf(ctx, "peer AddrInfoFromP2pAddr: %w", err)
+	}
+
+	addr := ServerAddr(info)
+	if addr == "" {
+		return nil
+	}
+
+	known, err := conf.LoadKnownServers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := known[addr]; ok {
+		return nil
+	}
+
+	known[addr] = conf.KnownServer{Peer: info.ID.String(), Added: time.Now()}
+
+	return known.Save(ctx)
+}
+
+var warnedInsecure sync.Map
+
+// warnInsecure tells the user when a remote server is connected to without libp2p, once for each
+// target
+func warnInsecure(target string) {
+	if strings.HasPrefix(target, "unix:") {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+
+	if host == "localhost" {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return
+	}
+
+	if _, warned := warnedInsecure.LoadOrStore(target, true); warned {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, tui.ErrorStyle.Render("Warning!"),
+		fmt.Sprintf("Connecting to %s without encryption or checking the server's identity, use the libp2p multiaddr printed by the server instead", target))
+}
@@ -30,7 +30,15 @@ import (
 
 const Libp2pProtocol = protocol.ID("/ayup/grpc/1.0.0")
 
+// EnsurePrivKey decodes the base64 key. If it is empty then the key is read from its encrypted key
+// file, or if there is none, a new key is created and saved in the env file.
 func EnsurePrivKey(ctx context.Context, confName string, b64PrivKey string) (privKey crypto.PrivKey, err error) {
+	if b64PrivKey == "" && conf.HasKeyFile(confName) {
+		if b64PrivKey, err = conf.LoadKeyFile(ctx, confName); err != nil {
+			return nil, err
+		}
+	}
+
 	if b64PrivKey == "" {
 		ptrace.Event(ctx, "creating private key")
 
@@ -100,6 +108,7 @@ func ClientWithKey(ctx context.Context, target string, priv crypto.PrivKey) (pb.
 	maddr, err := multiaddr.NewMultiaddr(target)
 	if err != nil {
 		terror.Ackf(ctx, "new multiaddr: %w", err)
+		warnInsecure(target)
 
 		conn, err := grpc.NewClient(target,
 			grpc.WithStatsHandler(
@@ -122,6 +131,10 @@ func ClientWithKey(ctx context.Context, target string, priv crypto.PrivKey) (pb.
 		return nil, terror.Errorf(ctx, "peer addrinfofromp2padd: %w", err)
 	}
 
+	if err := checkKnownServer(ctx, peerInfo); err != nil {
+		return nil, err
+	}
+
 	host, err := libp2p.New(
 		libp2p.Identity(priv),
 		libp2p.Transport(tcp.NewTCPTransport),
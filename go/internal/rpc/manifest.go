@@ -0,0 +1,178 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	attr "go.opentelemetry.io/otel/attribute"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// HashFile returns the SHA-256 of a file's contents
+func HashFile(ctx context.Context, path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "os Open: %w", err)
+	}
+	defer func() { terror.Ackf(ctx, "f Close: %w", f.Close()) }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, terror.Errorf(ctx, "io Copy: %w", err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// BuildManifest lists the files, directories and symlinks in dirPath which SendDir would send,
+// along with the hashes of the files. The ignore files should be the same as the sender's. The
+// paths which are skipped are reported to logChan if it is not nil.
+func BuildManifest(ctx context.Context, source pb.Source, dirPath string, ignoreFiles []string, logChan chan string) ([]*pb.ManifestEntry, error) {
+	return buildManifest(ctx, source, dirPath, ignoreFiles, logChan, nil)
+}
+
+// BuildManifestPaths is like BuildManifest, but it only lists what SendPaths would send for the
+// given paths. Paths which don't exist are left out.
+func BuildManifestPaths(ctx context.Context, source pb.Source, dirPath string, ignoreFiles []string, paths []string) ([]*pb.ManifestEntry, error) {
+	if paths == nil {
+		paths = []string{}
+	}
+
+	return buildManifest(ctx, source, dirPath, ignoreFiles, nil, paths)
+}
+
+func buildManifest(ctx context.Context, source pb.Source, dirPath string, ignoreFiles []string, logChan chan string, paths []string) ([]*pb.ManifestEntry, error) {
+	ctx, span := trace.Span(ctx, "build manifest", attr.String("path", dirPath), attr.Bool("partial", paths != nil))
+	defer span.End()
+
+	var entries []*pb.ManifestEntry
+	ignore := NewIgnore(dirPath, ignoreFiles)
+
+	skipNotice := func(kind string, path string) {
+		if logChan != nil {
+			logChan <- fmt.Sprintf("Skip %s: %s: %s", source, kind, path)
+		}
+	}
+
+	visit := func(path string, d fs.DirEntry) error {
+		if isHidden(d.Name()) {
+			skipNotice("hidden", path)
+
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if ignored, err := ignore.Match(ctx, path, d.IsDir()); err != nil {
+			return err
+		} else if ignored {
+			skipNotice("ignored", path)
+
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		typ, ok := fileType(d)
+		if !ok {
+			skipNotice("special file", path)
+
+			return nil
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return terror.Errorf(ctx, "dir info: %w", err)
+		}
+
+		entry := &pb.ManifestEntry{
+			Path:   path,
+			Source: source,
+			Mode:   uint32(info.Mode().Perm()),
+			Type:   typ,
+		}
+
+		switch typ {
+		case pb.FileType_regular:
+			entry.Size = info.Size()
+			if entry.Hash, err = HashFile(ctx, filepath.Join(dirPath, path)); err != nil {
+				return err
+			}
+		case pb.FileType_symlink:
+			entry.Mode = 0
+			if entry.Target, err = os.Readlink(filepath.Join(dirPath, path)); err != nil {
+				return terror.Errorf(ctx, "os Readlink: %w", err)
+			}
+
+			if !SymlinkIsLocal(dirPath, path, entry.Target) {
+				skipNotice("symlink outside of the source directory", path)
+
+				return nil
+			}
+		}
+
+		entries = append(entries, entry)
+
+		return nil
+	}
+
+	walk := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return terror.Errorf(ctx, "walkdir func(%s): %w", dirPath, err)
+		}
+
+		return visit(path, d)
+	}
+
+	dfs := os.DirFS(dirPath)
+
+	if paths == nil {
+		if err := fs.WalkDir(dfs, ".", walk); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range paths {
+		if !filepath.IsLocal(path) {
+			return nil, terror.Errorf(ctx, "file path is not local: %s", path)
+		}
+
+		if isHiddenPath(path) {
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(dirPath, path))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, terror.Errorf(ctx, "os Lstat: %w", err)
+		}
+
+		if info.IsDir() {
+			err = fs.WalkDir(dfs, path, walk)
+		} else {
+			err = visit(path, fs.FileInfoToDirEntry(info))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	span.SetAttributes(attr.Int("entries", len(entries)))
+
+	return entries, nil
+}
@@ -0,0 +1,83 @@
+package rpc
+
+import (
+	"sync"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+func progressKey(source pb.Source, path string) string {
+	return source.String() + "/" + path
+}
+
+// RecvProgress records how much of each file has been received, so that a sender which lost its
+// connection can resume where it left off
+type RecvProgress struct {
+	mutex sync.Mutex
+	files map[string]*pb.FileProgress
+}
+
+func NewRecvProgress() *RecvProgress {
+	return &RecvProgress{
+		files: make(map[string]*pb.FileProgress),
+	}
+}
+
+func (s *RecvProgress) update(source pb.Source, path string, offset int64, done bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.files[progressKey(source, path)] = &pb.FileProgress{
+		Source: source,
+		Path:   path,
+		Offset: offset,
+		Done:   done,
+	}
+}
+
+func (s *RecvProgress) Files() []*pb.FileProgress {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files := make([]*pb.FileProgress, 0, len(s.files))
+	for _, f := range s.files {
+		files = append(files, &pb.FileProgress{
+			Source: f.Source,
+			Path:   f.Path,
+			Offset: f.Offset,
+			Done:   f.Done,
+		})
+	}
+
+	return files
+}
+
+// Total is the number of bytes received over all files
+func (s *RecvProgress) Total() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var total int64
+	for _, f := range s.files {
+		total += f.Offset
+	}
+
+	return total
+}
+
+// ResumeFrom is what the receiver reported it has of each file, keyed by source and path
+type ResumeFrom map[string]*pb.FileProgress
+
+func NewResumeFrom(files []*pb.FileProgress) ResumeFrom {
+	from := make(ResumeFrom, len(files))
+	for _, f := range files {
+		from[progressKey(f.Source, f.Path)] = f
+	}
+
+	return from
+}
+
+func (s ResumeFrom) get(source pb.Source, path string) (*pb.FileProgress, bool) {
+	f, ok := s[progressKey(source, path)]
+	return f, ok
+}
@@ -29,6 +29,8 @@ type fileRecver struct {
 	internalError func(string, ...any) error
 	srcDir        string
 	assDir        string
+	progress      *RecvProgress
+	quota         func(n int64) error
 
 	RecvedAssistant bool
 }
@@ -51,6 +53,51 @@ func NewFileRecver(
 	}
 }
 
+// SetProgress records how much of each file is received in progress
+func (s *fileRecver) SetProgress(progress *RecvProgress) {
+	s.progress = progress
+}
+
+// SetQuota sets a function which is called with the size of each chunk before it is written. If
+// it returns an error then receiving stops with that error.
+func (s *fileRecver) SetQuota(quota func(n int64) error) {
+	s.quota = quota
+}
+
+// openResumed opens a file which was partly received before the connection was lost
+func openResumed(path string, offset int64, mode fs.FileMode) (*os.File, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() || info.Size() < offset {
+		return nil, fmt.Errorf("can't resume from offset %d, the file has %d bytes", offset, info.Size())
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything after the offset may be incomplete
+	if err := file.Truncate(offset); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if err := file.Chmod(mode); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
 func (s *fileRecver) RecvDirs(ctx context.Context) error {
 	ctx, span := trace.Span(ctx, "RecvDirs")
 	defer span.End()
@@ -87,6 +134,21 @@ func (s *fileRecver) RecvDirs(ctx context.Context) error {
 			return s.sendError("User cancelled")
 		}
 
+		for _, path := range chunks.GetDeleted() {
+			if err := CheckBeneath(s.srcDir, path); err != nil {
+				return s.sendError("%w", err)
+			}
+
+			if s.logChan != nil {
+				s.logChan <- fmt.Sprintf("Deleting: %s", path)
+			}
+			trace.Event(ctx, "delete", attr.String("path", path))
+
+			if err := os.RemoveAll(filepath.Join(s.srcDir, path)); err != nil {
+				return s.internalError("os RemoveAll: %w", err)
+			}
+		}
+
 		for _, chunk := range chunks.GetChunk() {
 			path := chunk.GetPath()
 			trace.Event(ctx, "got chunk",
@@ -97,25 +159,43 @@ func (s *fileRecver) RecvDirs(ctx context.Context) error {
 				attr.Int("size", len(chunk.Data)),
 			)
 
-			if !filepath.IsLocal(chunk.GetPath()) {
-				return s.sendError("file path is not local: %s", path)
-			}
-
 			base := filepath.Base(path)
 			if base == "." || base == "/" {
 				return s.sendError("file path has no base name: %s", path)
 			}
 
-			dstPath := filepath.Join(s.srcDir, path)
+			root := s.srcDir
 			switch chunk.Source {
 			case pb.Source_app:
 			case pb.Source_assistant:
 				s.RecvedAssistant = true
-				dstPath = filepath.Join(s.assDir, path)
+				root = s.assDir
 			default:
 				return s.internalError("unrecognized source: %d", chunk.Source)
 			}
 
+			// Nothing is written through a symlink, in case it points out of the root
+			if err := CheckBeneath(root, path); err != nil {
+				return s.sendError("%w", err)
+			}
+			dstPath := filepath.Join(root, path)
+
+			switch chunk.Type {
+			case pb.FileType_regular:
+			case pb.FileType_dir:
+				if err := s.recvDir(ctx, dstPath, chunk); err != nil {
+					return err
+				}
+				continue
+			case pb.FileType_symlink:
+				if err := s.recvSymlink(ctx, root, dstPath, chunk); err != nil {
+					return err
+				}
+				continue
+			default:
+				return s.internalError("unrecognized file type: %d", chunk.Type)
+			}
+
 			file, alreadyOpen := openFiles[dstPath]
 			if !alreadyOpen {
 				dir := filepath.Dir(dstPath)
@@ -128,16 +208,46 @@ func (s *fileRecver) RecvDirs(ctx context.Context) error {
 				if s.logChan != nil {
 					s.logChan <- fmt.Sprintf("Receiving: %s: %s", chunk.Source.String(), path)
 				}
-				trace.Event(ctx, "open/create file", attr.String("path", path))
-				file, err = os.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
-				if err != nil {
-					return s.internalError("open file: %w", err)
+
+				if chunk.Offset > 0 {
+					trace.Event(ctx, "resume file", attr.String("path", path), attr.Int64("offset", chunk.Offset))
+					file, err = openResumed(dstPath, chunk.Offset, fileMode(chunk.Mode, 0600))
+					if err != nil {
+						return s.internalError("openResumed: %w", err)
+					}
+				} else {
+					if err := removeUnwritable(dstPath); err != nil {
+						return s.internalError("removeUnwritable: %w", err)
+					}
+
+					trace.Event(ctx, "open/create file", attr.String("path", path))
+					file, err = os.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+					if err != nil {
+						return s.internalError("open file: %w", err)
+					}
+
+					// The file stays writable through the open descriptor
+					if err := file.Chmod(fileMode(chunk.Mode, 0600)); err != nil {
+						_ = file.Close()
+						return s.internalError("file chmod: %w", err)
+					}
 				}
 
 				openFiles[dstPath] = file
 			}
 
-			if _, err := file.Write(chunk.Data); err != nil {
+			data, err := decompress(ctx, chunk.Compression, chunk.Data)
+			if err != nil {
+				return s.internalError("decompress: %w", err)
+			}
+
+			if s.quota != nil {
+				if err := s.quota(int64(len(data))); err != nil {
+					return err
+				}
+			}
+
+			if _, err := file.WriteAt(data, chunk.Offset); err != nil {
 				return s.internalError("write file: %w", err)
 			}
 
@@ -145,8 +255,86 @@ func (s *fileRecver) RecvDirs(ctx context.Context) error {
 				terror.Ackf(ctx, "file close: %w", file.Close())
 				delete(openFiles, dstPath)
 			}
+
+			if s.progress != nil {
+				s.progress.update(chunk.Source, path, chunk.Offset+int64(len(data)), chunk.Last)
+			}
+		}
+	}
+}
+
+// fileMode returns the permission bits sent by the other side or def if they were not sent
+func fileMode(mode uint32, def fs.FileMode) fs.FileMode {
+	if mode == 0 {
+		return def
+	}
+
+	return fs.FileMode(mode) & fs.ModePerm
+}
+
+// removeUnwritable removes whatever is at path unless it is a regular file which can be truncated
+func removeUnwritable(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode().IsRegular() && info.Mode().Perm()&0200 != 0 {
+		return nil
+	}
+
+	return os.RemoveAll(path)
+}
+
+func (s *fileRecver) recvDir(ctx context.Context, dstPath string, chunk *pb.FileChunk) error {
+	trace.Event(ctx, "create dir", attr.String("path", chunk.Path))
+
+	info, err := os.Lstat(dstPath)
+	if err == nil && !info.IsDir() {
+		if err := os.Remove(dstPath); err != nil {
+			return s.internalError("os Remove: %w", err)
 		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return s.internalError("os Lstat: %w", err)
 	}
+
+	if err := os.MkdirAll(dstPath, 0700); err != nil {
+		return s.internalError("mkdirall: %w", err)
+	}
+
+	// The owner keeps full access so that the directory's contents can be received
+	if err := os.Chmod(dstPath, fileMode(chunk.Mode, 0700)|0700); err != nil {
+		return s.internalError("os Chmod: %w", err)
+	}
+
+	return nil
+}
+
+func (s *fileRecver) recvSymlink(ctx context.Context, root string, dstPath string, chunk *pb.FileChunk) error {
+	if !SymlinkIsLocal(root, chunk.Path, chunk.Target) {
+		return s.sendError("symlink points outside of the source directory: %s -> %s", chunk.Path, chunk.Target)
+	}
+
+	if s.logChan != nil {
+		s.logChan <- fmt.Sprintf("Receiving: %s: %s -> %s", chunk.Source.String(), chunk.Path, chunk.Target)
+	}
+	trace.Event(ctx, "create symlink", attr.String("path", chunk.Path), attr.String("target", chunk.Target))
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+		return s.internalError("mkdirall: %w", err)
+	}
+
+	if err := os.RemoveAll(dstPath); err != nil {
+		return s.internalError("os RemoveAll: %w", err)
+	}
+
+	if err := os.Symlink(chunk.Target, dstPath); err != nil {
+		return s.internalError("os Symlink: %w", err)
+	}
+
+	return nil
 }
 
 type fileChunkSender interface {
@@ -155,14 +343,19 @@ type fileChunkSender interface {
 
 type fileSender struct {
 	stream        fileChunkSender
+	app           string
 	cancelChan    chan struct{}
 	logChan       chan string
 	sendError     func(string, ...any) error
 	internalError func(string, ...any) error
+	compression   pb.Compression
+	ignoreFiles   []string
+	resume        ResumeFrom
 }
 
 func NewFileSender(
 	stream fileChunkSender,
+	app string,
 	cancelChan chan struct{},
 	logChan chan string,
 	sendError func(string, ...any) error,
@@ -170,6 +363,7 @@ func NewFileSender(
 ) fileSender {
 	return fileSender{
 		stream:        stream,
+		app:           app,
 		cancelChan:    cancelChan,
 		logChan:       logChan,
 		sendError:     sendError,
@@ -177,8 +371,76 @@ func NewFileSender(
 	}
 }
 
-func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath string) (err error) {
-	_, span := trace.Span(ctx, "sync dir", attr.String("path", dirPath))
+// SetCompression sets the compression used for file data, the receiver must accept it
+func (s *fileSender) SetCompression(compression pb.Compression) {
+	s.compression = compression
+}
+
+// SetIgnoreFiles sets the names of the ignore files read from the directories being sent
+func (s *fileSender) SetIgnoreFiles(names []string) {
+	s.ignoreFiles = names
+}
+
+// SetResume skips the parts of files which the receiver already has
+func (s *fileSender) SetResume(from ResumeFrom) {
+	s.resume = from
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") &&
+		name != "." &&
+		name != ".ayup"
+}
+
+func isHiddenPath(path string) bool {
+	for _, name := range strings.Split(filepath.ToSlash(path), "/") {
+		if isHidden(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileType returns how a directory entry is sent or false if it can't be
+func fileType(d fs.DirEntry) (pb.FileType, bool) {
+	switch {
+	case d.Type().IsRegular():
+		return pb.FileType_regular, true
+	case d.IsDir():
+		return pb.FileType_dir, true
+	case d.Type()&fs.ModeSymlink != 0:
+		return pb.FileType_symlink, true
+	default:
+		return pb.FileType_regular, false
+	}
+}
+
+func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath string) error {
+	return s.send(ctx, source, dirPath, nil, true)
+}
+
+// SendPaths only sends the given paths inside dirPath. Paths which no longer exist are sent as
+// deletions and directories are sent with everything in them.
+func (s fileSender) SendPaths(ctx context.Context, source pb.Source, dirPath string, paths []string) error {
+	if paths == nil {
+		paths = []string{}
+	}
+
+	return s.send(ctx, source, dirPath, paths, true)
+}
+
+// SendEntries is like SendPaths except that directories are sent without their contents
+func (s fileSender) SendEntries(ctx context.Context, source pb.Source, dirPath string, paths []string) error {
+	if paths == nil {
+		paths = []string{}
+	}
+
+	return s.send(ctx, source, dirPath, paths, false)
+}
+
+func (s fileSender) send(ctx context.Context, source pb.Source, dirPath string, paths []string, recursive bool) (err error) {
+	ctx, span := trace.Span(ctx, "sync dir", attr.String("path", dirPath), attr.Bool("partial", paths != nil))
 	defer span.End()
 
 	buf := make([]byte, 16*1024)
@@ -194,6 +456,7 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath strin
 		select {
 		case <-s.cancelChan:
 			if err := s.stream.Send(&pb.FileChunks{
+				App:    s.app,
 				Cancel: true,
 			}); err != nil {
 				return s.internalError("stream send: %w", err)
@@ -204,6 +467,7 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath strin
 		}
 
 		if err := s.stream.Send(&pb.FileChunks{
+			App:   s.app,
 			Chunk: chunks,
 		}); err != nil {
 			return s.internalError("stream send: %w", err)
@@ -215,8 +479,24 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath strin
 		return nil
 	}
 
-	sendFile := func(path string, r fs.File) error {
-		offset := 0
+	// Send a directory or symlink
+	appendEntry := func(chunk *pb.FileChunk) error {
+		if length > 15*1024 || len(chunks) >= 512 {
+			if err := sendFileChunks(); err != nil {
+				return err
+			}
+		}
+
+		chunks = append(chunks, chunk)
+		length += len(chunk.Path) + len(chunk.Target)
+
+		return nil
+	}
+
+	sendFile := func(path string, mode uint32, r fs.File, offset int) error {
+		first := true
+		// Set to none if the file turns out to be incompressible
+		compression := s.compression
 
 		for {
 			if length > 15*1024 || len(chunks) >= 512 {
@@ -251,13 +531,36 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath strin
 				}
 			}
 
-			chunks = append(chunks, &pb.FileChunk{
-				Source: source,
-				Path:   path,
-				Last:   last,
-				Data:   buf[length : length+chunkLength],
-				Offset: int64(offset),
-			})
+			data := buf[length : length+chunkLength]
+			chunkCompression := pb.Compression_none
+			if compression != pb.Compression_none && chunkLength > 0 {
+				compressed, ok, err := compress(ctx, compression, data)
+				if err != nil {
+					return s.internalError("compress: %w", err)
+				}
+
+				if ok {
+					data = compressed
+					chunkCompression = compression
+				} else {
+					trace.Event(ctx, "incompressible file", attr.String("path", path))
+					compression = pb.Compression_none
+				}
+			}
+
+			chunk := &pb.FileChunk{
+				Source:      source,
+				Path:        path,
+				Last:        last,
+				Data:        data,
+				Offset:      int64(offset),
+				Compression: chunkCompression,
+			}
+			if first {
+				chunk.Mode = mode
+				first = false
+			}
+			chunks = append(chunks, chunk)
 
 			length += chunkLength
 			offset += chunkLength
@@ -271,12 +574,9 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath strin
 	}
 
 	dfs := os.DirFS(dirPath)
+	ignore := NewIgnore(dirPath, s.ignoreFiles)
 
-	err = fs.WalkDir(dfs, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return s.internalError("walkdir func(%s): %w", dirPath, err)
-		}
-
+	visit := func(path string, d fs.DirEntry) error {
 		event_attrs := []attr.KeyValue{
 			attr.String("path", path),
 			attr.Bool("isDir", d.IsDir()),
@@ -300,10 +600,7 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath strin
 			}
 		}
 
-		if strings.HasPrefix(d.Name(), ".") &&
-			d.Name() != "." &&
-			d.Name() != ".ayup" &&
-			d.Name() != ".ayup-env" {
+		if isHidden(d.Name()) {
 			skipNotice("hidden")
 
 			if d.IsDir() {
@@ -312,19 +609,76 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath strin
 			return nil
 		}
 
-		if !d.Type().IsRegular() {
-			skipNotice("special file")
+		if ignored, err := ignore.Match(ctx, path, d.IsDir()); err != nil {
+			return s.internalError("ignore Match: %w", err)
+		} else if ignored {
+			skipNotice("ignored")
 
+			if d.IsDir() {
+				return fs.SkipDir
+			}
 			return nil
 		}
 
-		// TODO: We should probably transmit empty directories
-		if d.IsDir() {
-			span.AddEvent("skip", tr.WithAttributes(event_attrs...))
+		typ, ok := fileType(d)
+		if !ok {
+			skipNotice("special file")
+
 			return nil
 		}
 
-		span.AddEvent("copy", tr.WithAttributes(event_attrs...))
+		switch typ {
+		case pb.FileType_dir:
+			// The root already exists on the other side
+			if path == "." {
+				return nil
+			}
+
+			span.AddEvent("dir", tr.WithAttributes(event_attrs...))
+
+			return appendEntry(&pb.FileChunk{
+				Source: source,
+				Path:   path,
+				Last:   true,
+				Mode:   uint32(info.Mode().Perm()),
+				Type:   pb.FileType_dir,
+			})
+		case pb.FileType_symlink:
+			target, err := os.Readlink(filepath.Join(dirPath, path))
+			if err != nil {
+				return s.internalError("os Readlink: %w", err)
+			}
+
+			if !SymlinkIsLocal(dirPath, path, target) {
+				skipNotice("symlink outside of the source directory")
+
+				return nil
+			}
+
+			span.AddEvent("symlink", tr.WithAttributes(event_attrs...))
+			if s.logChan != nil {
+				s.logChan <- fmt.Sprintf("Send %s: %s -> %s", source, path, target)
+			}
+
+			return appendEntry(&pb.FileChunk{
+				Source: source,
+				Path:   path,
+				Last:   true,
+				Type:   pb.FileType_symlink,
+				Target: target,
+			})
+		}
+
+		var offset int64
+		if from, ok := s.resume.get(source, path); ok && from.Offset <= info.Size() {
+			if from.Done {
+				span.AddEvent("already sent", tr.WithAttributes(event_attrs...))
+				return nil
+			}
+			offset = from.Offset
+		}
+
+		span.AddEvent("copy", tr.WithAttributes(append(event_attrs, attr.Int64("offset", offset))...))
 
 		size := info.Size()
 		unit := "b"
@@ -341,16 +695,87 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, dirPath strin
 		}
 		defer r.Close()
 
-		return sendFile(path, r)
-	})
+		if offset > 0 {
+			seeker, ok := r.(io.Seeker)
+			if !ok {
+				return s.internalError("file is not seekable: %s", path)
+			}
 
-	if err != nil {
-		return
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return s.internalError("file seek: %w", err)
+			}
+		}
+
+		return sendFile(path, uint32(info.Mode().Perm()), r, int(offset))
+	}
+
+	walk := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return s.internalError("walkdir func(%s): %w", dirPath, err)
+		}
+
+		return visit(path, d)
+	}
+
+	if paths == nil {
+		if err = fs.WalkDir(dfs, ".", walk); err != nil {
+			return
+		}
+
+		return sendFileChunks()
+	}
+
+	var deleted []string
+	for _, path := range paths {
+		if !filepath.IsLocal(path) {
+			return s.internalError("file path is not local: %s", path)
+		}
+
+		if isHiddenPath(path) {
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(dirPath, path))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return s.internalError("os Lstat: %w", err)
+			}
+
+			if ignored, err := ignore.Match(ctx, path, false); err != nil {
+				return s.internalError("ignore Match: %w", err)
+			} else if ignored {
+				continue
+			}
+
+			if s.logChan != nil {
+				s.logChan <- fmt.Sprintf("Delete %s: %s", source, path)
+			}
+			deleted = append(deleted, path)
+			continue
+		}
+
+		if info.IsDir() && recursive {
+			err = fs.WalkDir(dfs, path, walk)
+		} else {
+			err = visit(path, fs.FileInfoToDirEntry(info))
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	if err = sendFileChunks(); err != nil {
 		return
 	}
 
+	if len(deleted) > 0 {
+		if err := s.stream.Send(&pb.FileChunks{
+			App:     s.app,
+			Deleted: deleted,
+		}); err != nil {
+			return s.internalError("stream send: %w", err)
+		}
+	}
+
 	return
 }
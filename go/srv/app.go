@@ -0,0 +1,163 @@
+package srv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/assist"
+	inrPb "premai.io/Ayup/go/internal/grpc/inrootless"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// The app used by clients which don't specify one
+const defaultAppId = "default"
+
+var appIdRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// An application pushed by a client. Each app has its own directories, processes and ports so that
+// several can be pushed to the same server without interfering with each other.
+type app struct {
+	id   string
+	root string
+
+	AssistantDir string
+	AppDir       string
+	StateDir     string
+	ScratchDir   string
+
+	hasAssistant bool
+	procs        *assist.Procs
+
+	// Held while the app is being uploaded, downloaded or assisted
+	busy sync.Mutex
+	// The manifest of the upload in progress, guarded by busy
+	pendingManifest []*pb.ManifestEntry
+
+	// The last upload if it didn't finish, so that it can be resumed
+	uploadMutex sync.Mutex
+	upload      *appUpload
+	// The client which last uploaded the app, its usage counts against their quotas
+	owner string
+
+	// The disk space the app uses, so that every app isn't walked each time it's needed
+	usageMutex sync.Mutex
+	usage      cachedUsage
+
+	// Guards the fields below which track what the app is running
+	runMutex sync.Mutex
+	built    *assist.State
+	run      *appRun
+	session  *session
+}
+
+// How long to wait for a container's network to be set up after its process starts
+const containerIpTimeout = 5 * time.Second
+
+// containerIp finds the IP of the container created with hostname
+func (s *Srv) containerIp(ctx context.Context, hostname string) (string, error) {
+	deadline := time.Now().Add(containerIpTimeout)
+
+	for {
+		res, err := s.inrClient.ContainerIp(ctx, &inrPb.ContainerIpRequest{Hostname: hostname})
+		if err != nil {
+			return "", terror.Errorf(ctx, "inrClient ContainerIp: %w", err)
+		}
+
+		if res.Ip != "" {
+			return res.Ip, nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", terror.Errorf(ctx, "the IP of container %s was not found", hostname)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func normAppId(ctx context.Context, id string) (string, error) {
+	if id == "" {
+		id = defaultAppId
+	}
+
+	if !appIdRegex.MatchString(id) {
+		return "", terror.Errorf(ctx, "invalid app name `%s`: it should start with a letter or number and may contain '.', '_' and '-'", id)
+	}
+
+	return id, nil
+}
+
+func (s *Srv) newApp(id string) *app {
+	root := filepath.Join(s.AppsDir, id)
+
+	return &app{
+		id:           id,
+		root:         root,
+		AssistantDir: filepath.Join(root, "assist"),
+		AppDir:       filepath.Join(root, "app"),
+		StateDir:     filepath.Join(root, "state"),
+		ScratchDir:   filepath.Join(root, "scratch"),
+		procs:        assist.NewProcs(s.containerIp),
+	}
+}
+
+// lookupApp returns an app which has already been pushed
+func (s *Srv) lookupApp(ctx context.Context, id string) (*app, error) {
+	id, err := normAppId(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.appsMutex.Lock()
+	defer s.appsMutex.Unlock()
+
+	a, ok := s.apps[id]
+	if !ok {
+		return nil, terror.Errorf(ctx, "no such app: %s", id)
+	}
+
+	return a, nil
+}
+
+// getApp returns the app with the given ID, creating its directories if it is new
+func (s *Srv) getApp(ctx context.Context, id string) (*app, error) {
+	id, err := normAppId(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.appsMutex.Lock()
+	defer s.appsMutex.Unlock()
+
+	if a, ok := s.apps[id]; ok {
+		return a, nil
+	}
+
+	root := filepath.Join(s.AppsDir, id)
+	trace.Event(ctx, "new app", attribute.String("id", id), attribute.String("root", root))
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+
+	a := s.newApp(id)
+	s.apps[id] = a
+
+	if err := s.saveAppsIndex(ctx); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
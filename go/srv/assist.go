@@ -3,19 +3,21 @@ package srv
 import (
 	"context"
 	"errors"
-	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 	tr "go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 
 	"premai.io/Ayup/go/assistants/dockerfile"
+	"premai.io/Ayup/go/assistants/exec"
 	"premai.io/Ayup/go/assistants/python"
 	"premai.io/Ayup/go/internal/assist"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/metrics"
 	"premai.io/Ayup/go/internal/trace"
 
 	"github.com/moby/buildkit/client"
@@ -32,7 +34,7 @@ type ActServer interface {
 type aCtx struct {
 	ctx       context.Context
 	sendMutex *sync.Mutex
-	stream    pb.Srv_AssistServer
+	stream    assist.Sender
 }
 
 func (s *aCtx) send(msg *pb.ActReply) error {
@@ -48,7 +50,7 @@ func (s *aCtx) send(msg *pb.ActReply) error {
 
 func (s *aCtx) sendError(fmt string, args ...any) error {
 	oerr := terror.Errorf(s.ctx, fmt, args...)
-	return s.send(newErrorReply(oerr.Error()))
+	return s.send(newErrorReply(oerr))
 }
 
 func (s *aCtx) internalError(fmt string, args ...any) error {
@@ -57,6 +59,11 @@ func (s *aCtx) internalError(fmt string, args ...any) error {
 	return s.sendError("Internal Error: Support ID: %s", span.SpanContext().SpanID())
 }
 
+// internalError logs the error and returns one which only gives the client its support ID
+func internalError(ctx context.Context, msgf string, args ...any) error {
+	return errors.New(newInternalError(ctx, msgf, args...).Error)
+}
+
 var ErrUserCancelled = errors.New("user cancelled")
 
 func (s *Srv) findWorkableAssistant(aCtx assist.Context, state assist.State) (assist.State, error) {
@@ -94,66 +101,143 @@ func (s *Srv) Assist(stream pb.Srv_AssistServer) error {
 		stream:    stream,
 	}
 
-	recvChan := make(chan assist.RecvReq)
+	req, err := stream.Recv()
+	if err != nil {
+		return actx.internalError("stream recv: %w", err)
+	}
 
-	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
-		if err != nil {
-			return actx.internalError("checkPeerAuth: %w", err)
-		}
+	if req.Cancel {
+		return actx.sendError("analysis canceled")
+	}
 
-		return actx.sendError("Not authorized")
+	if req.Choice != nil {
+		return actx.sendError("premature choice")
 	}
 
-	proxy := mkProxy()
-	go func() {
-		if err := proxy.Listen(":8080"); err != nil {
-			terror.Ackf(ctx, "proxy listen: %w", err)
+	if req.Attach {
+		a, err := s.lookupApp(ctx, req.App)
+		if err != nil {
+			return actx.sendError("%w", err)
+		}
+		tr.SpanFromContext(ctx).SetAttributes(attribute.String("app", a.id))
+
+		sess := a.currentSession()
+		if sess == nil {
+			return actx.sendError("There is no session to attach to for app: %s", a.id)
 		}
-	}()
-	defer func() {
-		if err := proxy.ShutdownWithContext(ctx); err != nil {
-			terror.Ackf(ctx, "proxy shutdown: %w", err)
+
+		var fromSeq uint32
+		if req.Session == sess.id {
+			fromSeq = req.Seq
 		}
-	}()
 
-	go func(ctx context.Context) {
-		for {
-			req, err := stream.Recv()
-			if err != nil && err != io.EOF {
-				err = terror.Errorf(ctx, "stream recv: %w", err)
-			}
+		// Viewers only watch, they can't answer choices, cancel or take over the session
+		return sess.serve(actx, stream, fromSeq, !hasRole(ctx, roleDeveloper))
+	}
 
-			recvChan <- assist.RecvReq{Req: req, Err: err}
+	if !hasRole(ctx, roleDeveloper) {
+		return actx.sendError("Not allowed, pushing needs the developer role")
+	}
 
-			if err != nil {
-				break
-			}
+	a, err := s.getApp(ctx, req.App)
+	if err != nil {
+		return actx.sendError("%w", err)
+	}
+	tr.SpanFromContext(ctx).SetAttributes(attribute.String("app", a.id))
+
+	if s.draining.Load() {
+		return actx.sendError("%w", errShuttingDown)
+	}
+
+	if !a.busy.TryLock() {
+		return actx.sendError("App busy: %s", a.id)
+	}
+
+	sess, err := s.newSession(ctx, a, req.Detach)
+	if err != nil {
+		a.busy.Unlock()
+		return actx.internalError("newSession: %w", err)
+	}
+
+	go s.runSession(sess)
+
+	return sess.serve(actx, stream, 0, false)
+}
+
+// runSession runs the assistants for a session, the client may come and go while it does
+func (s *Srv) runSession(sess *session) {
+	a := sess.app
+	// The app must be free before the client sees the session finish, so it can download it
+	defer sess.finish()
+	defer a.busy.Unlock()
+	// The assistants change the app's files
+	defer a.changedUsage()
+
+	actx := aCtx{
+		ctx:       sess.ctx,
+		sendMutex: &sync.Mutex{},
+		stream:    sess,
+	}
+
+	if err := s.assist(actx, sess); err != nil {
+		result := "error"
+
+		// The client only needs to know where it was cancelled, not what failed as a result
+		var cerr *assist.CancelledError
+		if errors.As(err, &cerr) {
+			err = cerr
+			result = "cancelled"
+		} else if s.draining.Load() && sess.ctx.Err() != nil {
+			err = errShuttingDown
+			result = "shutdown"
 		}
-	}(ctx)
+
+		metrics.Pushes.WithLabelValues(result).Inc()
+		terror.Ackf(sess.ctx, "session Send: %w", sess.Send(newErrorReply(err)))
+		return
+	}
+
+	metrics.Pushes.WithLabelValues("ok").Inc()
+	terror.Ackf(sess.ctx, "session Send: %w", sess.Send(&pb.ActReply{}))
+}
+
+// assist runs the assistants on the session's app. It doesn't send an error reply itself, the
+// returned error is sent by runSession as the session's last reply.
+func (s *Srv) assist(actx aCtx, sess *session) error {
+	ctx := actx.ctx
+	a := sess.app
 
 	c, err := client.New(ctx, s.BuildkitdAddr)
 	if err != nil {
-		return actx.internalError("client new: %w", err)
+		return internalError(ctx, "client new: %w", err)
 	}
+	defer func() { terror.Ackf(ctx, "client Close: %w", c.Close()) }()
 
-	// TODO: Check if we are dealing with an existing session etc.
-	r, ok := <-recvChan
-	if !ok {
-		return actx.internalError("stream recv: channel closed")
+	if err := s.scratchQuota(ctx, a); err != nil {
+		return err
 	}
-	if r.Err != nil {
-		return actx.internalError("stream recv: %w", r.Err)
+
+	if a.running() {
+		if err := actx.send(newLogReply("Stopping the app running in the background\n")); err != nil {
+			return err
+		}
+
+		if err := s.stopApp(ctx, a); err != nil {
+			return internalError(ctx, "stopApp: %w", err)
+		}
 	}
 
-	if r.Req.Cancel {
-		return actx.sendError("analysis canceled")
+	appAssistantDir := ""
+	if a.hasAssistant {
+		appAssistantDir = a.AssistantDir
 	}
 
-	if r.Req.Choice != nil {
-		return actx.sendError("premature choice")
+	registry, err := s.registry.ForApp(ctx, appAssistantDir)
+	if err != nil {
+		return err
 	}
 
-	state := assist.NewState(filepath.Join(s.AppDir, ".ayup"), s.StateDir, s.registry)
+	state := assist.NewState(filepath.Join(a.AppDir, ".ayup"), a.StateDir, registry)
 
 	if err := os.RemoveAll(state.Path); err != nil && !os.IsNotExist(err) {
 		return terror.Errorf(ctx, "os RemoveAll(%s): %w", state.Path, err)
@@ -169,32 +253,24 @@ func (s *Srv) Assist(stream pb.Srv_AssistServer) error {
 
 	_, state, err = state.Version(ctx)
 	if err != nil {
-		return actx.sendError("dot Version: %w", err)
+		return terror.Errorf(ctx, "dot Version: %w", err)
 	}
 
 	aCtx := assist.Context{
 		Ctx:         ctx,
 		SendMutex:   actx.sendMutex,
-		Stream:      stream,
+		Stream:      sess,
 		Client:      c,
-		RecvChan:    recvChan,
+		RecvChan:    sess.recvChan,
 		OnLog:       nil,
-		AppPath:     s.AppDir,
-		StatePath:   s.StateDir,
-		ScratchPath: s.ScratchDir,
-	}
-
-	if s.push.hasAssistant {
-		nameBs, err := assist.LoadName(ctx, s.AssistantDir)
-		if err != nil {
-			return err
-		}
-		s.registry.Del(assist.FullName(assist.Local, string(nameBs)))
-
-		_, err = s.registry.RegisterDir(actx.ctx, assist.Local, s.AssistantDir)
-		if err != nil {
-			return err
-		}
+		AppId:       a.id,
+		AppPath:     a.AppDir,
+		StatePath:   a.StateDir,
+		ScratchPath: a.ScratchDir,
+		Procs:       a.procs,
+		Secrets: func(ctx context.Context, assistant string) (map[string][]byte, error) {
+			return s.secrets.forAssistant(ctx, a.id, assistant)
+		},
 	}
 
 	state, err = state.LoadState(ctx)
@@ -209,6 +285,7 @@ func (s *Srv) Assist(stream pb.Srv_AssistServer) error {
 		}
 	}
 
+	detached := false
 	for {
 		assist := state.GetNext()
 		if assist == nil {
@@ -229,7 +306,25 @@ func (s *Srv) Assist(stream pb.Srv_AssistServer) error {
 		if err != nil {
 			return err
 		}
+
+		if _, ok := assist.(*exec.Assistant); ok {
+			if err := a.setBuilt(ctx, state); err != nil {
+				return err
+			}
+
+			// The daemon executes the app after the state has been moved back into place
+			if sess.detached {
+				detached = true
+				break
+			}
+		}
+
+		start := time.Now()
 		state, err = assist.Assist(aCtx, state)
+		// The exec assistant runs the app rather than building it
+		if _, ok := assist.(*exec.Assistant); !ok {
+			metrics.ObserveDuration(assist.Name(), start, err)
+		}
 		if err != nil {
 			return err
 		}
@@ -239,5 +334,28 @@ func (s *Srv) Assist(stream pb.Srv_AssistServer) error {
 		return terror.Errorf(ctx, "os Rename(%s, %s): %w", state.Path, state.SrcPath, err)
 	}
 
-	return aCtx.Send(&pb.ActReply{})
+	if detached {
+		if err := s.startApp(ctx, a); err != nil {
+			return terror.Errorf(ctx, "startApp: %w", err)
+		}
+
+		if err := actx.send(newLogReply("The app is running in the background, stop it with 'ay app stop'\n")); err != nil {
+			return err
+		}
+
+		// Let the client forward the app's ports while it is still connected, for e.g. in watch mode
+		for _, p := range state.GetPorts() {
+			if err := actx.send(&pb.ActReply{
+				Variant: &pb.ActReply_Expose{
+					Expose: &pb.ExposePort{
+						Port: p,
+					},
+				},
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
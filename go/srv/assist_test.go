@@ -0,0 +1,52 @@
+package srv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/metrics"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+func TestFailedPushSendsOneError(t *testing.T) {
+	trace.Zlog = zap.NewNop()
+
+	// The buildkitd address can't be parsed, so the push fails before anything is built
+	s := &Srv{
+		AppsDir:       t.TempDir(),
+		BuildkitdAddr: "%",
+		appsCtx:       context.Background(),
+	}
+	a := s.newApp("hello")
+	a.busy.Lock()
+
+	sess, err := s.newSession(context.Background(), a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := testutil.ToFloat64(metrics.Pushes.WithLabelValues("ok"))
+	failed := testutil.ToFloat64(metrics.Pushes.WithLabelValues("error"))
+
+	s.runSession(sess)
+
+	if len(sess.replies) != 1 {
+		t.Fatalf("got %d replies, want 1: %v", len(sess.replies), sess.replies)
+	}
+
+	if _, isErr := sess.replies[0].Variant.(*pb.ActReply_Error); !isErr {
+		t.Errorf("the reply is not an error: %v", sess.replies[0])
+	}
+
+	if got := testutil.ToFloat64(metrics.Pushes.WithLabelValues("ok")); got != ok {
+		t.Errorf("the push was counted as ok")
+	}
+
+	if got := testutil.ToFloat64(metrics.Pushes.WithLabelValues("error")); got != failed+1 {
+		t.Errorf("the push was counted %v times as an error, want 1", got-failed)
+	}
+}
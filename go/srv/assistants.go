@@ -28,7 +28,17 @@ func (s *Srv) AssistantsList(ctx context.Context, req *pb.AssistantsListReq) (*p
 }
 
 func (s *Srv) AssistantsPush(ctx context.Context, req *pb.AssistantsPushReq) (*pb.AssistantsPushResp, error) {
-	nameBs, err := assist.LoadName(ctx, s.AssistantDir)
+	a, err := s.getApp(ctx, req.App)
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.busy.TryLock() {
+		return nil, terror.Errorf(ctx, "app busy: %s", a.id)
+	}
+	defer a.busy.Unlock()
+
+	nameBs, err := assist.LoadName(ctx, a.AssistantDir)
 	if err != nil {
 		return nil, err
 	}
@@ -39,9 +49,11 @@ func (s *Srv) AssistantsPush(ctx context.Context, req *pb.AssistantsPushReq) (*p
 		return nil, terror.Errorf(ctx, "os RemoveAll: %w", err)
 	}
 
-	if err := os.Rename(s.AssistantDir, path); err != nil {
+	if err := os.Rename(a.AssistantDir, path); err != nil {
 		return nil, terror.Errorf(ctx, "os Rename: %w", err)
 	}
+	a.hasAssistant = false
+	a.changedUsage()
 
 	s.registry.Del(assist.FullName(assist.Local, string(nameBs)))
 	if _, err := s.registry.RegisterDir(ctx, assist.Local, path); err != nil {
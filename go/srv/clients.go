@@ -0,0 +1,370 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+
+	"premai.io/Ayup/go/internal/fs"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+type authedClient struct {
+	Id       p2pPeer.ID `json:"id"`
+	Label    string     `json:"label"`
+	Approved time.Time  `json:"approved"`
+	Role     string     `json:"role"`
+	// Revoked clients are remembered so they are not authorized again from
+	// AYUP_P2P_AUTHORIZED_CLIENTS when the daemon restarts
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// The longest label kept for a client, in runes
+const maxLabelLen = 64
+
+// sanitizeLabel removes control and formatting characters from a label chosen by the client and
+// shortens it. Otherwise it could contain escape sequences which change what the terminal shows
+// when the label is printed.
+func sanitizeLabel(label string) string {
+	var b strings.Builder
+	n := 0
+
+	for _, r := range label {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) || r == utf8.RuneError {
+			continue
+		}
+
+		if n++; n > maxLabelLen {
+			break
+		}
+		b.WriteRune(r)
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// clientStore is the persisted list of clients allowed to connect with libp2p
+type clientStore struct {
+	path string
+
+	mutex   sync.Mutex
+	clients []*authedClient
+}
+
+// loadClients reads the store at path and adds the pre-authorized clients to it, unless they
+// have been revoked
+func loadClients(ctx context.Context, path string, preauthed []p2pPeer.ID) (*clientStore, error) {
+	c := &clientStore{path: path}
+
+	bs, err := fs.ReadFile(ctx, path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(bs, &c.clients); err != nil {
+			return nil, terror.Errorf(ctx, "json Unmarshal(%s): %w", path, err)
+		}
+	}
+
+	// Clients authorized before there were roles could do everything
+	for _, client := range c.clients {
+		if client.Role == "" {
+			client.Role = roleAdmin.String()
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	added := false
+	for _, id := range preauthed {
+		if c.findLocked(id) != nil {
+			continue
+		}
+
+		trace.Event(ctx, "adding pre-authorized client", attribute.String("peerId", id.String()))
+		c.clients = append(c.clients, &authedClient{Id: id, Role: roleAdmin.String()})
+		added = true
+	}
+
+	if added {
+		if err := c.saveLocked(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *clientStore) saveLocked(ctx context.Context) error {
+	bs, err := json.MarshalIndent(c.clients, "", "  ")
+	if err != nil {
+		return terror.Errorf(ctx, "json Marshal: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+
+	tmpPath := c.path + ".tmp"
+	if err := fs.WriteFile(ctx, bs, tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return terror.Errorf(ctx, "os Rename: %w", err)
+	}
+
+	return nil
+}
+
+// findLocked returns the client with the peer ID, including if it was revoked
+func (c *clientStore) findLocked(id p2pPeer.ID) *authedClient {
+	for _, client := range c.clients {
+		if client.Id == id {
+			return client
+		}
+	}
+
+	return nil
+}
+
+// resolveLocked finds an authorized client by its peer ID or label
+func (c *clientStore) resolveLocked(name string) (*authedClient, error) {
+	if id, err := p2pPeer.Decode(name); err == nil {
+		if client := c.findLocked(id); client != nil && client.Revoked == nil {
+			return client, nil
+		}
+	}
+
+	var found *authedClient
+	for _, client := range c.clients {
+		if client.Revoked != nil || client.Label != name {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("more than one client is labelled %s, use the peer ID", name)
+		}
+		found = client
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no authorized client: %s", name)
+	}
+
+	return found, nil
+}
+
+func (c *clientStore) role(id p2pPeer.ID) role {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	client := c.findLocked(id)
+	if client == nil || client.Revoked != nil {
+		return roleNone
+	}
+
+	r, err := parseRole(client.Role)
+	if err != nil {
+		return roleNone
+	}
+
+	return r
+}
+
+func (c *clientStore) list() []authedClient {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var clients []authedClient
+	for _, client := range c.clients {
+		if client.Revoked == nil {
+			clients = append(clients, *client)
+		}
+	}
+
+	return clients
+}
+
+// approve authorizes the client, it may have been revoked before
+func (c *clientStore) approve(ctx context.Context, id p2pPeer.ID, label string, r role) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	client := c.findLocked(id)
+	if client == nil {
+		client = &authedClient{Id: id}
+		c.clients = append(c.clients, client)
+	}
+
+	client.Label = label
+	client.Role = r.String()
+	client.Approved = time.Now()
+	client.Revoked = nil
+
+	return c.saveLocked(ctx)
+}
+
+func (c *clientStore) revoke(ctx context.Context, name string) (p2pPeer.ID, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	client, err := c.resolveLocked(name)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	client.Revoked = &now
+
+	return client.Id, c.saveLocked(ctx)
+}
+
+func (c *clientStore) rename(ctx context.Context, name string, label string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	client, err := c.resolveLocked(name)
+	if err != nil {
+		return err
+	}
+
+	client.Label = label
+
+	return c.saveLocked(ctx)
+}
+
+func (c *clientStore) setRole(ctx context.Context, name string, r role) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	client, err := c.resolveLocked(name)
+	if err != nil {
+		return err
+	}
+
+	client.Role = r.String()
+
+	return c.saveLocked(ctx)
+}
+
+// rotate replaces the client's old peer ID with its new one, keeping its label and role
+func (c *clientStore) rotate(ctx context.Context, old p2pPeer.ID, new p2pPeer.ID) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	client := c.findLocked(old)
+	if client == nil || client.Revoked != nil {
+		return fmt.Errorf("the client %s is not authorized", old)
+	}
+
+	if c.findLocked(new) != nil {
+		return fmt.Errorf("the new peer ID %s is already known, revoked clients can't be reused", new)
+	}
+
+	// The old ID is kept as revoked, so it isn't authorized again if it was pre-authorized
+	now := time.Now()
+	c.clients = append(c.clients, &authedClient{
+		Id:       old,
+		Label:    client.Label,
+		Approved: client.Approved,
+		Role:     client.Role,
+		Revoked:  &now,
+	})
+	client.Id = new
+
+	return c.saveLocked(ctx)
+}
+
+// clientsCtl converts errors from f to a message which can be shown to the user
+func (s *Srv) clientsCtl(ctx context.Context, name string, f func() error) *pb.Error {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+	ctx, span := trace.Span(ctx, name)
+	defer span.End()
+
+	if err := f(); err != nil {
+		return newError(err)
+	}
+
+	return nil
+}
+
+func (s *Srv) ClientsList(ctx context.Context, req *pb.ClientsListReq) (*pb.ClientsListReply, error) {
+	var reply pb.ClientsListReply
+
+	reply.Error = s.clientsCtl(ctx, "clients list", func() error {
+		for _, client := range s.clients.list() {
+			var approved int64
+			if !client.Approved.IsZero() {
+				approved = client.Approved.Unix()
+			}
+
+			reply.Clients = append(reply.Clients, &pb.ClientInfo{
+				Peer:     client.Id.String(),
+				Label:    client.Label,
+				Approved: approved,
+				Role:     client.Role,
+			})
+		}
+
+		return nil
+	})
+
+	return &reply, nil
+}
+
+func (s *Srv) ClientsRevoke(ctx context.Context, req *pb.ClientsRevokeReq) (*pb.ClientsRevokeReply, error) {
+	return &pb.ClientsRevokeReply{
+		Error: s.clientsCtl(ctx, "clients revoke", func() error {
+			id, err := s.clients.revoke(ctx, req.Client)
+			if err != nil {
+				return err
+			}
+
+			trace.Event(ctx, "revoked client", attribute.String("peerId", id.String()))
+
+			// Closing the connection ends the client's open streams, new ones are rejected
+			if s.p2pHost != nil {
+				terror.Ackf(ctx, "ClosePeer: %w", s.p2pHost.Network().ClosePeer(id))
+			}
+
+			return nil
+		}),
+	}, nil
+}
+
+func (s *Srv) ClientsRename(ctx context.Context, req *pb.ClientsRenameReq) (*pb.ClientsRenameReply, error) {
+	return &pb.ClientsRenameReply{
+		Error: s.clientsCtl(ctx, "clients rename", func() error {
+			return s.clients.rename(ctx, req.Client, sanitizeLabel(req.Label))
+		}),
+	}, nil
+}
+
+func (s *Srv) ClientsSetRole(ctx context.Context, req *pb.ClientsSetRoleReq) (*pb.ClientsSetRoleReply, error) {
+	return &pb.ClientsSetRoleReply{
+		Error: s.clientsCtl(ctx, "clients set role", func() error {
+			r, err := parseRole(req.Role)
+			if err != nil {
+				return err
+			}
+
+			return s.clients.setRole(ctx, req.Client, r)
+		}),
+	}, nil
+}
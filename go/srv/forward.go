@@ -3,37 +3,18 @@ package srv
 import (
 	"fmt"
 	"io"
-	"strings"
+	"sync"
 
-	"github.com/gofiber/contrib/otelfiber"
-	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/proxy"
+	attr "go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
 
 	inrPb "premai.io/Ayup/go/internal/grpc/inrootless"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/metrics"
 	"premai.io/Ayup/go/internal/terror"
 	"premai.io/Ayup/go/internal/trace"
 )
 
-func mkProxy() *fiber.App {
-	app := fiber.New(fiber.Config{
-		DisableStartupMessage: true,
-		BodyLimit:             1024 * 1024 * 1024,
-	})
-	app.Use(otelfiber.Middleware())
-
-	app.Use(func(c *fiber.Ctx) error {
-		if strings.HasPrefix(c.Hostname(), "app.") {
-			return proxy.Do(c, "http://localhost:5000"+c.OriginalURL())
-		}
-
-		return fiber.NewError(fiber.StatusNotFound, "Not found!")
-	})
-
-	return app
-}
-
 func (s *Srv) Forward(stream pb.Srv_ForwardServer) error {
 	ctx := stream.Context()
 	genericError := fmt.Errorf("port forwarding failure")
@@ -44,9 +25,19 @@ func (s *Srv) Forward(stream pb.Srv_ForwardServer) error {
 		return genericError
 	}
 
+	metrics.ActiveForwards.Inc()
+	defer metrics.ActiveForwards.Dec()
+
+	// The ports which were checked against the app's, only these are used as metric labels
+	// because the client chooses the port
+	var checkedPorts sync.Map
+
 	var g errgroup.Group
 
 	g.Go(func() error {
+		var a *app
+		var name string
+
 		for {
 			req, err := stream.Recv()
 			if err != nil {
@@ -59,13 +50,36 @@ func (s *Srv) Forward(stream pb.Srv_ForwardServer) error {
 				}
 			}
 
+			// Each message names its app and port, so they are checked every time and not just
+			// for the first message. The app must already exist and expose the port.
+			if a == nil || name != req.App {
+				if a, err = s.lookupApp(ctx, req.App); err != nil {
+					return err
+				}
+				name = req.App
+				trace.Event(ctx, "forward to app", attr.String("app", a.id))
+			}
+
+			if !a.procs.HasPort(req.Port) {
+				return terror.Errorf(ctx, "app %s does not expose port %d", a.id, req.Port)
+			}
+			checkedPorts.Store(req.Port, true)
+
+			// The address is cleared when the app exits, rather than guessed
+			ip := a.procs.Addr()
+			if ip == "" {
+				return terror.Errorf(ctx, "app %s is not running", a.id)
+			}
+
 			if err := inrStream.Send(&inrPb.ForwardRequest{
 				Data: req.Data,
 				Port: req.Port,
+				Ip:   ip,
 			}); err != nil {
 				terror.Ackf(ctx, "inrStream Send: %w", err)
 				return genericError
 			}
+			metrics.AddForwarded(req.Port, "in", len(req.Data))
 
 			trace.Event(ctx, "ingress recv")
 		}
@@ -102,6 +116,9 @@ func (s *Srv) Forward(stream pb.Srv_ForwardServer) error {
 				terror.Ackf(ctx, "inrStream Send: %w", err)
 				return genericError
 			}
+			if _, ok := checkedPorts.Load(req.Port); ok {
+				metrics.AddForwarded(req.Port, "out", len(req.Data))
+			}
 
 			trace.Event(ctx, "ingress recv")
 		}
@@ -0,0 +1,120 @@
+package srv
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	tr "go.opentelemetry.io/otel/trace"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// How long an invite can be used for, unless the admin says otherwise
+const inviteTimeout = time.Hour
+
+// An invite authorizes the first client which logs in with it. Only a hash of the secret is
+// kept and invites are forgotten when the daemon stops.
+type invite struct {
+	hash    [sha256.Size]byte
+	role    role
+	expires time.Time
+}
+
+// pruneInvitesLocked removes expired invites, invitesMutex must be held
+func (s *Srv) pruneInvitesLocked() {
+	now := time.Now()
+	for i := 0; i < len(s.invites); {
+		if now.After(s.invites[i].expires) {
+			s.invites = append(s.invites[:i], s.invites[i+1:]...)
+		} else {
+			i++
+		}
+	}
+}
+
+// useInvite checks the code and if it is valid, removes the invite and returns its role
+func (s *Srv) useInvite(code string) (role, error) {
+	if s.p2pHost == nil {
+		return roleNone, fmt.Errorf("invites can only be used with libp2p")
+	}
+
+	server, secret, err := rpc.ParseInvite(code)
+	if err != nil {
+		return roleNone, err
+	}
+
+	if server != s.p2pHost.ID() {
+		return roleNone, fmt.Errorf("the invite is for a different server: %s", server)
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+
+	s.invitesMutex.Lock()
+	defer s.invitesMutex.Unlock()
+
+	s.pruneInvitesLocked()
+
+	for i, inv := range s.invites {
+		if subtle.ConstantTimeCompare(inv.hash[:], hash[:]) == 1 {
+			s.invites = append(s.invites[:i], s.invites[i+1:]...)
+			return inv.role, nil
+		}
+	}
+
+	return roleNone, fmt.Errorf("the invite is not valid, it may have expired or been used already")
+}
+
+func (s *Srv) InviteCreate(ctx context.Context, req *pb.InviteCreateReq) (*pb.InviteCreateReply, error) {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+	ctx, span := trace.Span(ctx, "invite create")
+	defer span.End()
+
+	if s.p2pHost == nil {
+		return &pb.InviteCreateReply{
+			Error: &pb.Error{Error: "Invites need the daemon to listen with libp2p, see 'ay daemon start --help'"},
+		}, nil
+	}
+
+	r, err := parseRole(req.Role)
+	if err != nil {
+		return &pb.InviteCreateReply{Error: newError(err)}, nil
+	}
+
+	expiresIn := inviteTimeout
+	if req.ExpiresIn > 0 {
+		expiresIn = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	code, secret, err := rpc.NewInvite(s.p2pHost.ID())
+	if err != nil {
+		return &pb.InviteCreateReply{Error: newInternalError(ctx, "NewInvite: %w", err)}, nil
+	}
+
+	inv := invite{
+		hash:    sha256.Sum256([]byte(secret)),
+		role:    r,
+		expires: time.Now().Add(expiresIn),
+	}
+
+	s.invitesMutex.Lock()
+	s.pruneInvitesLocked()
+	s.invites = append(s.invites, inv)
+	s.invitesMutex.Unlock()
+
+	trace.Event(ctx, "invite created")
+
+	reply := &pb.InviteCreateReply{
+		Code:    code,
+		Expires: inv.expires.Unix(),
+	}
+	for _, maddr := range s.p2pHost.Addrs() {
+		reply.Addrs = append(reply.Addrs, fmt.Sprintf("%s/p2p/%s", maddr.String(), s.p2pHost.ID().String()))
+	}
+
+	return reply, nil
+}
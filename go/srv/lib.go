@@ -3,14 +3,18 @@ package srv
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	gostream "github.com/libp2p/go-libp2p-gostream"
+	"github.com/libp2p/go-libp2p/core/host"
 	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
 	"golang.org/x/sync/errgroup"
 
@@ -23,6 +27,7 @@ import (
 	"premai.io/Ayup/go/internal/conf"
 	inrPb "premai.io/Ayup/go/internal/grpc/inrootless"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/metrics"
 
 	"premai.io/Ayup/go/internal/proc"
 	"premai.io/Ayup/go/internal/rpc"
@@ -31,45 +36,91 @@ import (
 	"premai.io/Ayup/go/internal/tui"
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
-	attr "go.opentelemetry.io/otel/attribute"
 	tr "go.opentelemetry.io/otel/trace"
 )
 
-type Push struct {
-	hasAssistant bool
-}
-
 type Srv struct {
 	pb.UnimplementedSrvServer
 
-	AssistantDir        string
 	RemoteAssistantsDir string
 	LocalAssistantsDir  string
-	AppDir              string
-	StateDir            string
-	ScratchDir          string
-
-	Host             string
-	P2pPrivKey       string
-	P2pAuthedClients []p2pPeer.ID
+	// Each app gets a subdirectory of this, it persists across restarts
+	AppsDir string
+	// Start the apps which were running in the background when the daemon was last stopped
+	RestartApps bool
+	// Limits on the disk space used by each client
+	Quotas Quotas
+	// Sent to apps to stop them, if they don't exit within StopTimeout then they are killed
+	StopSignal  syscall.Signal
+	StopTimeout time.Duration
+	// Where to serve Prometheus metrics over HTTP, e.g. :9090, they are not served if empty
+	MetricsHost string
+	// A unix socket which accepts requests with the admin role, for e.g. to approve logins
+	ControlSocket string
+	// How long a login waits to be approved before it expires
+	LoginTimeout time.Duration
+
+	Host       string
+	P2pPrivKey string
+	// Where P2pPrivKey was set if not in the env file, for e.g. the command line. The key can't be
+	// rotated then, because the next key would be overridden when the daemon restarts.
+	P2pPrivKeySource string
+	// Records the clients which may connect with libp2p and when they were authorized
+	ClientsFile string
+	// Clients which are authorized without logging in, unless they have been revoked
+	P2pPreauthedClients []p2pPeer.ID
+	// Where the handoff from the last key rotation is saved, see 'ay key rotate --server'
+	KeyHandoffFile string
+	// The secrets given to assistants, encrypted with the key in SecretsKeyFile
+	SecretsFile    string
+	SecretsKeyFile string
 
 	BuildkitdAddr string
 
 	registry  *assistants.Registry
 	inrClient inrPb.InRootlessClient
-
-	push Push
+	clients   *clientStore
+	secrets   *secretStore
+	// Nil when listening without libp2p
+	p2pHost host.Host
+
+	apps      map[string]*app
+	appsMutex sync.Mutex
+	// Detached apps run in this context so they outlive the client's stream
+	appsCtx context.Context
+	// Set when the daemon is shutting down, after which no new work is accepted
+	draining atomic.Bool
 
 	tuiMutex sync.Mutex
+
+	// Logins waiting to be approved
+	pending      map[p2pPeer.ID]*pendingLogin
+	pendingMutex sync.Mutex
+	// When each peer last requested a login, guarded by pendingMutex
+	loginRequested map[p2pPeer.ID]time.Time
+
+	invites      []invite
+	invitesMutex sync.Mutex
+
+	keyHandoff atomic.Pointer[string]
+	// The key was loaded from its encrypted key file rather than the env file
+	keyInFile bool
 }
 
-func newErrorReply(error string) *pb.ActReply {
+func newErrorReply(err error) *pb.ActReply {
 	return &pb.ActReply{
 		Source: "ayup",
 		Variant: &pb.ActReply_Error{
-			Error: &pb.Error{
-				Error: error,
-			},
+			Error: newError(err),
+		},
+	}
+}
+
+func newLogReply(log string) *pb.ActReply {
+	return &pb.ActReply{
+		Source: "ayup",
+		Variant: &pb.ActReply_Log{
+			Log: log,
 		},
 	}
 }
@@ -89,40 +140,51 @@ func remotePeerId(ctx context.Context) (peerId p2pPeer.ID, err error) {
 	return
 }
 
-func (s *Srv) checkPeerAuth(ctx context.Context) (bool, error) {
-	span := tr.SpanFromContext(ctx)
-
+// peerName identifies the client for its quotas, clients using the insecure transport are all
+// called local
+func peerName(ctx context.Context) string {
 	pr, ok := peer.FromContext(ctx)
-	if !ok {
-		return false, fmt.Errorf("failed to get peer info from context")
+	if !ok || pr.Addr.Network() != gostream.Network {
+		return "local"
 	}
 
-	if pr.Addr.Network() != gostream.Network {
-		trace.Event(ctx, "Authorized due to insecure transport")
+	return pr.Addr.String()
+}
 
-		return true, nil
+// listenControl listens on a unix socket only the daemon's user can connect to, which gives the
+// admin role because it does not use libp2p. The socket is created in a directory only the
+// daemon's user can enter, so it can't be reached before its mode is set.
+func listenControl(ctx context.Context, path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, terror.Errorf(ctx, "os MkdirAll: %w", err)
 	}
 
-	peerIdStr := pr.Addr.String()
-	span.SetAttributes(attr.String("peerId", peerIdStr))
-
-	peerId, err := p2pPeer.Decode(peerIdStr)
+	fi, err := os.Lstat(dir)
 	if err != nil {
-		return false, terror.Errorf(ctx, "peer Decode: %w", err)
+		return nil, terror.Errorf(ctx, "os Lstat: %w", err)
 	}
 
-	for _, authedId := range s.P2pAuthedClients {
-		if peerId == authedId {
-			trace.Event(ctx, "Authorized due to ID match")
-			return true, nil
-		} else {
-			trace.Event(ctx, "No match", attr.String("authedId", authedId.String()))
-		}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Geteuid() || fi.Mode().Perm()&0077 != 0 {
+		return nil, terror.Errorf(ctx, "%s has to be a directory only the daemon's user can access, 'chmod 700' it or remove it", dir)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, terror.Errorf(ctx, "os Remove: %w", err)
 	}
 
-	trace.Event(ctx, "No authorized peer IDs match")
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "net Listen: %w", err)
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		terror.Ackf(ctx, "lis Close: %w", lis.Close())
+		return nil, terror.Errorf(ctx, "os Chmod: %w", err)
+	}
 
-	return false, nil
+	return lis, nil
 }
 
 // TODO: Could be better handled in upstream change to buildkit by setting the cache path
@@ -175,6 +237,18 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 	ctx, span := trace.Span(ctx, "start srv")
 	defer span.End()
 
+	if s.StopSignal == 0 {
+		s.StopSignal = syscall.SIGTERM
+	}
+	if s.StopTimeout == 0 {
+		s.StopTimeout = appStopTimeout
+	}
+	if s.LoginTimeout == 0 {
+		s.LoginTimeout = loginTimeout
+	}
+	s.pending = make(map[p2pPeer.ID]*pendingLogin)
+	s.loginRequested = make(map[p2pPeer.ID]time.Time)
+
 	cniVarPath, err := fixupCni(ctx)
 	if err != nil {
 		return err
@@ -188,11 +262,18 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 		return terror.Errorf(ctx, "os Executable: %w", err)
 	}
 
+	s.keyInFile = s.P2pPrivKey == "" && conf.HasKeyFile("AYUP_SERVER_P2P_PRIV_KEY")
 	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_SERVER_P2P_PRIV_KEY", s.P2pPrivKey)
 	if err != nil {
 		return err
 	}
 
+	// Apps, sessions and buildkitd are stopped by the drain after a signal, not by the signal
+	appsCtx, cancelApps := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelApps()
+
+	s.apps = make(map[string]*app)
+	s.appsCtx = appsCtx
 	s.registry = assistants.NewRegistry()
 	if err := s.registry.RegisterDirs(ctx, assist.Remote, s.RemoteAssistantsDir); err != nil {
 		return err
@@ -202,6 +283,18 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 		return err
 	}
 
+	if err := s.loadApps(ctx); err != nil {
+		return err
+	}
+
+	if s.clients, err = loadClients(ctx, s.ClientsFile, s.P2pPreauthedClients); err != nil {
+		return err
+	}
+
+	if s.secrets, err = loadSecrets(ctx, s.SecretsFile, s.SecretsKeyFile); err != nil {
+		return err
+	}
+
 	titleStyle := tui.TitleStyle
 	if err != nil {
 		return terror.Errorf(ctx, "peer IDFromPublicKey: %w", err)
@@ -211,6 +304,11 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 	if err != nil {
 		return terror.Errorf(ctx, "listen: %w", err)
 	}
+	s.p2pHost = host
+
+	if err := s.loadHandoff(ctx); err != nil {
+		return err
+	}
 
 	if host != nil {
 		for _, maddr := range host.Addrs() {
@@ -218,16 +316,18 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 			fmt.Println(titleStyle.Render("Connect with:"), fmt.Sprintf("ay login %s", peerMaddr))
 		}
 
-		if len(s.P2pAuthedClients) > 0 {
+		if clients := s.clients.list(); len(clients) > 0 {
 			fmt.Println()
 			fmt.Println(titleStyle.Render("Authorized clients:"))
-			for _, clientPeerId := range s.P2pAuthedClients {
-				fmt.Println("\t", clientPeerId)
+			for _, client := range clients {
+				fmt.Println("\t", client.Id, client.Label)
 			}
 		}
 	}
 
 	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(s.unaryAuth),
+		grpc.StreamInterceptor(s.streamAuth),
 		grpc.StatsHandler(
 			otelgrpc.NewServerHandler(
 				otelgrpc.WithTracerProvider(span.TracerProvider()),
@@ -238,6 +338,19 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 	pb.RegisterSrvServer(srv, s)
 	span.AddEvent("Listening")
 
+	if s.ControlSocket != "" {
+		ctlLis, err := listenControl(ctx, s.ControlSocket)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := srv.Serve(ctlLis); err != nil {
+				terror.Ackf(ctx, "control serve: %w", err)
+			}
+		}()
+	}
+
 	inrConn, err := grpc.NewClient("unix://"+conf.InrootlessAddr(),
 		grpc.WithStatsHandler(
 			otelgrpc.NewClientHandler(
@@ -255,11 +368,14 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 
 	var g errgroup.Group
 
-	buildkitSpan, _, buildkitOut := s.runRootlessBuildkit(&g, ctx, selfExe, cniVarPath)
-
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
+	buildkitCtx, cancelBuildkit := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelBuildkit()
+
+	buildkitSpan, _, buildkitOut := s.runRootlessBuildkit(&g, buildkitCtx, selfExe, cniVarPath)
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -280,10 +396,28 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 		return terror.Errorf(ctx, "inrClient Ping: %w", err)
 	}
 
+	if s.RestartApps {
+		go s.restartApps(ctx)
+	}
+
+	var metricsSrv *metrics.Server
+	if s.MetricsHost != "" {
+		metricsSrv = metrics.NewServer(s.MetricsHost)
+		go func() {
+			terror.Ackf(ctx, "metrics listen: %w", metricsSrv.Listen(ctx))
+		}()
+		fmt.Println(titleStyle.Render("Metrics at:"), fmt.Sprintf("http://%s/metrics", s.MetricsHost))
+	}
+
 	go func() {
 		<-ctx.Done()
 
-		srv.GracefulStop()
+		s.drain(ctx, cancelApps)
+		s.stopGrpc(ctx, srv)
+		if metricsSrv != nil {
+			terror.Ackf(ctx, "metrics shutdown: %w", metricsSrv.Shutdown(context.WithoutCancel(ctx)))
+		}
+		cancelBuildkit()
 	}()
 
 	if err := srv.Serve(lis); err != nil {
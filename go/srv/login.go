@@ -2,22 +2,246 @@ package srv
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/charmbracelet/huh"
+	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mattn/go-isatty"
 	"github.com/muesli/termenv"
-	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
 
-	"premai.io/Ayup/go/internal/conf"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/metrics"
 	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
 	"premai.io/Ayup/go/internal/tui"
 )
 
+// How long a login waits to be approved, unless Srv.LoginTimeout is set
+const loginTimeout = 5 * time.Minute
+
+// The most logins which can wait to be approved at once. Anyone can request a login, so this
+// stops them filling the daemon's memory and console.
+const maxPendingLogins = 16
+
+// How long a peer has to wait after requesting a login before it can request another
+const loginRetryInterval = 10 * time.Second
+
+// The shortest peer ID prefix which a login can be approved with. All Ed25519 peer IDs start with
+// the same 8 characters, so this leaves at least 4 which are random.
+const minLoginPrefix = 12
+
+var errTooManyLogins = errors.New("too many logins are waiting to be approved, try again later")
+
+// A login waiting for an admin to approve or reject it
+type pendingLogin struct {
+	id        p2pPeer.ID
+	label     string
+	requested time.Time
+	expires   time.Time
+
+	// The Login calls waiting on this, pendingMutex must be held
+	waiters int
+	// Closed when there are no Login calls waiting
+	left chan struct{}
+
+	mutex sync.Mutex
+	// Closed when the login is approved or rejected
+	done chan struct{}
+	// The role the client was given, roleNone if it was rejected
+	role role
+}
+
+// queueLogin adds a login for the peer or joins the one which is already waiting. New logins are
+// limited in number and how often each peer can request them.
+func (s *Srv) queueLogin(id p2pPeer.ID, label string) (p *pendingLogin, isNew bool, err error) {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	if p, ok := s.pending[id]; ok {
+		p.waiters++
+		return p, false, nil
+	}
+
+	now := time.Now()
+	for peer, requested := range s.loginRequested {
+		if now.Sub(requested) >= loginRetryInterval {
+			delete(s.loginRequested, peer)
+		}
+	}
+
+	if _, ok := s.loginRequested[id]; ok {
+		return nil, false, fmt.Errorf("a login was requested too recently, try again in %s", loginRetryInterval)
+	}
+
+	if len(s.pending) >= maxPendingLogins {
+		return nil, false, errTooManyLogins
+	}
+	s.loginRequested[id] = now
+
+	p = &pendingLogin{
+		id:        id,
+		label:     label,
+		requested: now,
+		expires:   now.Add(s.LoginTimeout),
+		waiters:   1,
+		left:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	s.pending[id] = p
+
+	return p, true, nil
+}
+
+// leaveLogin removes the login once nobody is waiting on it
+func (s *Srv) leaveLogin(p *pendingLogin) {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	p.waiters--
+	if p.waiters < 1 && s.pending[p.id] == p {
+		delete(s.pending, p.id)
+		close(p.left)
+	}
+}
+
+func (s *Srv) pendingLogins() []*pendingLogin {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	logins := make([]*pendingLogin, 0, len(s.pending))
+	for _, p := range s.pending {
+		logins = append(logins, p)
+	}
+
+	return logins
+}
+
+// findLogin finds a waiting login by its peer ID or a prefix of it. The label can't be used
+// because the client chooses it, so another client could use the same one.
+func (s *Srv) findLogin(name string) (*pendingLogin, error) {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	if id, err := p2pPeer.Decode(name); err == nil {
+		if p, ok := s.pending[id]; ok {
+			return p, nil
+		}
+	}
+
+	if len(name) < minLoginPrefix {
+		return nil, fmt.Errorf("use the peer ID or at least its first %d characters: %s", minLoginPrefix, name)
+	}
+
+	var found *pendingLogin
+	for id, p := range s.pending {
+		if !strings.HasPrefix(id.String(), name) {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("more than one login's peer ID starts with %s, use more of it", name)
+		}
+		found = p
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no login is waiting for: %s", name)
+	}
+
+	return found, nil
+}
+
+// decideLogin approves the login with role r or rejects it if r is roleNone
+func (s *Srv) decideLogin(ctx context.Context, p *pendingLogin, r role) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	select {
+	case <-p.done:
+		return fmt.Errorf("the login was already decided")
+	default:
+	}
+
+	if r != roleNone {
+		if err := s.clients.approve(ctx, p.id, p.label, r); err != nil {
+			return err
+		}
+	}
+
+	p.role = r
+	close(p.done)
+
+	if r == roleNone {
+		fmt.Println(tui.TitleStyle.Render("Authorization rejected:"), p.id.String(), p.label)
+	} else {
+		fmt.Println(tui.TitleStyle.Render("Authorized client:"), p.id.String(), p.label, r)
+	}
+
+	return nil
+}
+
+// promptLogin lets someone at the daemon's terminal decide the login, if there is a terminal
+func (s *Srv) promptLogin(ctx context.Context, p *pendingLogin) {
+	if !isatty.IsTerminal(os.Stdin.Fd()) || !s.tuiMutex.TryLock() {
+		return
+	}
+	defer s.tuiMutex.Unlock()
+
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), p.expires)
+	defer cancel()
+
+	// Stop prompting if the login is decided some other way or the client gives up
+	go func() {
+		select {
+		case <-p.done:
+			cancel()
+		case <-p.left:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	accessible := false
+	if termenv.ColorProfile() == termenv.Ascii {
+		accessible = true
+	}
+
+	chosen := roleDeveloper
+	form := huh.NewForm(huh.NewGroup(
+		huh.NewSelect[role]().
+			Title("Authorize client?").
+			Description(fmt.Sprintf("Peer ID: %s\nLabel: %s", p.id.String(), p.label)).
+			Options(
+				huh.NewOption("Reject", roleNone),
+				huh.NewOption("Viewer: see the assistants and attach to apps' logs", roleViewer),
+				huh.NewOption("Developer: push, download and control apps", roleDeveloper),
+				huh.NewOption("Admin: also replace assistants and manage clients", roleAdmin),
+			).
+			Value(&chosen),
+	)).WithAccessible(accessible)
+
+	if err := form.RunWithContext(ctx); err != nil {
+		if ctx.Err() == nil {
+			terror.Ackf(ctx, "form Run: %w", err)
+		}
+		return
+	}
+
+	terror.Ackf(ctx, "decideLogin: %w", s.decideLogin(ctx, p, chosen))
+}
+
 func (s *Srv) Login(ctx context.Context, in *pb.LoginReq) (*pb.LoginReply, error) {
-	span := trace.SpanFromContext(ctx)
+	span := tr.SpanFromContext(ctx)
 
 	internalError := func(err error) (*pb.LoginReply, error) {
+		metrics.LoginAttempts.WithLabelValues("error").Inc()
 		return &pb.LoginReply{
 			Error: &pb.Error{
 				Error: fmt.Sprintf("Internal Error: Support ID: %s", span.SpanContext().SpanID()),
@@ -25,49 +249,73 @@ func (s *Srv) Login(ctx context.Context, in *pb.LoginReq) (*pb.LoginReply, error
 		}, err
 	}
 
-	hasAuth, err := s.checkPeerAuth(ctx)
+	have, err := s.peerRole(ctx)
 	if err != nil {
-		return internalError(terror.Errorf(ctx, "checkPeerAuth: %w", err))
+		return internalError(terror.Errorf(ctx, "peerRole: %w", err))
 	}
 
-	if hasAuth {
-		return &pb.LoginReply{}, nil
+	if have != roleNone {
+		metrics.LoginAttempts.WithLabelValues("authorized").Inc()
+		return &pb.LoginReply{Role: have.String()}, nil
 	}
 
 	peerId, err := remotePeerId(ctx)
 	if err != nil {
 		return internalError(err)
 	}
+	label := sanitizeLabel(in.Label)
 
-	if !s.tuiMutex.TryLock() {
-		return &pb.LoginReply{
-			Error: &pb.Error{
-				Error: "Server busy",
-			},
-		}, nil
+	if in.Invite != "" {
+		r, err := s.useInvite(in.Invite)
+		if err != nil {
+			metrics.LoginAttempts.WithLabelValues("bad_invite").Inc()
+			return &pb.LoginReply{Error: newError(err)}, nil
+		}
+
+		if err := s.clients.approve(ctx, peerId, label, r); err != nil {
+			return internalError(err)
+		}
+
+		metrics.LoginAttempts.WithLabelValues("invited").Inc()
+		fmt.Println(tui.TitleStyle.Render("Authorized client with an invite:"), peerId.String(), label, r)
+
+		return &pb.LoginReply{Role: r.String()}, nil
 	}
-	defer s.tuiMutex.Unlock()
 
-	// TODO: timeout
+	p, isNew, err := s.queueLogin(peerId, label)
+	if err != nil {
+		metrics.LoginAttempts.WithLabelValues("limited").Inc()
+		return &pb.LoginReply{Error: newError(err)}, nil
+	}
+	defer s.leaveLogin(p)
+
+	if isNew {
+		trace.Event(ctx, "login queued", attribute.String("peerId", peerId.String()))
+		fmt.Println(tui.TitleStyle.Render("Login request:"), peerId.String(), label)
+		fmt.Println("\t", "approve it with", tui.TitleStyle.Render(fmt.Sprintf("ay daemon approve %s", peerId.String())))
 
-	accessible := false
-	if termenv.ColorProfile() == termenv.Ascii {
-		accessible = true
+		go s.promptLogin(ctx, p)
 	}
 
-	authed := false
-	hconf := huh.NewConfirm().
-		Title("Authorize client?").
-		Description(fmt.Sprintf("Peer ID: %s", peerId.String())).
-		Value(&authed).
-		WithAccessible(accessible)
+	expired := time.NewTimer(time.Until(p.expires))
+	defer expired.Stop()
 
-	if err := hconf.Run(); err != nil {
-		return internalError(err)
+	select {
+	case <-p.done:
+	case <-expired.C:
+		metrics.LoginAttempts.WithLabelValues("expired").Inc()
+		return &pb.LoginReply{
+			Error: &pb.Error{
+				Error: "The login request expired before it was approved",
+			},
+		}, nil
+	case <-ctx.Done():
+		metrics.LoginAttempts.WithLabelValues("cancelled").Inc()
+		return nil, ctx.Err()
 	}
 
-	if !authed {
-		fmt.Println(tui.TitleStyle.Render("Authorization rejected:"), peerId.String())
+	if p.role == roleNone {
+		metrics.LoginAttempts.WithLabelValues("rejected").Inc()
 		return &pb.LoginReply{
 			Error: &pb.Error{
 				Error: "Authorization rejected",
@@ -75,10 +323,43 @@ func (s *Srv) Login(ctx context.Context, in *pb.LoginReq) (*pb.LoginReply, error
 		}, nil
 	}
 
-	fmt.Println(tui.TitleStyle.Render("Authorized client:"), peerId.String())
-	s.P2pAuthedClients = append(s.P2pAuthedClients, peerId)
+	metrics.LoginAttempts.WithLabelValues("approved").Inc()
+
+	return &pb.LoginReply{Role: p.role.String()}, nil
+}
+
+func (s *Srv) LoginsList(ctx context.Context, req *pb.LoginsListReq) (*pb.LoginsListReply, error) {
+	var reply pb.LoginsListReply
+
+	for _, p := range s.pendingLogins() {
+		reply.Logins = append(reply.Logins, &pb.PendingLogin{
+			Peer:      p.id.String(),
+			Label:     p.label,
+			Requested: p.requested.Unix(),
+			Expires:   p.expires.Unix(),
+		})
+	}
+
+	return &reply, nil
+}
+
+func (s *Srv) LoginApprove(ctx context.Context, req *pb.LoginApproveReq) (*pb.LoginApproveReply, error) {
+	return &pb.LoginApproveReply{
+		Error: s.clientsCtl(ctx, "login approve", func() error {
+			r := roleNone
+			if !req.Reject {
+				var err error
+				if r, err = parseRole(req.Role); err != nil {
+					return err
+				}
+			}
 
-	_ = conf.Append(ctx, "AYUP_P2P_AUTHORIZED_CLIENTS", peerId.String())
+			p, err := s.findLogin(req.Client)
+			if err != nil {
+				return err
+			}
 
-	return &pb.LoginReply{}, nil
+			return s.decideLogin(ctx, p, r)
+		}),
+	}, nil
 }
@@ -0,0 +1,339 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	attr "go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+
+	ayFs "premai.io/Ayup/go/internal/fs"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// Hashes of the files received in previous uploads. So that we don't need to hash files again
+// unless they changed on disk.
+const manifestCacheName = "manifest.json"
+
+type manifestCacheEntry struct {
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+	Hash    []byte `json:"hash"`
+	ModTime int64  `json:"modTime"`
+}
+
+// Keyed by the source name and path e.g. app/main.py
+type manifestCache map[string]manifestCacheEntry
+
+func manifestKey(source pb.Source, path string) string {
+	return source.String() + "/" + filepath.ToSlash(path)
+}
+
+func (a *app) sourceDir(source pb.Source) (string, bool) {
+	switch source {
+	case pb.Source_app:
+		return a.AppDir, true
+	case pb.Source_assistant:
+		return a.AssistantDir, true
+	default:
+		return "", false
+	}
+}
+
+func (a *app) loadManifestCache(ctx context.Context) manifestCache {
+	cache := make(manifestCache)
+
+	bs, err := ayFs.ReadFile(ctx, a.root, manifestCacheName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			terror.Ackf(ctx, "ReadFile: %w", err)
+		}
+		return cache
+	}
+
+	if err := json.Unmarshal(bs, &cache); err != nil {
+		terror.Ackf(ctx, "json Unmarshal: %w", err)
+		return make(manifestCache)
+	}
+
+	return cache
+}
+
+func (a *app) saveManifestCache(ctx context.Context, cache manifestCache) error {
+	bs, err := json.Marshal(cache)
+	if err != nil {
+		return terror.Errorf(ctx, "json Marshal: %w", err)
+	}
+
+	return ayFs.WriteFile(ctx, bs, a.root, manifestCacheName)
+}
+
+// pruneSource deletes everything in a source's directory which is not in the manifest
+func pruneSource(ctx context.Context, dir string, source pb.Source, files map[string]*pb.ManifestEntry, dirs map[string]bool) error {
+	err := fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return terror.Errorf(ctx, "walkdir func(%s): %w", path, err)
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		key := manifestKey(source, path)
+		if d.IsDir() {
+			if dirs[key] {
+				return nil
+			}
+
+			trace.Event(ctx, "prune dir", attr.String("path", key))
+			if err := os.RemoveAll(filepath.Join(dir, path)); err != nil {
+				return terror.Errorf(ctx, "os RemoveAll: %w", err)
+			}
+			return fs.SkipDir
+		}
+
+		if _, ok := files[key]; ok {
+			return nil
+		}
+
+		trace.Event(ctx, "prune file", attr.String("path", key))
+		if err := os.Remove(filepath.Join(dir, path)); err != nil {
+			return terror.Errorf(ctx, "os Remove: %w", err)
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// haveEntry checks if the file on disk matches the manifest entry, using the cache if the file
+// has not changed since it was last hashed. If it matches, the returned entry can be cached. An
+// entry inside a symlinked directory is never present, otherwise the client could learn the
+// hashes of files outside of dir.
+func haveEntry(ctx context.Context, dir string, entry *pb.ManifestEntry, cached manifestCacheEntry, isCached bool) (bool, manifestCacheEntry, error) {
+	if err := rpc.CheckBeneath(dir, entry.Path); err != nil {
+		trace.Event(ctx, "entry not beneath", attr.String("path", entry.Path), attr.String("error", err.Error()))
+		return false, cached, nil
+	}
+
+	path := filepath.Join(dir, entry.Path)
+	info, err := os.Lstat(path)
+	if err != nil {
+		// A parent may be a file which will be pruned
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			return false, cached, nil
+		}
+		return false, cached, terror.Errorf(ctx, "os Lstat: %w", err)
+	}
+
+	switch entry.Type {
+	case pb.FileType_dir:
+		// Received directories always give the owner full access
+		return info.IsDir() && info.Mode().Perm() == fs.FileMode(entry.Mode)|0700, cached, nil
+	case pb.FileType_symlink:
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return false, cached, nil
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return false, cached, terror.Errorf(ctx, "os Readlink: %w", err)
+		}
+
+		return target == entry.Target, cached, nil
+	}
+
+	if !info.Mode().IsRegular() || info.Size() != entry.Size || uint32(info.Mode().Perm()) != entry.Mode {
+		return false, cached, nil
+	}
+
+	modTime := info.ModTime().UnixNano()
+	if !isCached || cached.Size != info.Size() || cached.ModTime != modTime {
+		hash, err := rpc.HashFile(ctx, path)
+		if err != nil {
+			return false, cached, err
+		}
+
+		cached = manifestCacheEntry{
+			Size:    info.Size(),
+			Mode:    uint32(info.Mode().Perm()),
+			Hash:    hash,
+			ModTime: modTime,
+		}
+	}
+
+	return bytes.Equal(cached.Hash, entry.Hash), cached, nil
+}
+
+func (s *Srv) UploadManifest(ctx context.Context, req *pb.Manifest) (*pb.ManifestReply, error) {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+	ctx, span := trace.Span(ctx, "upload manifest", attr.Int("entries", len(req.Entries)))
+	defer span.End()
+
+	sendError := func(msgf string, args ...any) (*pb.ManifestReply, error) {
+		oerr := terror.Errorf(ctx, msgf, args...)
+		return &pb.ManifestReply{
+			Error: newError(oerr),
+		}, nil
+	}
+
+	internalError := func(msgf string, args ...any) (*pb.ManifestReply, error) {
+		_ = terror.Errorf(ctx, msgf, args...)
+		return sendError("internal error")
+	}
+
+	if s.draining.Load() {
+		return sendError("%w", errShuttingDown)
+	}
+
+	a, err := s.getApp(ctx, req.App)
+	if err != nil {
+		return sendError("%w", err)
+	}
+	span.SetAttributes(attr.String("app", a.id))
+
+	if !a.busy.TryLock() {
+		return sendError("App busy: %s", a.id)
+	}
+	defer a.busy.Unlock()
+
+	files := make(map[string]*pb.ManifestEntry, len(req.Entries))
+	dirs := make(map[string]bool)
+	hasAssistant := false
+
+	for _, entry := range req.Entries {
+		if !filepath.IsLocal(entry.Path) {
+			return sendError("file path is not local: %s", entry.Path)
+		}
+
+		if _, ok := a.sourceDir(entry.Source); !ok {
+			return sendError("unrecognized source: %d", entry.Source)
+		}
+
+		if entry.Source == pb.Source_assistant {
+			hasAssistant = true
+		}
+
+		key := manifestKey(entry.Source, entry.Path)
+		if entry.Type == pb.FileType_dir {
+			dirs[key] = true
+		} else {
+			files[key] = entry
+		}
+		for dir := filepath.Dir(entry.Path); dir != "."; dir = filepath.Dir(dir) {
+			dirs[manifestKey(entry.Source, dir)] = true
+		}
+	}
+
+	oldCache := a.loadManifestCache(ctx)
+	cache := make(manifestCache, len(req.Entries))
+	var missing []*pb.ManifestEntry
+
+	for _, entry := range req.Entries {
+		dir, _ := a.sourceDir(entry.Source)
+		key := manifestKey(entry.Source, entry.Path)
+		cached, isCached := oldCache[key]
+
+		have, cached, err := haveEntry(ctx, dir, entry, cached, isCached)
+		if err != nil {
+			return internalError("haveEntry: %w", err)
+		}
+
+		if !have {
+			missing = append(missing, entry)
+		} else if entry.Type == pb.FileType_regular {
+			cache[key] = cached
+		}
+	}
+
+	span.SetAttributes(attr.Int("missing", len(missing)))
+
+	owner := peerName(ctx)
+	if err := s.manifestQuota(ctx, a, owner, req.Entries, missing); err != nil {
+		var qerr *quotaError
+		if errors.As(err, &qerr) {
+			return sendError("%w", err)
+		}
+		return internalError("manifestQuota: %w", err)
+	}
+
+	// Only once the upload is allowed are the files which are no longer in the app deleted
+	for _, source := range []pb.Source{pb.Source_app, pb.Source_assistant} {
+		dir, _ := a.sourceDir(source)
+		if err := pruneSource(ctx, dir, source, files, dirs); err != nil {
+			return internalError("pruneSource: %w", err)
+		}
+	}
+	a.changedUsage()
+
+	if err := a.setOwner(ctx, owner); err != nil {
+		return internalError("setOwner: %w", err)
+	}
+
+	if err := a.saveManifestCache(ctx, cache); err != nil {
+		return internalError("saveManifestCache: %w", err)
+	}
+
+	a.hasAssistant = hasAssistant
+	a.pendingManifest = missing
+
+	return &pb.ManifestReply{Missing: missing, Accept: rpc.AcceptCompression}, nil
+}
+
+// finishManifest caches the hashes of the files which were missing after they are uploaded
+func (a *app) finishManifest(ctx context.Context) error {
+	entries := a.pendingManifest
+	if entries == nil {
+		return nil
+	}
+	a.pendingManifest = nil
+
+	cache := a.loadManifestCache(ctx)
+	for _, entry := range entries {
+		if entry.Type != pb.FileType_regular {
+			continue
+		}
+
+		dir, _ := a.sourceDir(entry.Source)
+		if err := rpc.CheckBeneath(dir, entry.Path); err != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Path)
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return terror.Errorf(ctx, "os Lstat: %w", err)
+		}
+
+		hash, err := rpc.HashFile(ctx, path)
+		if err != nil {
+			return err
+		}
+
+		cache[manifestKey(entry.Source, entry.Path)] = manifestCacheEntry{
+			Size:    info.Size(),
+			Mode:    uint32(info.Mode().Perm()),
+			Hash:    hash,
+			ModTime: info.ModTime().UnixNano(),
+		}
+	}
+
+	return a.saveManifestCache(ctx, cache)
+}
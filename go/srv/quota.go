@@ -0,0 +1,384 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	attr "go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+
+	ayFs "premai.io/Ayup/go/internal/fs"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// The quotas' names as shown to the client
+const (
+	quotaUpload  = "upload"
+	quotaApps    = "apps"
+	quotaScratch = "scratch"
+)
+
+// The file in an app's root which records the client that last uploaded it
+const ownerName = "owner"
+
+// Quotas limit the disk space each client can use, in bytes. Zero means unlimited. Clients which
+// connect without libp2p share one set of quotas.
+type Quotas struct {
+	// The amount of data in a single upload
+	Upload int64
+	// The space taken by the client's apps, not including their scratch directories
+	Apps int64
+	// The space taken by the scratch directories of the client's apps. It's checked before the
+	// assistants run, so a build can go over it once.
+	Scratch int64
+}
+
+func (s Quotas) limit(name string) int64 {
+	switch name {
+	case quotaUpload:
+		return s.Upload
+	case quotaApps:
+		return s.Apps
+	case quotaScratch:
+		return s.Scratch
+	default:
+		return 0
+	}
+}
+
+// check returns a quotaError if used is over the named quota
+func (s Quotas) check(name string, used int64) error {
+	limit := s.limit(name)
+	if limit < 1 || used <= limit {
+		return nil
+	}
+
+	return &quotaError{
+		usage: &pb.QuotaUsage{
+			Name:  name,
+			Limit: limit,
+			Used:  used,
+		},
+	}
+}
+
+type quotaError struct {
+	usage *pb.QuotaUsage
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf(
+		"%s quota exceeded: %s of %s",
+		e.usage.Name,
+		units.BytesSize(float64(e.usage.Used)),
+		units.BytesSize(float64(e.usage.Limit)),
+	)
+}
+
+// newError converts err to an error reply, which says which quota was exceeded if that's the cause
+func newError(err error) *pb.Error {
+	rerr := &pb.Error{Error: err.Error()}
+
+	var qerr *quotaError
+	if errors.As(err, &qerr) {
+		rerr.Quota = qerr.usage
+	}
+
+	return rerr
+}
+
+// dirSize is the total size of the regular files in dir, except those in skip
+func dirSize(ctx context.Context, dir string, skip string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may be deleted while we walk
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return terror.Errorf(ctx, "walkdir func(%s): %w", path, err)
+		}
+
+		if d.IsDir() && path == skip {
+			return fs.SkipDir
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return terror.Errorf(ctx, "dir info: %w", err)
+		}
+		size += info.Size()
+
+		return nil
+	})
+
+	return size, err
+}
+
+func (a *app) getOwner() string {
+	a.uploadMutex.Lock()
+	defer a.uploadMutex.Unlock()
+
+	return a.owner
+}
+
+// setOwner records which client's quotas the app counts against
+func (a *app) setOwner(ctx context.Context, owner string) error {
+	a.uploadMutex.Lock()
+	defer a.uploadMutex.Unlock()
+
+	if a.owner == owner {
+		return nil
+	}
+	a.owner = owner
+
+	return ayFs.WriteFile(ctx, []byte(owner), a.root, ownerName)
+}
+
+func (a *app) loadOwner(ctx context.Context) error {
+	bs, err := ayFs.ReadFile(ctx, a.root, ownerName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	a.owner = strings.TrimSpace(string(bs))
+
+	return nil
+}
+
+// transferApps makes the apps owned by the client's old peer ID count against its new one, after
+// the client rotated its key
+func (s *Srv) transferApps(ctx context.Context, old string, new string) error {
+	for _, a := range s.allApps() {
+		if a.getOwner() != old {
+			continue
+		}
+
+		trace.Event(ctx, "transfer app", attr.String("app", a.id))
+
+		if err := a.setOwner(ctx, new); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type diskUsage struct {
+	apps    int64
+	scratch int64
+}
+
+// How long the size of an app's scratch directory is cached for. Unlike the rest of the app, it
+// changes while the app runs, so it can't be walked again only when it changes.
+const scratchUsageTTL = time.Minute
+
+// cachedUsage is an app's disk usage from when its directories were last walked
+type cachedUsage struct {
+	diskUsage
+	// Cleared by changedUsage
+	hasApps   bool
+	scratchAt time.Time
+}
+
+// diskUsage returns the space used by the app, only its directories which changed since they
+// were last walked are walked again. The scratch directory is only walked if scratch is set.
+func (a *app) diskUsage(ctx context.Context, scratch bool) (diskUsage, error) {
+	a.usageMutex.Lock()
+	defer a.usageMutex.Unlock()
+
+	if !a.usage.hasApps {
+		size, err := dirSize(ctx, a.root, a.ScratchDir)
+		if err != nil {
+			return diskUsage{}, err
+		}
+		a.usage.apps = size
+		a.usage.hasApps = true
+	}
+
+	if scratch && time.Since(a.usage.scratchAt) >= scratchUsageTTL {
+		size, err := dirSize(ctx, a.ScratchDir, "")
+		if err != nil {
+			return diskUsage{}, err
+		}
+		a.usage.scratch = size
+		a.usage.scratchAt = time.Now()
+	}
+
+	return a.usage.diskUsage, nil
+}
+
+// changedUsage is called after the app's files change, so that they are walked again the next
+// time its usage is needed
+func (a *app) changedUsage() {
+	a.usageMutex.Lock()
+	defer a.usageMutex.Unlock()
+
+	a.usage.hasApps = false
+	a.usage.scratchAt = time.Time{}
+}
+
+// peerUsage adds up the disk space used by the apps the peer owns, the scratch directories are
+// only included if scratch is set
+func (s *Srv) peerUsage(ctx context.Context, peer string, scratch bool) (diskUsage, error) {
+	ctx, span := trace.Span(ctx, "peer usage", attr.String("peer", peer))
+	defer span.End()
+
+	var usage diskUsage
+	for _, a := range s.allApps() {
+		if a.getOwner() != peer {
+			continue
+		}
+
+		appUsage, err := a.diskUsage(ctx, scratch)
+		if err != nil {
+			return usage, err
+		}
+
+		usage.apps += appUsage.apps
+		if scratch {
+			usage.scratch += appUsage.scratch
+		}
+	}
+
+	span.SetAttributes(attr.Int64("apps", usage.apps), attr.Int64("scratch", usage.scratch))
+
+	return usage, nil
+}
+
+// manifestQuota checks that uploading the files missing from the manifest won't exceed the
+// owner's quotas. The app's new size is taken to be the size of all the files in the manifest.
+func (s *Srv) manifestQuota(ctx context.Context, a *app, owner string, entries []*pb.ManifestEntry, missing []*pb.ManifestEntry) error {
+	var upload, total int64
+	for _, entry := range missing {
+		upload += entry.Size
+	}
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	if err := s.Quotas.check(quotaUpload, upload); err != nil {
+		return err
+	}
+
+	if s.Quotas.Apps < 1 {
+		return nil
+	}
+
+	usage, err := s.peerUsage(ctx, owner, false)
+	if err != nil {
+		return err
+	}
+
+	// Replace the size of the app's source with what it will be after the upload
+	if a.getOwner() == owner {
+		for _, dir := range []string{a.AppDir, a.AssistantDir} {
+			size, err := dirSize(ctx, dir, "")
+			if err != nil {
+				return err
+			}
+			usage.apps -= size
+		}
+	}
+
+	return s.Quotas.check(quotaApps, usage.apps+total)
+}
+
+// uploadQuota returns a function for the file receiver which checks the data received against
+// the owner's quotas. A full upload replaces the app's source, which only counts against owner if
+// they already own the app. Sent is how much was received before the upload was resumed.
+func (s *Srv) uploadQuota(ctx context.Context, a *app, owner string, full bool, sent int64) (func(n int64) error, error) {
+	var stored int64
+	if s.Quotas.Apps > 0 {
+		// The app is walked again to include what was received before the upload was resumed
+		a.changedUsage()
+
+		usage, err := s.peerUsage(ctx, owner, false)
+		if err != nil {
+			return nil, err
+		}
+		stored = usage.apps
+
+		// What was sent is only in the usage if owner already owns the app
+		if a.getOwner() != owner {
+			stored += sent
+		} else if full {
+			for _, dir := range []string{a.AppDir, a.AssistantDir} {
+				size, err := dirSize(ctx, dir, "")
+				if err != nil {
+					return nil, err
+				}
+				stored -= size
+			}
+		}
+	}
+
+	received := sent
+	return func(n int64) error {
+		received += n
+
+		if err := s.Quotas.check(quotaUpload, received); err != nil {
+			return err
+		}
+
+		return s.Quotas.check(quotaApps, stored+received-sent)
+	}, nil
+}
+
+// scratchQuota checks the app's owner has not used up their scratch quota before running the
+// assistants
+func (s *Srv) scratchQuota(ctx context.Context, a *app) error {
+	if s.Quotas.Scratch < 1 {
+		return nil
+	}
+
+	usage, err := s.peerUsage(ctx, a.getOwner(), true)
+	if err != nil {
+		return err
+	}
+
+	return s.Quotas.check(quotaScratch, usage.scratch)
+}
+
+func (s *Srv) ServerInfo(ctx context.Context, req *pb.ServerInfoReq) (*pb.ServerInfoReply, error) {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+	ctx, span := trace.Span(ctx, "server info")
+	defer span.End()
+
+	peer := peerName(ctx)
+	usage, err := s.peerUsage(ctx, peer, true)
+	if err != nil {
+		return &pb.ServerInfoReply{Error: newInternalError(ctx, "peerUsage: %w", err)}, nil
+	}
+
+	return &pb.ServerInfoReply{
+		Peer:    peer,
+		Role:    contextRole(ctx).String(),
+		Handoff: s.handoff(),
+		Quotas: []*pb.QuotaUsage{
+			{Name: quotaUpload, Limit: s.Quotas.Upload},
+			{Name: quotaApps, Limit: s.Quotas.Apps, Used: usage.apps},
+			{Name: quotaScratch, Limit: s.Quotas.Scratch, Used: usage.scratch},
+		},
+	}, nil
+}
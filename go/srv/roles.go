@@ -0,0 +1,182 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
+	attr "go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// role is what a peer is allowed to do, each role can do everything the ones before it can
+type role int
+
+const (
+	roleNone role = iota
+	// List assistants, see the server info and attach to sessions to read their logs
+	roleViewer
+	// Push, download, forward and control apps, and set their secrets
+	roleDeveloper
+	// Replace assistants and set their secrets, manage the clients and approve logins
+	roleAdmin
+)
+
+var roleNames = map[role]string{
+	roleNone:      "none",
+	roleViewer:    "viewer",
+	roleDeveloper: "developer",
+	roleAdmin:     "admin",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(name string) (role, error) {
+	for r, n := range roleNames {
+		if r != roleNone && n == name {
+			return r, nil
+		}
+	}
+
+	return roleNone, fmt.Errorf("unknown role: %s, use viewer, developer or admin", name)
+}
+
+// The role needed to call each method, methods not listed need admin
+var methodRoles = map[string]role{
+	pb.Srv_Login_FullMethodName:           roleNone,
+	pb.Srv_ServerInfo_FullMethodName:      roleViewer,
+	pb.Srv_ClientRotateKey_FullMethodName: roleViewer,
+	pb.Srv_AssistantsList_FullMethodName:  roleViewer,
+	// Pushing needs developer, which Assist checks because attaching only needs viewer
+	pb.Srv_Assist_FullMethodName:         roleViewer,
+	pb.Srv_UploadManifest_FullMethodName: roleDeveloper,
+	pb.Srv_Upload_FullMethodName:         roleDeveloper,
+	pb.Srv_UploadProgress_FullMethodName: roleDeveloper,
+	pb.Srv_Download_FullMethodName:       roleDeveloper,
+	pb.Srv_Forward_FullMethodName:        roleDeveloper,
+	pb.Srv_AppStart_FullMethodName:       roleDeveloper,
+	pb.Srv_AppStop_FullMethodName:        roleDeveloper,
+	pb.Srv_AppRestart_FullMethodName:     roleDeveloper,
+	// An assistant's secrets need admin, which secretScope checks
+	pb.Srv_SecretsSet_FullMethodName:     roleDeveloper,
+	pb.Srv_SecretsList_FullMethodName:    roleDeveloper,
+	pb.Srv_SecretsRm_FullMethodName:      roleDeveloper,
+	pb.Srv_AssistantsPush_FullMethodName: roleAdmin,
+	pb.Srv_ClientsList_FullMethodName:    roleAdmin,
+	pb.Srv_ClientsRevoke_FullMethodName:  roleAdmin,
+	pb.Srv_ClientsRename_FullMethodName:  roleAdmin,
+	pb.Srv_ClientsSetRole_FullMethodName: roleAdmin,
+	pb.Srv_LoginsList_FullMethodName:     roleAdmin,
+	pb.Srv_LoginApprove_FullMethodName:   roleAdmin,
+	pb.Srv_InviteCreate_FullMethodName:   roleAdmin,
+}
+
+type roleKey struct{}
+
+// peerRole returns the role of the peer which sent the request, roleNone if it is not authorized
+func (s *Srv) peerRole(ctx context.Context) (role, error) {
+	span := tr.SpanFromContext(ctx)
+
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return roleNone, fmt.Errorf("failed to get peer info from context")
+	}
+
+	if pr.Addr.Network() != gostream.Network {
+		trace.Event(ctx, "Authorized due to insecure transport")
+
+		return roleAdmin, nil
+	}
+
+	peerIdStr := pr.Addr.String()
+	span.SetAttributes(attr.String("peerId", peerIdStr))
+
+	peerId, err := p2pPeer.Decode(peerIdStr)
+	if err != nil {
+		return roleNone, terror.Errorf(ctx, "peer Decode: %w", err)
+	}
+
+	r := s.clients.role(peerId)
+	if r == roleNone {
+		trace.Event(ctx, "No authorized peer IDs match")
+	} else {
+		trace.Event(ctx, "Authorized due to ID match", attr.String("role", r.String()))
+	}
+
+	return r, nil
+}
+
+// contextRole is the role authorize found for the peer, the context must be the one passed to
+// the handler
+func contextRole(ctx context.Context) role {
+	have, _ := ctx.Value(roleKey{}).(role)
+	return have
+}
+
+// hasRole says if the peer has at least role r
+func hasRole(ctx context.Context, r role) bool {
+	return contextRole(ctx) >= r
+}
+
+// authorize checks the peer has the role needed to call method and adds the role to the context
+func (s *Srv) authorize(ctx context.Context, method string) (context.Context, error) {
+	need, ok := methodRoles[method]
+	if !ok {
+		need = roleAdmin
+	}
+
+	have, err := s.peerRole(ctx)
+	if err != nil {
+		return ctx, status.Error(codes.Internal, newInternalError(ctx, "peerRole: %w", err).Error)
+	}
+
+	if have < need {
+		trace.Event(ctx, "Permission denied", attr.String("method", method), attr.String("role", have.String()))
+
+		if have == roleNone {
+			return ctx, status.Error(codes.Unauthenticated, "Not authorized, use 'ay login' first")
+		}
+
+		return ctx, status.Errorf(codes.PermissionDenied, "Not allowed, this needs the %s role and this client has the %s role", need, have)
+	}
+
+	return context.WithValue(ctx, roleKey{}, have), nil
+}
+
+func (s *Srv) unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Srv) streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+}
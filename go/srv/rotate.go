@@ -0,0 +1,169 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+
+	"premai.io/Ayup/go/internal/conf"
+	"premai.io/Ayup/go/internal/fs"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// loadHandoff reads the handoff saved by the last key rotation. It is served to clients while the
+// daemon runs with the old key and after it restarts with the new one.
+func (s *Srv) loadHandoff(ctx context.Context) error {
+	if s.p2pHost == nil || s.KeyHandoffFile == "" {
+		return nil
+	}
+
+	bs, err := fs.ReadFile(ctx, s.KeyHandoffFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	text := string(bs)
+	h, err := rpc.ParseHandoff(text)
+	if err != nil {
+		return terror.Errorf(ctx, "rpc ParseHandoff(%s): %w", s.KeyHandoffFile, err)
+	}
+
+	// The key was changed some other way since
+	if id := s.p2pHost.ID(); h.Old != id && h.New != id {
+		trace.Event(ctx, "ignoring stale key handoff", attribute.String("new", h.New.String()))
+		return nil
+	}
+
+	s.keyHandoff.Store(&text)
+
+	return nil
+}
+
+// handoff returns the last key rotation's handoff or an empty string
+func (s *Srv) handoff() string {
+	if h := s.keyHandoff.Load(); h != nil {
+		return *h
+	}
+
+	return ""
+}
+
+func (s *Srv) ClientRotateKey(ctx context.Context, req *pb.ClientRotateKeyReq) (*pb.ClientRotateKeyReply, error) {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+	ctx, span := trace.Span(ctx, "client rotate key")
+	defer span.End()
+
+	if s.p2pHost == nil || peerName(ctx) == "local" {
+		return &pb.ClientRotateKeyReply{
+			Error: &pb.Error{Error: "Only clients connected with libp2p have a key to rotate"},
+		}, nil
+	}
+
+	caller, err := remotePeerId(ctx)
+	if err != nil {
+		return &pb.ClientRotateKeyReply{Error: newInternalError(ctx, "remotePeerId: %w", err)}, nil
+	}
+
+	h, err := rpc.ParseHandoff(req.Handoff)
+	if err != nil {
+		return &pb.ClientRotateKeyReply{Error: newError(err)}, nil
+	}
+
+	if h.Old != caller {
+		return &pb.ClientRotateKeyReply{Error: newError(fmt.Errorf("the handoff is from %s, not this client", h.Old))}, nil
+	}
+
+	if h.For != s.p2pHost.ID() {
+		return &pb.ClientRotateKeyReply{Error: newError(fmt.Errorf("the handoff is for the server %s, not this one", h.For))}, nil
+	}
+
+	if err := s.clients.rotate(ctx, h.Old, h.New); err != nil {
+		return &pb.ClientRotateKeyReply{Error: newError(err)}, nil
+	}
+
+	// The rotation has happened, so failing to move an app is only logged. The app moves to the
+	// new ID when it is next uploaded.
+	terror.Ackf(ctx, "transferApps: %w", s.transferApps(ctx, h.Old.String(), h.New.String()))
+
+	trace.Event(ctx, "rotated client key", attribute.String("old", h.Old.String()), attribute.String("new", h.New.String()))
+
+	return &pb.ClientRotateKeyReply{}, nil
+}
+
+// ServerRotateKey creates the daemon's next key and a handoff signed by the current and next
+// keys. The next key is saved where the current one was loaded from, the env file or key file,
+// and used after the daemon restarts. Until then clients can fetch the handoff with the current
+// key, afterwards it has to be given to them.
+func (s *Srv) ServerRotateKey(ctx context.Context, req *pb.ServerRotateKeyReq) (*pb.ServerRotateKeyReply, error) {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+	ctx, span := trace.Span(ctx, "server rotate key")
+	defer span.End()
+
+	if s.p2pHost == nil {
+		return &pb.ServerRotateKeyReply{
+			Error: &pb.Error{Error: "The daemon doesn't have a key unless it listens with libp2p, see 'ay daemon start --help'"},
+		}, nil
+	}
+
+	// A key set some other way would override the saved one after a restart
+	if s.P2pPrivKeySource != "" {
+		return &pb.ServerRotateKeyReply{
+			Error: &pb.Error{Error: fmt.Sprintf("The daemon's key was set by %s, it can only be rotated when it is kept in the env file or an encrypted key file", s.P2pPrivKeySource)},
+		}, nil
+	}
+
+	oldKey := s.p2pHost.Peerstore().PrivKey(s.p2pHost.ID())
+	if oldKey == nil {
+		return &pb.ServerRotateKeyReply{Error: newInternalError(ctx, "the host's private key is missing")}, nil
+	}
+
+	newKey, b64Key, err := rpc.GenerateKey()
+	if err != nil {
+		return &pb.ServerRotateKeyReply{Error: newInternalError(ctx, "rpc GenerateKey: %w", err)}, nil
+	}
+
+	handoff, err := rpc.NewHandoff(oldKey, newKey, "")
+	if err != nil {
+		return &pb.ServerRotateKeyReply{Error: newInternalError(ctx, "rpc NewHandoff: %w", err)}, nil
+	}
+
+	// The handoff is saved first, the key is no use to clients without it
+	if err := fs.WriteFile(ctx, []byte(handoff), s.KeyHandoffFile); err != nil {
+		return &pb.ServerRotateKeyReply{Error: newInternalError(ctx, "fs WriteFile: %w", err)}, nil
+	}
+
+	if err := s.saveKey(ctx, b64Key); err != nil {
+		terror.Ackf(ctx, "os Remove: %w", os.Remove(s.KeyHandoffFile))
+		return &pb.ServerRotateKeyReply{Error: newInternalError(ctx, "saveKey: %w", err)}, nil
+	}
+
+	s.keyHandoff.Store(&handoff)
+
+	newId, err := p2pPeer.IDFromPrivateKey(newKey)
+	if err != nil {
+		return &pb.ServerRotateKeyReply{Error: newInternalError(ctx, "peer IDFromPrivateKey: %w", err)}, nil
+	}
+
+	trace.Event(ctx, "rotated server key", attribute.String("new", newId.String()))
+
+	return &pb.ServerRotateKeyReply{Handoff: handoff, Peer: newId.String()}, nil
+}
+
+// saveKey replaces the daemon's key where it was loaded from. It never asks for a passphrase,
+// because there is no one at the daemon's terminal to answer.
+func (s *Srv) saveKey(ctx context.Context, b64Key string) error {
+	if s.keyInFile {
+		return conf.SaveKeyFile(ctx, "AYUP_SERVER_P2P_PRIV_KEY", b64Key)
+	}
+
+	return conf.Set(ctx, "AYUP_SERVER_P2P_PRIV_KEY", b64Key)
+}
@@ -0,0 +1,237 @@
+package srv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+
+	"premai.io/Ayup/go/assistants/exec"
+	"premai.io/Ayup/go/internal/assist"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// How long an app has to exit after being sent the stop signal before it is killed, unless
+// Srv.StopTimeout is set
+const appStopTimeout = 10 * time.Second
+
+// A run of an app which is owned by the daemon instead of a client's Assist stream
+type appRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// setBuilt records the state an app was in when it was ready to be executed, so that it can
+// be started again without another push or after the daemon restarts
+func (a *app) setBuilt(ctx context.Context, state assist.State) error {
+	a.runMutex.Lock()
+	defer a.runMutex.Unlock()
+
+	a.built = &state
+
+	return state.SaveBuilt(ctx, a.builtDir())
+}
+
+func (a *app) running() bool {
+	a.runMutex.Lock()
+	defer a.runMutex.Unlock()
+
+	return a.runningLocked()
+}
+
+func (a *app) runningLocked() bool {
+	if a.run == nil {
+		return false
+	}
+
+	select {
+	case <-a.run.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// startApp executes the last build of an app in the background. The app keeps running until it
+// exits, it is stopped or the daemon shuts down.
+func (s *Srv) startApp(ctx context.Context, a *app) error {
+	a.runMutex.Lock()
+	defer a.runMutex.Unlock()
+
+	if a.runningLocked() {
+		return terror.Errorf(ctx, "app is already running: %s", a.id)
+	}
+
+	if a.built == nil {
+		return terror.Errorf(ctx, "app has not been built, push it first: %s", a.id)
+	}
+	// The state directory is moved back into the app directory after the assistants finish
+	state := a.built.WithPath(a.built.SrcPath)
+
+	runCtx, cancel := context.WithCancel(s.appsCtx)
+	runCtx, span := trace.LinkedSpan(runCtx, "detached app", tr.SpanFromContext(ctx), true, attribute.String("app", a.id))
+
+	c, err := client.New(runCtx, s.BuildkitdAddr)
+	if err != nil {
+		span.End()
+		cancel()
+		return terror.Errorf(ctx, "client New: %w", err)
+	}
+
+	if err := a.setWantRunning(ctx, true); err != nil {
+		span.End()
+		cancel()
+		return err
+	}
+
+	run := &appRun{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	a.run = run
+
+	go func() {
+		// If the app exits by itself then it should not be restarted with the daemon
+		defer func() {
+			if s.appsCtx.Err() != nil || s.draining.Load() {
+				return
+			}
+
+			a.runMutex.Lock()
+			defer a.runMutex.Unlock()
+
+			if a.run == run {
+				terror.Ackf(runCtx, "setWantRunning: %w", a.setWantRunning(runCtx, false))
+			}
+		}()
+		defer close(run.done)
+		defer span.End()
+		defer cancel()
+		defer func() { terror.Ackf(runCtx, "client Close: %w", c.Close()) }()
+
+		aCtx := assist.Context{
+			Ctx:         runCtx,
+			SendMutex:   &sync.Mutex{},
+			Client:      c,
+			AppId:       a.id,
+			AppPath:     a.AppDir,
+			StatePath:   state.Path,
+			ScratchPath: a.ScratchDir,
+			Procs:       a.procs,
+		}
+
+		execAssist := exec.Assistant{}
+		_, run.err = execAssist.Assist(aCtx, state)
+
+		trace.Event(runCtx, "detached app exited")
+	}()
+
+	return nil
+}
+
+// stopApp sends the stop signal to a detached app and waits for it to exit. If it takes too long
+// then the app's container is killed.
+func (s *Srv) stopApp(ctx context.Context, a *app) error {
+	a.runMutex.Lock()
+	defer a.runMutex.Unlock()
+
+	if !a.runningLocked() {
+		return terror.Errorf(ctx, "app is not running in the background: %s", a.id)
+	}
+	run := a.run
+
+	if err := a.procs.Signal(ctx, s.StopSignal); err != nil {
+		terror.Ackf(ctx, "procs Signal: %w", err)
+	}
+
+	select {
+	case <-run.done:
+	case <-time.After(s.StopTimeout):
+		trace.Event(ctx, "app did not stop in time, killing it")
+		run.cancel()
+		<-run.done
+	}
+
+	a.run = nil
+
+	return a.setWantRunning(ctx, false)
+}
+
+// newInternalError logs the error and returns one which only gives the user the ID to look it up
+func newInternalError(ctx context.Context, msgf string, args ...any) *pb.Error {
+	_ = terror.Errorf(ctx, msgf, args...)
+	span := tr.SpanFromContext(ctx)
+	return &pb.Error{Error: "Internal Error: Support ID: " + span.SpanContext().SpanID().String()}
+}
+
+// appCtl runs f with the requested app. Errors are converted to a message which can be shown
+// to the user.
+func (s *Srv) appCtl(ctx context.Context, appId string, f func(a *app) error) *pb.Error {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+
+	a, err := s.lookupApp(ctx, appId)
+	if err != nil {
+		return &pb.Error{Error: err.Error()}
+	}
+	tr.SpanFromContext(ctx).SetAttributes(attribute.String("app", a.id))
+
+	if err := f(a); err != nil {
+		return newError(err)
+	}
+
+	return nil
+}
+
+func (s *Srv) AppStart(ctx context.Context, req *pb.AppStartReq) (*pb.AppStartResp, error) {
+	return &pb.AppStartResp{
+		Error: s.appCtl(ctx, req.App, func(a *app) error {
+			if s.draining.Load() {
+				return errShuttingDown
+			}
+
+			if !a.busy.TryLock() {
+				return terror.Errorf(ctx, "App busy: %s", a.id)
+			}
+			defer a.busy.Unlock()
+
+			return s.startApp(ctx, a)
+		}),
+	}, nil
+}
+
+func (s *Srv) AppStop(ctx context.Context, req *pb.AppStopReq) (*pb.AppStopResp, error) {
+	return &pb.AppStopResp{
+		Error: s.appCtl(ctx, req.App, func(a *app) error {
+			return s.stopApp(ctx, a)
+		}),
+	}, nil
+}
+
+func (s *Srv) AppRestart(ctx context.Context, req *pb.AppRestartReq) (*pb.AppRestartResp, error) {
+	return &pb.AppRestartResp{
+		Error: s.appCtl(ctx, req.App, func(a *app) error {
+			if s.draining.Load() {
+				return errShuttingDown
+			}
+
+			if !a.busy.TryLock() {
+				return terror.Errorf(ctx, "App busy: %s", a.id)
+			}
+			defer a.busy.Unlock()
+
+			if a.running() {
+				if err := s.stopApp(ctx, a); err != nil {
+					return err
+				}
+			}
+
+			return s.startApp(ctx, a)
+		}),
+	}, nil
+}
@@ -0,0 +1,321 @@
+package srv
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"premai.io/Ayup/go/internal/assist"
+	"premai.io/Ayup/go/internal/fs"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// Secrets are given to assistants as environment variables, so their names have to be valid ones
+var secretNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,127}$`)
+
+// The largest secret value which can be set
+const maxSecretSize = 64 * 1024
+
+// sealedSecret is a secret encrypted with the store's key. The scope and name are authenticated
+// with it, so it can't be moved to another app or assistant.
+type sealedSecret struct {
+	Nonce   []byte    `json:"nonce"`
+	Sealed  []byte    `json:"sealed"`
+	Updated time.Time `json:"updated"`
+}
+
+// secretStore is the persisted secrets of each app and assistant. The values are encrypted with
+// a key kept in a separate file, so the store can be backed up or copied without revealing them.
+type secretStore struct {
+	path string
+	aead cipher.AEAD
+
+	mutex sync.Mutex
+	// Keyed by the scope, e.g. app/hello or assistant/local:prem, then by the secret's name
+	scopes map[string]map[string]*sealedSecret
+}
+
+// loadSecretsKey reads the key the secrets are encrypted with, it is created on first use
+func loadSecretsKey(ctx context.Context, path string) ([]byte, error) {
+	key, err := fs.ReadFile(ctx, path)
+	if err == nil {
+		if len(key) != chacha20poly1305.KeySize {
+			return nil, terror.Errorf(ctx, "%s should be %d bytes, not %d", path, chacha20poly1305.KeySize, len(key))
+		}
+
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, terror.Errorf(ctx, "rand Read: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+
+	if err := fs.WriteFile(ctx, key, path); err != nil {
+		return nil, err
+	}
+
+	trace.Event(ctx, "created secrets key", attribute.String("path", path))
+
+	return key, nil
+}
+
+func loadSecrets(ctx context.Context, path string, keyPath string) (*secretStore, error) {
+	key, err := loadSecretsKey(ctx, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "chacha20poly1305 NewX: %w", err)
+	}
+
+	c := &secretStore{
+		path:   path,
+		aead:   aead,
+		scopes: make(map[string]map[string]*sealedSecret),
+	}
+
+	bs, err := fs.ReadFile(ctx, path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bs, &c.scopes); err != nil {
+		return nil, terror.Errorf(ctx, "json Unmarshal(%s): %w", path, err)
+	}
+
+	return c, nil
+}
+
+func (c *secretStore) saveLocked(ctx context.Context) error {
+	bs, err := json.MarshalIndent(c.scopes, "", "  ")
+	if err != nil {
+		return terror.Errorf(ctx, "json Marshal: %w", err)
+	}
+
+	tmpPath := c.path + ".tmp"
+	if err := fs.WriteFile(ctx, bs, tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return terror.Errorf(ctx, "os Rename: %w", err)
+	}
+
+	return nil
+}
+
+// additionalData binds a sealed secret to its scope and name
+func additionalData(scope string, name string) []byte {
+	return []byte(scope + "\x00" + name)
+}
+
+func (c *secretStore) set(ctx context.Context, scope string, name string, value string) error {
+	if !secretNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid secret name `%s`: it should be an environment variable name, e.g. API_KEY", name)
+	}
+
+	if len(value) > maxSecretSize {
+		return fmt.Errorf("the secret is %d bytes, the most allowed is %d", len(value), maxSecretSize)
+	}
+
+	secret := sealedSecret{
+		Nonce:   make([]byte, chacha20poly1305.NonceSizeX),
+		Updated: time.Now(),
+	}
+	if _, err := rand.Read(secret.Nonce); err != nil {
+		return terror.Errorf(ctx, "rand Read: %w", err)
+	}
+	secret.Sealed = c.aead.Seal(nil, secret.Nonce, []byte(value), additionalData(scope, name))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	secrets, ok := c.scopes[scope]
+	if !ok {
+		secrets = make(map[string]*sealedSecret)
+		c.scopes[scope] = secrets
+	}
+	secrets[name] = &secret
+
+	return c.saveLocked(ctx)
+}
+
+func (c *secretStore) rm(ctx context.Context, scope string, name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.scopes[scope][name]; !ok {
+		return fmt.Errorf("no secret named %s", name)
+	}
+
+	delete(c.scopes[scope], name)
+	if len(c.scopes[scope]) == 0 {
+		delete(c.scopes, scope)
+	}
+
+	return c.saveLocked(ctx)
+}
+
+// list returns the names of the scope's secrets and when they were set, sorted by name
+func (c *secretStore) list(scope string) []*pb.SecretInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	infos := make([]*pb.SecretInfo, 0, len(c.scopes[scope]))
+	for name, secret := range c.scopes[scope] {
+		infos = append(infos, &pb.SecretInfo{Name: name, Updated: secret.Updated.Unix()})
+	}
+	slices.SortFunc(infos, func(a, b *pb.SecretInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return infos
+}
+
+// open decrypts the scope's secrets and adds them to values
+func (c *secretStore) open(ctx context.Context, scope string, values map[string][]byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for name, secret := range c.scopes[scope] {
+		value, err := c.aead.Open(nil, secret.Nonce, secret.Sealed, additionalData(scope, name))
+		if err != nil {
+			return terror.Errorf(ctx, "The secret %s of %s can't be decrypted, it may be corrupted", name, scope)
+		}
+
+		values[name] = value
+	}
+
+	return nil
+}
+
+// forAssistant returns the secrets an assistant gets when it runs on an app. The app's secrets
+// take precedence over the assistant's. An assistant uploaded with the app only gets the app's,
+// because whoever pushed it chose its name.
+func (c *secretStore) forAssistant(ctx context.Context, appId string, assistant string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+
+	if !strings.HasPrefix(assistant, string(assist.App)+":") {
+		if err := c.open(ctx, "assistant/"+assistant, values); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.open(ctx, "app/"+appId, values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// secretScope checks the scope and that the caller may change it. Assistants are shared by all
+// apps, so only admins can change their secrets.
+func secretScope(ctx context.Context, scope *pb.SecretScope) (string, error) {
+	if scope.GetApp() != "" && scope.GetAssistant() != "" {
+		return "", fmt.Errorf("a secret belongs to an app or an assistant, not both")
+	}
+
+	if name := scope.GetAssistant(); name != "" {
+		if !hasRole(ctx, roleAdmin) {
+			return "", fmt.Errorf("Not allowed, an assistant's secrets need the admin role")
+		}
+
+		kind, _, ok := strings.Cut(name, ":")
+		if !ok || !slices.Contains([]assist.Kind{assist.Builtin, assist.Local, assist.Remote}, assist.Kind(kind)) {
+			return "", fmt.Errorf("invalid assistant name `%s`: it should have the form <type>:<name>, e.g. local:prem", name)
+		}
+
+		return "assistant/" + name, nil
+	}
+
+	id, err := normAppId(ctx, scope.GetApp())
+	if err != nil {
+		return "", err
+	}
+
+	return "app/" + id, nil
+}
+
+// secretsCtl converts errors from f to a message which can be shown to the user
+func (s *Srv) secretsCtl(ctx context.Context, name string, scope *pb.SecretScope, f func(ctx context.Context, scope string) error) *pb.Error {
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+	ctx, span := trace.Span(ctx, name)
+	defer span.End()
+
+	scopeName, err := secretScope(ctx, scope)
+	if err != nil {
+		return newError(err)
+	}
+	span.SetAttributes(attribute.String("scope", scopeName))
+
+	if err := f(ctx, scopeName); err != nil {
+		return newError(err)
+	}
+
+	return nil
+}
+
+func (s *Srv) SecretsSet(ctx context.Context, req *pb.SecretsSetReq) (*pb.SecretsSetReply, error) {
+	return &pb.SecretsSetReply{
+		Error: s.secretsCtl(ctx, "secrets set", req.Scope, func(ctx context.Context, scope string) error {
+			if err := s.secrets.set(ctx, scope, req.Name, req.Value); err != nil {
+				return err
+			}
+
+			trace.Event(ctx, "set secret", attribute.String("name", req.Name))
+
+			return nil
+		}),
+	}, nil
+}
+
+func (s *Srv) SecretsList(ctx context.Context, req *pb.SecretsListReq) (*pb.SecretsListReply, error) {
+	var reply pb.SecretsListReply
+
+	reply.Error = s.secretsCtl(ctx, "secrets list", req.Scope, func(ctx context.Context, scope string) error {
+		reply.Secrets = s.secrets.list(scope)
+		return nil
+	})
+
+	return &reply, nil
+}
+
+func (s *Srv) SecretsRm(ctx context.Context, req *pb.SecretsRmReq) (*pb.SecretsRmReply, error) {
+	return &pb.SecretsRmReply{
+		Error: s.secretsCtl(ctx, "secrets rm", req.Scope, func(ctx context.Context, scope string) error {
+			if err := s.secrets.rm(ctx, scope, req.Name); err != nil {
+				return err
+			}
+
+			trace.Event(ctx, "removed secret", attribute.String("name", req.Name))
+
+			return nil
+		}),
+	}, nil
+}
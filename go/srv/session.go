@@ -0,0 +1,418 @@
+package srv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+
+	"premai.io/Ayup/go/internal/assist"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// How long a session waits for a client to reattach before it is cancelled. This only needs to
+// cover a dropped connection, because without a client nobody owns the app.
+const sessionReattachTimeout = 30 * time.Second
+
+// How long a detached session waits for a client to reattach before it is cancelled
+const sessionAbandonTimeout = 15 * time.Minute
+
+// The number of replies kept for replaying to a client which reattaches
+const sessionMaxReplies = 10000
+
+// The number of new replies which can wait to be sent to a client. A client which falls this far
+// behind is detached, it can reattach and replay what it missed.
+const sessionStreamQueue = 1000
+
+var errSessionAbandoned = errors.New("no client attached to the session")
+
+// A stream which is attached to a session
+type sessionStream struct {
+	stream pb.Srv_AssistServer
+	// Closed when another stream attaches to the session
+	superseded chan struct{}
+	// Read only streams are sent the replies, but their requests are dropped
+	readOnly bool
+	// The replies waiting to be sent by write, so that a slow client doesn't hold up the session.
+	// It is closed, with the session's mutex held, when the stream is detached.
+	queue chan *pb.ActReply
+	// Closed when write has returned and nothing else will be sent to the stream by it
+	written chan struct{}
+}
+
+// write sends the queued replies to the client until the stream is detached
+func (ss *sessionStream) write(s *session) {
+	defer close(ss.written)
+
+	for msg := range ss.queue {
+		if err := ss.stream.Send(msg); err != nil {
+			terror.Ackf(s.ctx, "stream Send: %w", err)
+			s.detach(ss)
+			break
+		}
+	}
+
+	// Empty the queue if the client went away
+	for range ss.queue {
+	}
+}
+
+// queueLocked queues a reply for the stream or detaches it if the client is too far behind
+func (s *session) queueLocked(ss *sessionStream, msg *pb.ActReply) {
+	select {
+	case ss.queue <- msg:
+	default:
+		trace.Event(s.ctx, "client too slow", attribute.Bool("readOnly", ss.readOnly))
+		s.detachLocked(ss)
+	}
+}
+
+// A session is an Assist run on an app. It is not tied to the client's stream, so that a client
+// which loses its connection can reattach, see what it missed and answer any pending choice.
+type session struct {
+	id       string
+	app      *app
+	ctx      context.Context
+	span     tr.Span
+	cancel   context.CancelFunc
+	recvChan chan assist.RecvReq
+	// The app keeps running after the session when it is detached
+	detached bool
+	// Closed after the last reply has been sent
+	done chan struct{}
+
+	mutex   sync.Mutex
+	seq     uint32
+	replies []*pb.ActReply
+	// The last choice sent if it has not been answered
+	choice *pb.ActReply
+	stream *sessionStream
+	// Read only streams, which don't replace stream or keep the session from being abandoned
+	viewers      map[*sessionStream]struct{}
+	abandonTimer *time.Timer
+}
+
+func newSessionId() (string, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bs), nil
+}
+
+func (s *Srv) newSession(ctx context.Context, a *app, detached bool) (*session, error) {
+	id, err := newSessionId()
+	if err != nil {
+		return nil, terror.Errorf(ctx, "newSessionId: %w", err)
+	}
+
+	sctx, cancel := context.WithCancel(s.appsCtx)
+	sctx, span := trace.LinkedSpan(sctx, "assist session", tr.SpanFromContext(ctx), true,
+		attribute.String("app", a.id),
+		attribute.String("session", id),
+	)
+
+	sess := &session{
+		id:       id,
+		app:      a,
+		ctx:      sctx,
+		span:     span,
+		cancel:   cancel,
+		recvChan: make(chan assist.RecvReq),
+		detached: detached,
+		done:     make(chan struct{}),
+	}
+
+	a.runMutex.Lock()
+	a.session = sess
+	a.runMutex.Unlock()
+
+	return sess, nil
+}
+
+// restoreSession recreates a session which finished before the daemon last stopped, so that a
+// client can attach to it and see the replies it missed
+func restoreSession(ctx context.Context, a *app, id string, seq uint32, replies []*pb.ActReply) *session {
+	sess := &session{
+		id:       id,
+		app:      a,
+		ctx:      ctx,
+		span:     tr.SpanFromContext(ctx),
+		cancel:   func() {},
+		recvChan: make(chan assist.RecvReq),
+		done:     make(chan struct{}),
+		seq:      seq,
+		replies:  replies,
+	}
+	close(sess.done)
+
+	return sess
+}
+
+// currentSession returns the last session started on the app, which may have finished
+func (a *app) currentSession() *session {
+	a.runMutex.Lock()
+	defer a.runMutex.Unlock()
+
+	return a.session
+}
+
+// Send records the reply so it can be replayed and queues it for the attached clients. Failing to
+// send to a client is not an error, the client can reattach later.
+func (s *session) Send(msg *pb.ActReply) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	msg.Session = s.id
+	msg.Seq = s.seq
+
+	s.replies = append(s.replies, msg)
+	if len(s.replies) > sessionMaxReplies {
+		s.replies = s.replies[len(s.replies)-sessionMaxReplies:]
+	}
+
+	if _, ok := msg.Variant.(*pb.ActReply_Choice); ok {
+		s.choice = msg
+	}
+
+	for ss := range s.viewers {
+		s.queueLocked(ss, msg)
+	}
+
+	if s.stream != nil {
+		s.queueLocked(s.stream, msg)
+	}
+
+	return nil
+}
+
+func (s *session) clearChoice() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.choice = nil
+}
+
+func (s *session) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *session) detachLocked(ss *sessionStream) {
+	if ss.readOnly {
+		if _, ok := s.viewers[ss]; ok {
+			delete(s.viewers, ss)
+			close(ss.queue)
+		}
+		return
+	}
+
+	if s.stream != ss {
+		return
+	}
+	s.stream = nil
+	close(ss.queue)
+
+	trace.Event(s.ctx, "client detached")
+
+	if s.isDone() {
+		return
+	}
+
+	timeout := sessionReattachTimeout
+	if s.detached {
+		timeout = sessionAbandonTimeout
+	}
+
+	s.abandonTimer = time.AfterFunc(timeout, func() {
+		trace.Event(s.ctx, "session abandoned")
+		s.cancel()
+
+		select {
+		case s.recvChan <- assist.RecvReq{Err: errSessionAbandoned}:
+		case <-s.done:
+		}
+	})
+}
+
+func (s *session) detach(ss *sessionStream) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.detachLocked(ss)
+}
+
+// attach queues the replies after fromSeq for stream, then new replies are queued as they are
+// sent. A stream which isn't read only replaces the one already attached.
+func (s *session) attach(ctx context.Context, stream pb.Srv_AssistServer, fromSeq uint32, readOnly bool) *sessionStream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	trace.Event(ctx, "client attached", attribute.Int("fromSeq", int(fromSeq)), attribute.Bool("readOnly", readOnly))
+
+	var replay []*pb.ActReply
+
+	if len(s.replies) > 0 && s.replies[0].Seq > fromSeq+1 {
+		replay = append(replay, newLogReply("Some earlier logs are no longer available\n"))
+	}
+
+	for _, msg := range s.replies {
+		if msg.Seq <= fromSeq && msg != s.choice {
+			continue
+		}
+
+		// Forwards are reestablished below using the ports the app has now
+		if _, ok := msg.Variant.(*pb.ActReply_Expose); ok {
+			continue
+		}
+
+		replay = append(replay, msg)
+	}
+
+	if !s.isDone() {
+		for _, port := range s.app.procs.Ports() {
+			replay = append(replay, &pb.ActReply{
+				Variant: &pb.ActReply_Expose{
+					Expose: &pb.ExposePort{
+						Port: port,
+					},
+				},
+			})
+		}
+	}
+
+	ss := &sessionStream{
+		stream:     stream,
+		superseded: make(chan struct{}),
+		readOnly:   readOnly,
+		queue:      make(chan *pb.ActReply, len(replay)+sessionStreamQueue),
+		written:    make(chan struct{}),
+	}
+	for _, msg := range replay {
+		ss.queue <- msg
+	}
+	go ss.write(s)
+
+	// Nothing more will be sent once the session is done
+	if s.isDone() {
+		close(ss.queue)
+		return ss
+	}
+
+	if readOnly {
+		if s.viewers == nil {
+			s.viewers = make(map[*sessionStream]struct{})
+		}
+		s.viewers[ss] = struct{}{}
+
+		return ss
+	}
+
+	if s.stream != nil {
+		close(s.stream.superseded)
+		s.detachLocked(s.stream)
+	}
+
+	if s.abandonTimer != nil {
+		s.abandonTimer.Stop()
+		s.abandonTimer = nil
+	}
+
+	s.stream = ss
+
+	return ss
+}
+
+// serve attaches stream to the session and passes on the client's requests until the session
+// finishes or the client goes away. The requests from a read only stream are dropped.
+func (s *session) serve(actx aCtx, stream pb.Srv_AssistServer, fromSeq uint32, readOnly bool) error {
+	ss := s.attach(actx.ctx, stream, fromSeq, readOnly)
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := ss.stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			if ss.readOnly {
+				trace.Event(actx.ctx, "dropped read only request")
+				continue
+			}
+
+			if req.Choice != nil {
+				s.clearChoice()
+			}
+
+			select {
+			case s.recvChan <- assist.RecvReq{Req: req}:
+			case <-s.done:
+				return
+			case <-ss.superseded:
+				return
+			}
+		}
+	}()
+
+	// The stream can't be sent to after serve returns, so wait for the queued replies to be sent
+	select {
+	case <-ss.written:
+		select {
+		case <-s.done:
+			return nil
+		case <-ss.superseded:
+			return actx.sendError("Another client attached to the session")
+		default:
+			return terror.Errorf(actx.ctx, "the client fell behind the session")
+		}
+	case err := <-recvErr:
+		s.detach(ss)
+		<-ss.written
+
+		if err == io.EOF {
+			return nil
+		}
+
+		return terror.Errorf(actx.ctx, "stream recv: %w", err)
+	}
+}
+
+// finish is called after the session's last reply has been sent
+func (s *session) finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	close(s.done)
+
+	// The streams' writers exit once they have sent what is queued
+	for ss := range s.viewers {
+		s.detachLocked(ss)
+	}
+	if s.stream != nil {
+		s.detachLocked(s.stream)
+	}
+
+	if s.abandonTimer != nil {
+		s.abandonTimer.Stop()
+		s.abandonTimer = nil
+	}
+
+	s.cancel()
+	s.span.End()
+}
@@ -0,0 +1,65 @@
+package srv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// A client which never reads the replies sent to it
+type stalledStream struct {
+	grpc.ServerStream
+	unblock chan struct{}
+}
+
+func (s *stalledStream) Send(*pb.ActReply) error {
+	<-s.unblock
+	return context.Canceled
+}
+
+func (s *stalledStream) Recv() (*pb.ActReq, error) {
+	<-s.unblock
+	return nil, context.Canceled
+}
+
+func TestStalledViewerDoesNotBlockSession(t *testing.T) {
+	trace.Zlog = zap.NewNop()
+
+	s := &Srv{AppsDir: t.TempDir(), appsCtx: context.Background()}
+	sess, err := s.newSession(context.Background(), s.newApp("hello"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &stalledStream{unblock: make(chan struct{})}
+	defer close(stream.unblock)
+	ss := sess.attach(context.Background(), stream, 0, true)
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for range sessionStreamQueue + 2 {
+			_ = sess.Send(newLogReply("hello\n"))
+		}
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked on the stalled viewer")
+	}
+
+	sess.mutex.Lock()
+	_, attached := sess.viewers[ss]
+	sess.mutex.Unlock()
+
+	if attached {
+		t.Error("the stalled viewer is still attached")
+	}
+}
@@ -0,0 +1,124 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	attr "go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+var errShuttingDown = errors.New("the server is shutting down, try again when it is back")
+
+// allApps returns a snapshot of the apps
+func (s *Srv) allApps() []*app {
+	s.appsMutex.Lock()
+	defer s.appsMutex.Unlock()
+
+	apps := make([]*app, 0, len(s.apps))
+	for _, a := range s.apps {
+		apps = append(apps, a)
+	}
+
+	return apps
+}
+
+// drainApp tells the app's client the server is shutting down, then asks the app to stop and waits
+// for it and its session to finish
+func (s *Srv) drainApp(ctx context.Context, a *app) {
+	ctx, span := trace.Span(ctx, "drain app", attr.String("app", a.id))
+	defer span.End()
+
+	sess := a.currentSession()
+	if sess != nil && !sess.isDone() {
+		terror.Ackf(ctx, "session Send: %w", sess.Send(newLogReply("The server is shutting down\n")))
+	}
+
+	a.runMutex.Lock()
+	run := a.run
+	a.runMutex.Unlock()
+
+	// An app may be executing in the session or in the background
+	if err := a.procs.Signal(ctx, s.StopSignal); err != nil {
+		terror.Ackf(ctx, "procs Signal: %w", err)
+	}
+
+	if run != nil {
+		<-run.done
+	}
+
+	if sess != nil {
+		<-sess.done
+	}
+}
+
+// drain stops new work from being accepted, then stops the apps and sessions. Anything still
+// running after StopTimeout is cancelled. The sessions are saved so that clients can see how
+// they ended after the daemon restarts.
+func (s *Srv) drain(ctx context.Context, cancelApps context.CancelFunc) {
+	ctx, span := trace.Span(ctx, "drain")
+	defer span.End()
+
+	s.draining.Store(true)
+
+	s.tuiMutex.Lock()
+	fmt.Println(tui.TitleStyle.Render("Shutting down:"), "stopping apps and sessions")
+	s.tuiMutex.Unlock()
+
+	apps := s.allApps()
+
+	var wg sync.WaitGroup
+	for _, a := range apps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.drainApp(ctx, a)
+		}()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(s.StopTimeout):
+		trace.Event(ctx, "apps did not stop in time, cancelling them")
+	}
+
+	cancelApps()
+	<-drained
+
+	for _, a := range apps {
+		if err := a.saveSession(ctx); err != nil {
+			terror.Ackf(ctx, "saveSession: %w", err)
+		}
+	}
+}
+
+// stopGrpc waits for the remaining requests to finish, the streams which outlive the timeout
+// are closed
+func (s *Srv) stopGrpc(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(s.StopTimeout):
+		trace.Event(ctx, "requests did not finish in time, closing them")
+		srv.Stop()
+		<-stopped
+	}
+}
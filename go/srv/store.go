@@ -0,0 +1,266 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"premai.io/Ayup/go/internal/assist"
+	"premai.io/Ayup/go/internal/fs"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// The file in AppsDir which lists the known apps
+const appsIndexName = "index.json"
+
+// The file in an app's root which holds its last session when the daemon stopped
+const sessionFileName = "session.json"
+
+type savedSession struct {
+	Id      string            `json:"id"`
+	Seq     uint32            `json:"seq"`
+	Replies []json.RawMessage `json:"replies"`
+}
+
+type appsIndex struct {
+	Apps []string `json:"apps"`
+}
+
+func (a *app) builtDir() string {
+	return filepath.Join(a.root, "built")
+}
+
+// The marker file which says the app should be running in the background
+func (a *app) runningPath() string {
+	return filepath.Join(a.root, "running")
+}
+
+func (a *app) setWantRunning(ctx context.Context, want bool) error {
+	path := a.runningPath()
+
+	if !want {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return terror.Errorf(ctx, "os Remove: %w", err)
+		}
+
+		return nil
+	}
+
+	return fs.WriteFile(ctx, nil, path)
+}
+
+func exists(ctx context.Context, path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, terror.Errorf(ctx, "os Stat: %w", err)
+	}
+
+	return true, nil
+}
+
+// saveAppsIndex writes the list of apps, appsMutex must be held
+func (s *Srv) saveAppsIndex(ctx context.Context) error {
+	index := appsIndex{
+		Apps: make([]string, 0, len(s.apps)),
+	}
+	for id := range s.apps {
+		index.Apps = append(index.Apps, id)
+	}
+	slices.Sort(index.Apps)
+
+	bs, err := json.Marshal(index)
+	if err != nil {
+		return terror.Errorf(ctx, "json Marshal: %w", err)
+	}
+
+	tmpPath := filepath.Join(s.AppsDir, appsIndexName+".tmp")
+	if err := fs.WriteFile(ctx, bs, tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(s.AppsDir, appsIndexName)); err != nil {
+		return terror.Errorf(ctx, "os Rename: %w", err)
+	}
+
+	return nil
+}
+
+// saveSession writes the app's last session, if it has one
+func (a *app) saveSession(ctx context.Context) error {
+	sess := a.currentSession()
+	if sess == nil {
+		return nil
+	}
+
+	sess.mutex.Lock()
+	saved := savedSession{
+		Id:      sess.id,
+		Seq:     sess.seq,
+		Replies: make([]json.RawMessage, 0, len(sess.replies)),
+	}
+	for _, msg := range sess.replies {
+		bs, err := protojson.Marshal(msg)
+		if err != nil {
+			sess.mutex.Unlock()
+			return terror.Errorf(ctx, "protojson Marshal: %w", err)
+		}
+		saved.Replies = append(saved.Replies, bs)
+	}
+	sess.mutex.Unlock()
+
+	bs, err := json.Marshal(saved)
+	if err != nil {
+		return terror.Errorf(ctx, "json Marshal: %w", err)
+	}
+
+	return fs.WriteFile(ctx, bs, a.root, sessionFileName)
+}
+
+func (a *app) loadSession(ctx context.Context) error {
+	bs, err := fs.ReadFile(ctx, a.root, sessionFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var saved savedSession
+	if err := json.Unmarshal(bs, &saved); err != nil {
+		return terror.Errorf(ctx, "json Unmarshal: %w", err)
+	}
+
+	replies := make([]*pb.ActReply, 0, len(saved.Replies))
+	for _, raw := range saved.Replies {
+		var msg pb.ActReply
+		if err := protojson.Unmarshal(raw, &msg); err != nil {
+			return terror.Errorf(ctx, "protojson Unmarshal: %w", err)
+		}
+		replies = append(replies, &msg)
+	}
+
+	a.session = restoreSession(ctx, a, saved.Id, saved.Seq, replies)
+
+	return nil
+}
+
+func (s *Srv) loadApp(ctx context.Context, id string) (*app, error) {
+	a := s.newApp(id)
+
+	if err := a.loadOwner(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := a.loadSession(ctx); err != nil {
+		terror.Ackf(ctx, "loadSession: %w", err)
+	}
+
+	hasAssistant, err := exists(ctx, a.AssistantDir)
+	if err != nil {
+		return nil, err
+	}
+	a.hasAssistant = hasAssistant
+
+	hasBuilt, err := exists(ctx, a.builtDir())
+	if err != nil {
+		return nil, err
+	}
+
+	if hasBuilt {
+		state, err := assist.LoadBuilt(ctx, filepath.Join(a.AppDir, ".ayup"), a.builtDir(), s.registry)
+		if err != nil {
+			return nil, err
+		}
+		a.built = &state
+	}
+
+	return a, nil
+}
+
+// loadApps reads the apps which were pushed before the daemon was last stopped
+func (s *Srv) loadApps(ctx context.Context) error {
+	ctx, span := trace.Span(ctx, "load apps")
+	defer span.End()
+
+	if err := os.MkdirAll(s.AppsDir, 0700); err != nil {
+		return terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+
+	bs, err := fs.ReadFile(ctx, s.AppsDir, appsIndexName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var index appsIndex
+	if err := json.Unmarshal(bs, &index); err != nil {
+		return terror.Errorf(ctx, "json Unmarshal: %w", err)
+	}
+
+	s.appsMutex.Lock()
+	defer s.appsMutex.Unlock()
+
+	for _, id := range index.Apps {
+		if _, err := normAppId(ctx, id); err != nil {
+			terror.Ackf(ctx, "normAppId: %w", err)
+			continue
+		}
+
+		a, err := s.loadApp(ctx, id)
+		if err != nil {
+			terror.Ackf(ctx, "loadApp: %w", err)
+			continue
+		}
+
+		trace.Event(ctx, "loaded app", attribute.String("id", id), attribute.Bool("built", a.built != nil))
+		s.apps[id] = a
+	}
+
+	return nil
+}
+
+// restartApps starts the apps which were running in the background when the daemon stopped
+func (s *Srv) restartApps(ctx context.Context) {
+	ctx, span := trace.Span(ctx, "restart apps")
+	defer span.End()
+
+	for _, a := range s.allApps() {
+		if s.draining.Load() {
+			return
+		}
+
+		want, err := exists(ctx, a.runningPath())
+		if err != nil {
+			terror.Ackf(ctx, "exists: %w", err)
+			continue
+		}
+
+		if !want {
+			continue
+		}
+
+		err = s.startApp(ctx, a)
+
+		s.tuiMutex.Lock()
+		if err != nil {
+			fmt.Println(tui.ErrorStyle.Render("Couldn't restart app:"), a.id, err)
+		} else {
+			fmt.Println(tui.TitleStyle.Render("Restarted app:"), a.id)
+		}
+		s.tuiMutex.Unlock()
+	}
+}
@@ -8,11 +8,39 @@ import (
 	attr "go.opentelemetry.io/otel/attribute"
 
 	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/metrics"
 	"premai.io/Ayup/go/internal/rpc"
 	"premai.io/Ayup/go/internal/terror"
 	"premai.io/Ayup/go/internal/trace"
 )
 
+// Replays the first message of an upload, which we had to read to find out the app, and checks
+// the following ones are for the same app
+type peekedChunksRecver struct {
+	appId  string
+	first  *pb.FileChunks
+	stream pb.Srv_UploadServer
+}
+
+func (s *peekedChunksRecver) Recv() (*pb.FileChunks, error) {
+	if s.first != nil {
+		chunks := s.first
+		s.first = nil
+		return chunks, nil
+	}
+
+	chunks, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	if chunks.App != s.appId {
+		return nil, terror.Errorf(s.stream.Context(), "upload switched app to %s", chunks.App)
+	}
+
+	return chunks, nil
+}
+
 func (s *Srv) Download(req *pb.DownloadReq, stream pb.Srv_DownloadServer) error {
 	ctx := stream.Context()
 
@@ -25,9 +53,20 @@ func (s *Srv) Download(req *pb.DownloadReq, stream pb.Srv_DownloadServer) error
 		return sendError("internal error")
 	}
 
-	fileSender := rpc.NewFileSender(stream, nil, nil, sendError, internalError)
+	a, err := s.getApp(ctx, req.App)
+	if err != nil {
+		return err
+	}
+
+	if !a.busy.TryLock() {
+		return sendError("App busy: %s", a.id)
+	}
+	defer a.busy.Unlock()
+
+	fileSender := rpc.NewFileSender(stream, req.App, nil, nil, sendError, internalError)
+	fileSender.SetCompression(rpc.NegotiateCompression(req.Accept))
 
-	if err := fileSender.SendDir(ctx, pb.Source_app, s.AppDir); err != nil {
+	if err := fileSender.SendDir(ctx, pb.Source_app, a.AppDir); err != nil {
 		return err
 	}
 
@@ -36,13 +75,20 @@ func (s *Srv) Download(req *pb.DownloadReq, stream pb.Srv_DownloadServer) error
 
 func (s *Srv) Upload(stream pb.Srv_UploadServer) error {
 	ctx := stream.Context()
-	ctx, span := trace.Span(ctx, "upload", attr.String("srcDir", s.AppDir), attr.String("assDir", s.AssistantDir))
+	ctx, span := trace.Span(ctx, "upload")
 	defer span.End()
 
+	// The stream is closed after the first error, so further errors are only logged
+	closed := false
 	sendErrorClose := func(msgf string, args ...any) error {
 		oerr := terror.Errorf(ctx, msgf, args...)
+		if closed {
+			return nil
+		}
+		closed = true
+
 		err := stream.SendAndClose(&pb.Result{
-			Error: &pb.Error{Error: oerr.Error()},
+			Error: newError(oerr),
 		})
 		if err != nil {
 			_ = terror.Errorf(ctx, "stream send and close: %w", err)
@@ -55,41 +101,132 @@ func (s *Srv) Upload(stream pb.Srv_UploadServer) error {
 		return sendErrorClose("internal error")
 	}
 
-	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
-		if err != nil {
-			return internalError("checkPeerAuth: %w", err)
+	if s.draining.Load() {
+		return sendErrorClose("%w", errShuttingDown)
+	}
+
+	first, err := stream.Recv()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return internalError("stream Recv: %w", err)
+	}
+
+	var appId, uploadId string
+	var partial, resume bool
+	if first != nil {
+		appId = first.App
+		partial = first.Partial
+		uploadId = first.Upload
+		resume = first.Resume
+	}
+
+	a, err := s.getApp(ctx, appId)
+	if err != nil {
+		return sendErrorClose("%w", err)
+	}
+	span.SetAttributes(
+		attr.String("app", a.id),
+		attr.String("srcDir", a.AppDir),
+		attr.String("assDir", a.AssistantDir),
+		attr.Bool("partial", partial),
+		attr.String("upload", uploadId),
+		attr.Bool("resume", resume),
+	)
+
+	if !a.busy.TryLock() {
+		return sendErrorClose("App busy: %s", a.id)
+	}
+	defer a.busy.Unlock()
+
+	up, resumed, err := a.beginUpload(ctx, uploadId, resume, partial)
+	if err != nil {
+		return sendErrorClose("%w", err)
+	}
+	finished := false
+	defer func() { a.endUpload(up, finished) }()
+	partial = up.partial
+
+	// The app's files change even if the upload fails
+	defer a.changedUsage()
+
+	// A partial upload only contains what changed since the last one, so it is written to the
+	// app's source. A full upload is received into the staging directory, a resumed one continues
+	// from where the last one stopped.
+	appDir, assistDir := a.AppDir, a.AssistantDir
+	if !partial {
+		appDir, assistDir = a.stagingDirs()
+
+		if !resumed {
+			if err := a.clearStaging(ctx); err != nil {
+				return internalError("clearStaging: %w", err)
+			}
 		}
+	}
 
-		return sendErrorClose("Not authorized")
+	if err := os.MkdirAll(appDir, 0700); err != nil {
+		return internalError("os MkdirAll: %w", err)
 	}
 
-	if _, err := os.Stat(s.AssistantDir); err == nil {
-		if err := os.RemoveAll(s.AssistantDir); err != nil {
-			return internalError("RemoveAll: %w", err)
+	owner := peerName(ctx)
+
+	if first != nil {
+		quota, err := s.uploadQuota(ctx, a, owner, !partial, up.progress.Total())
+		if err != nil {
+			return internalError("uploadQuota: %w", err)
+		}
+
+		recver := &peekedChunksRecver{appId: appId, first: first, stream: stream}
+		fileRecvr := rpc.NewFileRecver(recver, nil, sendErrorClose, internalError, appDir, assistDir)
+		fileRecvr.SetProgress(up.progress)
+		fileRecvr.SetQuota(func(n int64) error {
+			if err := quota(n); err != nil {
+				return err
+			}
+
+			metrics.UploadBytes.Add(float64(n))
+			return nil
+		})
+
+		// Only the quota returns an error, the others are sent to the client and return nil
+		if err := fileRecvr.RecvDirs(ctx); err != nil && !errors.Is(err, io.EOF) {
+			return sendErrorClose("%w", err)
+		}
+
+		// RecvDirs also stops without an error if the client goes away
+		if closed || ctx.Err() != nil {
+			return nil
 		}
+
+		up.assistant = up.assistant || fileRecvr.RecvedAssistant
 	}
 
-	if err := os.RemoveAll(s.AppDir); err != nil && !os.IsNotExist(err) {
-		return internalError("RemoveAll: %w", err)
+	if !partial {
+		if err := a.swapUpload(ctx); err != nil {
+			return internalError("swapUpload: %w", err)
+		}
 	}
 
-	if err := os.MkdirAll(s.AppDir, 0700); err != nil {
-		return internalError("os MkdirAll: %w", err)
+	// The app only counts against the client once its upload is complete
+	if err := a.setOwner(ctx, owner); err != nil {
+		return internalError("setOwner: %w", err)
 	}
 
-	fileRecvr := rpc.NewFileRecver(stream, nil, sendErrorClose, internalError, s.AppDir, s.AssistantDir)
+	if !partial {
+		a.hasAssistant = up.assistant
+	}
+	finished = true
 
-	if err := fileRecvr.RecvDirs(ctx); err != nil {
-		if !errors.Is(err, io.EOF) {
-			return err
+	// Partial uploads may follow a manifest, otherwise the manifest is stale
+	if partial {
+		if err := a.finishManifest(ctx); err != nil {
+			return internalError("finishManifest: %w", err)
 		}
+	} else {
+		a.pendingManifest = nil
 	}
 
 	if err := stream.SendAndClose(&pb.Result{}); err != nil {
 		return internalError("stream send and close: %w", err)
 	}
 
-	s.push.hasAssistant = fileRecvr.RecvedAssistant
-
 	return nil
 }
@@ -0,0 +1,129 @@
+package srv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// An upload which can be resumed with the same ID if the client loses its connection
+type appUpload struct {
+	id        string
+	partial   bool
+	progress  *rpc.RecvProgress
+	assistant bool
+	// Set while a stream is receiving the upload
+	active bool
+}
+
+// beginUpload starts a new upload or continues the last one if resume is set
+func (a *app) beginUpload(ctx context.Context, id string, resume bool, partial bool) (*appUpload, bool, error) {
+	a.uploadMutex.Lock()
+	defer a.uploadMutex.Unlock()
+
+	if resume {
+		if id == "" || a.upload == nil || a.upload.id != id {
+			return nil, false, terror.Errorf(ctx, "the upload can't be resumed, it has been replaced or finished")
+		}
+
+		a.upload.active = true
+		return a.upload, true, nil
+	}
+
+	a.upload = &appUpload{
+		id:       id,
+		partial:  partial,
+		progress: rpc.NewRecvProgress(),
+		active:   true,
+	}
+
+	return a.upload, false, nil
+}
+
+// endUpload forgets the upload if it finished, otherwise it can be resumed
+func (a *app) endUpload(up *appUpload, finished bool) {
+	a.uploadMutex.Lock()
+	defer a.uploadMutex.Unlock()
+
+	up.active = false
+
+	if finished && a.upload == up {
+		a.upload = nil
+	}
+}
+
+func (s *Srv) UploadProgress(ctx context.Context, req *pb.UploadProgressReq) (*pb.UploadProgressReply, error) {
+	reply := &pb.UploadProgressReply{}
+
+	reply.Error = s.appCtl(ctx, req.App, func(a *app) error {
+		a.uploadMutex.Lock()
+		defer a.uploadMutex.Unlock()
+
+		up := a.upload
+		if req.Upload == "" || up == nil || up.id != req.Upload {
+			return nil
+		}
+
+		reply.Found = true
+		reply.Active = up.active
+		reply.Files = up.progress.Files()
+
+		return nil
+	})
+
+	return reply, nil
+}
+
+// The directory in an app's root which full uploads are received into. The app's source is only
+// replaced once the upload is complete, so an upload which fails or goes over quota leaves it as
+// it was.
+const uploadStagingName = "upload"
+
+// stagingDirs are where the source of a full upload is received, see uploadStagingName
+func (a *app) stagingDirs() (string, string) {
+	staging := filepath.Join(a.root, uploadStagingName)
+
+	return filepath.Join(staging, "app"), filepath.Join(staging, "assist")
+}
+
+// clearStaging removes what was received by a full upload which won't be finished
+func (a *app) clearStaging(ctx context.Context) error {
+	if err := os.RemoveAll(filepath.Join(a.root, uploadStagingName)); err != nil {
+		return terror.Errorf(ctx, "os RemoveAll: %w", err)
+	}
+
+	return nil
+}
+
+// swapUpload replaces the app's source with the full upload in the staging directory
+func (a *app) swapUpload(ctx context.Context) error {
+	appDir, assistDir := a.stagingDirs()
+
+	for _, dirs := range [][2]string{{appDir, a.AppDir}, {assistDir, a.AssistantDir}} {
+		from, to := dirs[0], dirs[1]
+		old := to + ".old"
+
+		if err := os.RemoveAll(old); err != nil {
+			return terror.Errorf(ctx, "os RemoveAll: %w", err)
+		}
+
+		if err := os.Rename(to, old); err != nil && !os.IsNotExist(err) {
+			return terror.Errorf(ctx, "os Rename: %w", err)
+		}
+
+		// The upload may not have an assistant
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return terror.Errorf(ctx, "os Rename: %w", err)
+		}
+
+		if err := os.RemoveAll(old); err != nil {
+			return terror.Errorf(ctx, "os RemoveAll: %w", err)
+		}
+	}
+
+	return a.clearStaging(ctx)
+}